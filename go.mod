@@ -6,13 +6,20 @@ toolchain go1.24.6
 
 require (
 	github.com/gorilla/websocket v1.5.3
+	github.com/quic-go/quic-go v0.59.0
+	github.com/xtaci/kcp-go/v5 v5.6.19
 	github.com/xtaci/smux v1.5.28
 	golang.org/x/crypto v0.42.0
+	golang.org/x/sys v0.36.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
-	github.com/stretchr/testify v1.11.0 // indirect
-	golang.org/x/sys v0.36.0 // indirect
-
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/klauspost/reedsolomon v1.12.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/templexxx/cpu v0.1.1 // indirect
+	github.com/templexxx/xorsimd v0.4.3 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
+	golang.org/x/net v0.43.0 // indirect
 )
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"path"
+	"strings"
+)
+
+// ParseIdentityPatterns 解析逗号分隔的证书身份模式列表，例如 "gw-*.example.com, spiffe://fleet/*"
+func ParseIdentityPatterns(value string) []string {
+	var patterns []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// MatchIdentity 报告证书身份是否匹配 patterns 中的任意一个 (path.Match 通配符)
+func MatchIdentity(patterns []string, identity string) bool {
+	if identity == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, identity); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"liuproxy_remote/remote/types"
+)
+
+// MaxPadding 是单帧填充长度的上限，保证填充后的帧仍能放进 16 位长度头
+const MaxPadding = 16 * 1024
+
+// Range 是一个闭区间 [Min, Max]，零值表示总是 0
+type Range struct {
+	Min, Max int
+}
+
+// ParseRange 解析 "min-max" 或单个数字 (等价于 "n-n")
+func ParseRange(value string) (Range, error) {
+	minStr, maxStr, found := strings.Cut(value, "-")
+	if !found {
+		maxStr = minStr
+	}
+	lo, err1 := strconv.Atoi(strings.TrimSpace(minStr))
+	hi, err2 := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err1 != nil || err2 != nil || lo < 0 || hi < lo {
+		return Range{}, fmt.Errorf("invalid range '%s' (want min-max)", value)
+	}
+	return Range{Min: lo, Max: hi}, nil
+}
+
+// Rand 返回区间内的一个均匀随机数
+func (r Range) Rand() int {
+	if r.Max <= r.Min {
+		return r.Min
+	}
+	return r.Min + rand.IntN(r.Max-r.Min+1)
+}
+
+// IsZero 报告区间是否总是 0
+func (r Range) IsZero() bool {
+	return r.Max == 0
+}
+
+// PaddingPolicy 是服务端对一个用户的流量整形策略。
+// 它只用于在元数据中请求了填充帧格式 (流量整形) 的客户端，其他客户端的帧格式和发送时机不变。
+type PaddingPolicy struct {
+	// Frame 是每个下行帧附加的随机填充字节数
+	Frame Range
+	// First 是客户端第一个包 (元数据) 必须携带的填充字节数，用于掩盖这个很小的包；
+	// 零值表示不检查
+	First Range
+	// Jitter 是每个下行帧发送前的随机延迟 (毫秒)
+	Jitter Range
+}
+
+// NextPadding 返回下一个下行帧的填充长度
+func (p *PaddingPolicy) NextPadding() int {
+	return p.Frame.Rand()
+}
+
+// NextDelay 返回下一个下行帧发送前的延迟
+func (p *PaddingPolicy) NextDelay() time.Duration {
+	return time.Duration(p.Jitter.Rand()) * time.Millisecond
+}
+
+// CheckFirst 确认客户端第一个包中的填充字节数 n 落在 First 区间内
+func (p *PaddingPolicy) CheckFirst(n int) error {
+	if p.First.IsZero() || (n >= p.First.Min && n <= p.First.Max) {
+		return nil
+	}
+	return fmt.Errorf("first packet carries %d padding bytes, want %d-%d", n, p.First.Min, p.First.Max)
+}
+
+// parsePaddingPolicy 解析填充配置。用户级的每一项为空时沿用 base (监听器级) 的设置。
+func parsePaddingPolicy(base PaddingPolicy, conf types.PaddingConf) (PaddingPolicy, error) {
+	policy := base
+	fields := []struct {
+		name  string
+		value string
+		dst   *Range
+		limit int
+	}{
+		{"padding", conf.Frame, &policy.Frame, MaxPadding},
+		{"padding_first", conf.First, &policy.First, MaxPadding},
+		{"padding_jitter", conf.Jitter, &policy.Jitter, 1000},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		r, err := ParseRange(f.value)
+		if err != nil {
+			return PaddingPolicy{}, fmt.Errorf("%s: %w", f.name, err)
+		}
+		if r.Max > f.limit {
+			return PaddingPolicy{}, fmt.Errorf("%s: maximum %d exceeds limit %d", f.name, r.Max, f.limit)
+		}
+		*f.dst = r
+	}
+	return policy, nil
+}
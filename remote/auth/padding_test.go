@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"testing"
+
+	"liuproxy_remote/remote/types"
+)
+
+func TestParsePaddingPolicy_UserOverridesListener(t *testing.T) {
+	base, err := parsePaddingPolicy(PaddingPolicy{}, types.PaddingConf{Frame: "0-256", Jitter: "5"})
+	if err != nil {
+		t.Fatalf("listener policy: %v", err)
+	}
+	policy, err := parsePaddingPolicy(base, types.PaddingConf{First: "200-800"})
+	if err != nil {
+		t.Fatalf("user policy: %v", err)
+	}
+	want := PaddingPolicy{Frame: Range{0, 256}, First: Range{200, 800}, Jitter: Range{5, 5}}
+	if policy != want {
+		t.Fatalf("policy = %+v, want %+v", policy, want)
+	}
+	for i := 0; i < 100; i++ {
+		if n := policy.NextPadding(); n > 256 {
+			t.Fatalf("frame padding %d outside 0-256", n)
+		}
+	}
+	for n, ok := range map[int]bool{0: false, 199: false, 200: true, 800: true, 801: false} {
+		if err := policy.CheckFirst(n); (err == nil) != ok {
+			t.Errorf("CheckFirst(%d) = %v, want ok=%v", n, err, ok)
+		}
+	}
+	if err := base.CheckFirst(0); err != nil {
+		t.Errorf("CheckFirst without padding_first = %v", err)
+	}
+
+	for _, bad := range []string{"abc", "10-5", "-1", "0-99999"} {
+		if _, err := parsePaddingPolicy(base, types.PaddingConf{Frame: bad}); err == nil {
+			t.Errorf("padding = %q should be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/stats"
+	"liuproxy_remote/remote/types"
+)
+
+// LegacyUserName 是开启 legacy_crypt 后，由 [common] crypt 生成的兼容用户的名字
+const LegacyUserName = "legacy"
+
+// oldKeyLogInterval 限制"客户端仍在使用旧密钥"日志的频率，每个用户每代密钥每个周期最多一条
+const oldKeyLogInterval = 10 * time.Minute
+
+// ErrUnknownUser 表示没有任何用户的密钥能解开给定的密文
+var ErrUnknownUser = errors.New("no user key matches the ciphertext")
+
+var decryptFailures = stats.Get("auth_decrypt_failures")
+
+// User 是一个已配置的隧道用户及其密钥环
+type User struct {
+	Name string
+	// Security 是该用户的流必须达到的最低安全级别
+	Security SecurityLevel
+	// Padding 是该用户下行流量的填充和延迟抖动策略
+	Padding PaddingPolicy
+	// Certs 不为空时，该用户的流只能来自客户端证书身份匹配其中某个模式的 TLS 连接
+	Certs []string
+	// token 和 wsPath 用于在 WebSocket 升级时认证该用户，空字符串表示未设置
+	token   string
+	wsPath  string
+	keyring *securecrypt.Keyring
+	// socks5Password 是内置 SOCKS5 代理的登录密码，空字符串表示该用户不能使用 SOCKS5
+	socks5Password string
+	// suite 是用户自己配置的加密套件 (空字符串表示沿用监听器设置)，
+	// secrets 是各代口令派生出的密钥，监听器改用其他套件时据此重建密钥环
+	suite   string
+	secrets []derivedSecret
+}
+
+// derivedSecret 是一代口令经 Argon2id 派生出的密钥
+type derivedSecret struct {
+	generation  int
+	retireAfter time.Time
+	key         []byte
+}
+
+// newKeyring 用 suite 指定的套件为每一代密钥创建加密器
+func (u *User) newKeyring(suite string) (*securecrypt.Keyring, error) {
+	suites, err := securecrypt.ResolveSuites(suite)
+	if err != nil {
+		return nil, fmt.Errorf("user '%s': %w", u.Name, err)
+	}
+	var keys []*securecrypt.Key
+	for _, secret := range u.secrets {
+		for _, s := range suites {
+			cipher, err := securecrypt.NewCipherWithKey(s, secret.key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create %s cipher for user '%s' key generation %d: %w", s, u.Name, secret.generation, err)
+			}
+			keys = append(keys, &securecrypt.Key{Generation: secret.generation, RetireAfter: secret.retireAfter, Cipher: cipher})
+		}
+	}
+	return securecrypt.NewKeyring(keys...), nil
+}
+
+// AllowsIdentity 报告客户端证书身份为 identity (可能为空) 的连接能否使用该用户
+func (u *User) AllowsIdentity(identity string) bool {
+	return len(u.Certs) == 0 || MatchIdentity(u.Certs, identity)
+}
+
+// Keyring 返回该用户当前被接受的所有密钥
+func (u *User) Keyring() *securecrypt.Keyring {
+	return u.keyring
+}
+
+// String 便于在日志中直接打印用户
+func (u *User) String() string {
+	if u == nil {
+		return "<unknown>"
+	}
+	return u.Name
+}
+
+// Registry 保存所有用户，并负责判断一段密文属于哪个用户
+type Registry struct {
+	users []*User
+
+	// oldKeyLogged 记录每个 "用户/代数" 上一次输出旧密钥日志的时间
+	oldKeyMu     sync.Mutex
+	oldKeyLogged map[string]time.Time
+}
+
+// NewRegistry 根据配置创建用户表。
+// 每个用户的口令都经过 Argon2id 派生，这一步较慢，因此只在启动时执行一次。
+// 开启 legacy_crypt 时，额外用 [common] crypt 创建一个名为 "legacy" 的兼容用户，
+// 使尚未迁移的旧网关可以继续工作。
+func NewRegistry(cfg *types.Config) (*Registry, error) {
+	r := &Registry{oldKeyLogged: make(map[string]time.Time)}
+	now := time.Now()
+	listenerPadding, err := parsePaddingPolicy(PaddingPolicy{}, types.PaddingConf{
+		Frame:  cfg.RemoteConf.Padding,
+		First:  cfg.RemoteConf.PaddingFirst,
+		Jitter: cfg.RemoteConf.PaddingJitter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, conf := range cfg.Users {
+		if conf.Name == LegacyUserName && cfg.CommonConf.LegacyCrypt {
+			return nil, fmt.Errorf("user name '%s' is reserved while legacy_crypt is enabled", LegacyUserName)
+		}
+		suite := conf.Suite
+		if suite == "" {
+			suite = cfg.RemoteConf.Suite
+		}
+		security, err := ParseSecurityLevel(conf.Security)
+		if err != nil {
+			return nil, fmt.Errorf("user '%s': %w", conf.Name, err)
+		}
+		padding, err := parsePaddingPolicy(listenerPadding, conf.Padding)
+		if err != nil {
+			return nil, fmt.Errorf("user '%s': %w", conf.Name, err)
+		}
+
+		var secrets []derivedSecret
+		for _, kc := range conf.Keys {
+			if !kc.RetireAfter.IsZero() && !kc.RetireAfter.After(now) {
+				log.Printf("[AUTH] User '%s' key generation %d retired at %s and will not be accepted.", conf.Name, kc.Generation, kc.RetireAfter.Format(time.RFC3339))
+			}
+			secrets = append(secrets, derivedSecret{generation: kc.Generation, retireAfter: kc.RetireAfter, key: securecrypt.DeriveKey(conf.Name, kc.Secret)})
+		}
+		u := &User{Name: conf.Name, Security: security, Padding: padding, Certs: ParseIdentityPatterns(conf.Certs), token: conf.Token, wsPath: conf.WsPath, socks5Password: conf.Socks5Password, suite: conf.Suite, secrets: secrets}
+		if u.keyring, err = u.newKeyring(suite); err != nil {
+			return nil, err
+		}
+		r.users = append(r.users, u)
+	}
+
+	if cfg.CommonConf.LegacyCrypt {
+		cipher, err := securecrypt.NewCipher(cfg.CommonConf.Crypt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create legacy cipher: %w", err)
+		}
+		keyring := securecrypt.NewKeyring(&securecrypt.Key{Generation: 0, Cipher: cipher})
+		r.users = append(r.users, &User{Name: LegacyUserName, Padding: listenerPadding, keyring: keyring})
+		log.Printf("[AUTH] WARNING: legacy_crypt is enabled. Clients using the integer 'crypt' key are accepted as user '%s'.", LegacyUserName)
+	}
+
+	if err := r.checkUpgradeCredentials(); err != nil {
+		return nil, err
+	}
+	if len(r.users) == 0 {
+		return nil, errors.New("no users configured: add a [users] section, or set legacy_crypt = true to keep using 'crypt'")
+	}
+	log.Printf("[AUTH] Loaded %d user(s).", len(r.users))
+	return r, nil
+}
+
+// Lookup 按名字查找用户
+func (r *Registry) Lookup(name string) *User {
+	for _, u := range r.users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// Subset 返回只包含 names 中用户的用户表，用于限制某个监听器可以接入的用户。
+// names 为空时返回 r 本身；未知的用户名返回错误。
+func (r *Registry) Subset(names []string) (*Registry, error) {
+	if len(names) == 0 {
+		return r, nil
+	}
+	sub := &Registry{oldKeyLogged: make(map[string]time.Time)}
+	for _, name := range names {
+		u := r.Lookup(name)
+		if u == nil {
+			return nil, fmt.Errorf("unknown user '%s'", name)
+		}
+		if !slices.Contains(sub.users, u) {
+			sub.users = append(sub.users, u)
+		}
+	}
+	return sub, nil
+}
+
+// WithSuite 返回一个用户表，其中未单独配置 suite 的用户改用 suite 套件，用于监听器级的套件设置。
+// suite 为空时返回 r 本身；兼容用户 legacy 始终使用 XChaCha20-Poly1305。
+func (r *Registry) WithSuite(suite string) (*Registry, error) {
+	if suite == "" {
+		return r, nil
+	}
+	out := &Registry{oldKeyLogged: make(map[string]time.Time)}
+	for _, u := range r.users {
+		if u.suite != "" || u.secrets == nil {
+			out.users = append(out.users, u)
+			continue
+		}
+		copied := *u
+		keyring, err := u.newKeyring(suite)
+		if err != nil {
+			return nil, err
+		}
+		copied.keyring = keyring
+		out.users = append(out.users, &copied)
+	}
+	return out, nil
+}
+
+// checkUpgradeCredentials 确认令牌和秘密路径不重复，秘密路径以 "/" 开头
+func (r *Registry) checkUpgradeCredentials() error {
+	tokens := make(map[string]bool)
+	paths := make(map[string]bool)
+	for _, u := range r.users {
+		if u.token != "" {
+			if tokens[u.token] {
+				return fmt.Errorf("user '%s': token is already used by another user", u.Name)
+			}
+			tokens[u.token] = true
+		}
+		if u.wsPath != "" {
+			if !strings.HasPrefix(u.wsPath, "/") {
+				return fmt.Errorf("user '%s': ws_path must start with '/'", u.Name)
+			}
+			if paths[u.wsPath] {
+				return fmt.Errorf("user '%s': ws_path '%s' is already used by another user", u.Name, u.wsPath)
+			}
+			paths[u.wsPath] = true
+		}
+	}
+	return nil
+}
+
+// LookupToken 返回令牌为 token 的用户，没有时返回 nil。比较以常数时间进行。
+func (r *Registry) LookupToken(token string) *User {
+	if token == "" {
+		return nil
+	}
+	var found *User
+	for _, u := range r.users {
+		if u.token != "" && subtle.ConstantTimeCompare([]byte(u.token), []byte(token)) == 1 {
+			found = u
+		}
+	}
+	return found
+}
+
+// LookupSOCKS5 返回用户名为 name、SOCKS5 密码为 password 的用户，不匹配时返回 nil。密码比较以常数时间进行。
+func (r *Registry) LookupSOCKS5(name, password string) *User {
+	u := r.Lookup(name)
+	if u == nil || u.socks5Password == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(u.socks5Password), []byte(password)) != 1 {
+		return nil
+	}
+	return u
+}
+
+// LookupPath 返回秘密 WebSocket 路径为 path 的用户，没有时返回 nil
+func (r *Registry) LookupPath(path string) *User {
+	for _, u := range r.users {
+		if u.wsPath != "" && u.wsPath == path {
+			return u
+		}
+	}
+	return nil
+}
+
+// Identify 依次用每个用户密钥环中的有效密钥尝试解密 ciphertext，
+// 返回第一个匹配的用户、匹配的那一代密钥和明文。调用方应在整个流中继续使用该密钥。
+// hint 不为 nil 时会被优先尝试，通常是同一会话中上一次匹配到的用户。
+// peer 仅用于日志，可以为 nil。
+func (r *Registry) Identify(ciphertext []byte, hint *User, peer net.Addr) (*User, *securecrypt.Key, []byte, error) {
+	if hint != nil {
+		if key, plaintext, err := hint.keyring.Open(ciphertext); err == nil {
+			r.noteKeyUse(hint, key, peer)
+			return hint, key, plaintext, nil
+		}
+	}
+	for _, u := range r.users {
+		if u == hint {
+			continue
+		}
+		if key, plaintext, err := u.keyring.Open(ciphertext); err == nil {
+			r.noteKeyUse(u, key, peer)
+			return u, key, plaintext, nil
+		}
+	}
+	decryptFailures.Add(1)
+	return nil, nil, nil, ErrUnknownUser
+}
+
+// noteKeyUse 在客户端仍使用非最新一代密钥时输出 (限频的) 日志，方便确认轮换进度
+func (r *Registry) noteKeyUse(u *User, key *securecrypt.Key, peer net.Addr) {
+	current := u.keyring.Current()
+	if key.Generation == current.Generation {
+		return
+	}
+
+	logKey := fmt.Sprintf("%s/%d", u.Name, key.Generation)
+	now := time.Now()
+	r.oldKeyMu.Lock()
+	last, ok := r.oldKeyLogged[logKey]
+	if ok && now.Sub(last) < oldKeyLogInterval {
+		r.oldKeyMu.Unlock()
+		return
+	}
+	r.oldKeyLogged[logKey] = now
+	r.oldKeyMu.Unlock()
+
+	retire := "never"
+	if !key.RetireAfter.IsZero() {
+		retire = key.RetireAfter.Format(time.RFC3339)
+	}
+	log.Printf("[AUTH] User '%s' from %v is still using key generation %d with %s (current: %d, retires: %s).",
+		u.Name, peer, key.Generation, key.Cipher.Suite(), current.Generation, retire)
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"testing"
+
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/types"
+)
+
+func TestRegistry_WithSuite(t *testing.T) {
+	cfg := &types.Config{}
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}},
+		{Name: "bob", Keys: []types.KeyConf{{Generation: 1, Secret: "pw2"}}, Suite: securecrypt.SuiteXChaCha20Poly1305},
+	}
+	users, err := NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	listener, err := users.WithSuite(securecrypt.SuiteAES256GCM)
+	if err != nil {
+		t.Fatalf("WithSuite: %v", err)
+	}
+
+	// 未单独配置套件的用户改用监听器的套件，配置了套件的用户保持不变
+	if got := listener.Lookup("alice").Keyring().Current().Cipher.Suite(); got != securecrypt.SuiteAES256GCM {
+		t.Fatalf("alice suite on the listener = %s, want %s", got, securecrypt.SuiteAES256GCM)
+	}
+	if got := users.Lookup("alice").Keyring().Current().Cipher.Suite(); got != securecrypt.DefaultSuite {
+		t.Fatalf("alice suite in the base registry = %s, want %s", got, securecrypt.DefaultSuite)
+	}
+	if listener.Lookup("bob") != users.Lookup("bob") {
+		t.Fatal("a user with its own suite should be shared unchanged")
+	}
+
+	aesKey, _ := securecrypt.NewCipherWithKey(securecrypt.SuiteAES256GCM, securecrypt.DeriveKey("alice", "pw"))
+	sealed, _ := aesKey.Encrypt([]byte("metadata"))
+	if u, _, _, err := listener.Identify(sealed, nil, nil); err != nil || u.Name != "alice" {
+		t.Fatalf("Identify on the listener = %v, %v; want alice", u, err)
+	}
+	if _, _, _, err := users.Identify(sealed, nil, nil); err == nil {
+		t.Fatal("base registry accepted an AES-256-GCM request")
+	}
+
+	if _, err := users.WithSuite("rot13"); err == nil {
+		t.Fatal("WithSuite accepted an unknown suite")
+	}
+}
+
+func TestRegistry_Subset(t *testing.T) {
+	cfg := &types.Config{}
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}},
+		{Name: "bob", Keys: []types.KeyConf{{Generation: 1, Secret: "pw2"}}},
+	}
+	users, err := NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	if all, err := users.Subset(nil); err != nil || all != users {
+		t.Fatalf("Subset(nil) = %p, %v; want the registry itself", all, err)
+	}
+
+	// 重复的名字只出现一次，子集中的用户与原用户表共享
+	sub, err := users.Subset([]string{"alice", "alice"})
+	if err != nil {
+		t.Fatalf("Subset: %v", err)
+	}
+	if sub.Lookup("alice") != users.Lookup("alice") || sub.Lookup("bob") != nil || len(sub.users) != 1 {
+		t.Fatalf("subset users = %v, want only alice", sub.users)
+	}
+	alice, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	bob, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("bob", "pw2"))
+	sealed, _ := alice.Encrypt([]byte("metadata"))
+	if u, _, _, err := sub.Identify(sealed, nil, nil); err != nil || u.Name != "alice" {
+		t.Fatalf("Identify alice on the subset = %v, %v", u, err)
+	}
+	sealed, _ = bob.Encrypt([]byte("metadata"))
+	if _, _, _, err := sub.Identify(sealed, nil, nil); err == nil {
+		t.Fatal("subset accepted a user outside it")
+	}
+
+	if _, err := users.Subset([]string{"alice", "mallory"}); err == nil {
+		t.Fatal("Subset accepted an unknown user")
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"liuproxy_remote/remote/stats"
+)
+
+// ReplayIDSize 是防重放唯一 ID 的字节数
+const ReplayIDSize = 16
+
+var (
+	// ErrStaleTimestamp 表示时间戳超出了允许的时间窗口
+	ErrStaleTimestamp = errors.New("timestamp outside the replay window")
+	// ErrReplayed 表示该 ID 在时间窗口内已经出现过
+	ErrReplayed = errors.New("duplicate request id")
+	// ErrReplayCacheFull 表示时间窗口内的 ID 已达上限，新请求在有 ID 过期之前被拒绝
+	ErrReplayCacheFull = errors.New("replay cache is full")
+)
+
+var replayCacheFull = stats.Get("replay_cache_full")
+
+// ReplayCache 记录最近出现过的请求 ID，用于拒绝重放的元数据包和 UDP 数据报。
+//
+// 时间戳与本机时间相差超过 window 的请求直接拒绝，因此一个 ID 只需记到它的时间戳加 window 为止，
+// 之后重放的请求会因时间戳过期而被拒绝。ID 按过期时间放在最小堆中，只有过期的 ID 会被移除。
+//
+// ID 按用户分区记录: 请求只能用所属用户的密钥生成，重放也只会被识别为同一个用户，
+// 因此不同用户的 ID 互不影响。每个用户在窗口内最多记录 maxEntries 个 ID，达到上限时拒绝该用户的新请求
+// (而不是提前遗忘仍在窗口内的 ID)，以限制内存；一个用户用完自己的配额不会影响其他用户。
+type ReplayCache struct {
+	window     time.Duration
+	maxEntries int
+
+	mu    sync.Mutex
+	users map[string]*replayPartition
+}
+
+// replayPartition 是一个用户在窗口内出现过的 ID
+type replayPartition struct {
+	mu    sync.Mutex
+	seen  map[[ReplayIDSize]byte]struct{}
+	queue replayQueue
+}
+
+// NewReplayCache 创建一个防重放缓存，maxEntries 是每个用户在时间窗口内最多记录的 ID 数
+func NewReplayCache(window time.Duration, maxEntries int) *ReplayCache {
+	return &ReplayCache{
+		window:     window,
+		maxEntries: maxEntries,
+		users:      make(map[string]*replayPartition),
+	}
+}
+
+// Check 校验时间戳是否在窗口内、ID 是否在 user 的分区中出现过，通过后记录该 ID。
+func (c *ReplayCache) Check(user string, timestamp time.Time, id [ReplayIDSize]byte) error {
+	now := time.Now()
+	if timestamp.Before(now.Add(-c.window)) || timestamp.After(now.Add(c.window)) {
+		return ErrStaleTimestamp
+	}
+
+	p := c.partition(user)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expire(now)
+	if _, ok := p.seen[id]; ok {
+		return ErrReplayed
+	}
+	if len(p.seen) >= c.maxEntries {
+		replayCacheFull.Add(1)
+		return ErrReplayCacheFull
+	}
+	p.seen[id] = struct{}{}
+	heap.Push(&p.queue, replayEntry{id: id, expiry: timestamp.Add(c.window)})
+	return nil
+}
+
+// partition 返回 user 的分区，不存在时创建。分区数不超过用户表中的用户数。
+func (c *ReplayCache) partition(user string) *replayPartition {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.users[user]
+	if p == nil {
+		p = &replayPartition{seen: make(map[[ReplayIDSize]byte]struct{})}
+		c.users[user] = p
+	}
+	return p
+}
+
+// expire 移除时间戳已经超出窗口的 ID，这些 ID 的重放会被时间戳检查拒绝
+func (p *replayPartition) expire(now time.Time) {
+	for len(p.queue) > 0 && p.queue[0].expiry.Before(now) {
+		entry := heap.Pop(&p.queue).(replayEntry)
+		delete(p.seen, entry.id)
+	}
+}
+
+type replayEntry struct {
+	id     [ReplayIDSize]byte
+	expiry time.Time
+}
+
+// replayQueue 是按过期时间排序的最小堆
+type replayQueue []replayEntry
+
+func (q replayQueue) Len() int           { return len(q) }
+func (q replayQueue) Less(i, j int) bool { return q[i].expiry.Before(q[j].expiry) }
+func (q replayQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *replayQueue) Push(x any)        { *q = append(*q, x.(replayEntry)) }
+func (q *replayQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
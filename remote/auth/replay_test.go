@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCache_RejectsDuplicateAndStale(t *testing.T) {
+	cache := NewReplayCache(time.Minute, 16)
+	id := [ReplayIDSize]byte{1, 2, 3}
+
+	if err := cache.Check("alice", time.Now(), id); err != nil {
+		t.Fatalf("first Check() failed: %v", err)
+	}
+	if err := cache.Check("alice", time.Now(), id); err != ErrReplayed {
+		t.Fatalf("second Check() error = %v, want ErrReplayed", err)
+	}
+	if err := cache.Check("alice", time.Now().Add(-2*time.Minute), [ReplayIDSize]byte{4}); err != ErrStaleTimestamp {
+		t.Fatalf("stale Check() error = %v, want ErrStaleTimestamp", err)
+	}
+}
+
+func TestReplayCache_RemembersWhenFull(t *testing.T) {
+	cache := NewReplayCache(time.Minute, 2)
+	first := [ReplayIDSize]byte{1}
+	_ = cache.Check("alice", time.Now(), first)
+	_ = cache.Check("alice", time.Now(), [ReplayIDSize]byte{2})
+
+	// 缓存已满: 新请求被拒绝，窗口内的 ID 不会被遗忘
+	if err := cache.Check("alice", time.Now(), [ReplayIDSize]byte{3}); err != ErrReplayCacheFull {
+		t.Fatalf("Check() on a full cache error = %v, want ErrReplayCacheFull", err)
+	}
+	if err := cache.Check("alice", time.Now(), first); err != ErrReplayed {
+		t.Fatalf("Check() replay on a full cache error = %v, want ErrReplayed", err)
+	}
+}
+
+func TestReplayCache_EvictsOnlyExpiredIDs(t *testing.T) {
+	window := 50 * time.Millisecond
+	cache := NewReplayCache(window, 2)
+	old := [ReplayIDSize]byte{1}
+	recent := [ReplayIDSize]byte{2}
+	_ = cache.Check("alice", time.Now().Add(-window/2), old)
+	_ = cache.Check("alice", time.Now().Add(window/2), recent)
+
+	// old 过期后腾出位置，recent 仍在窗口内，必须继续被拒绝
+	time.Sleep(window/2 + 10*time.Millisecond)
+	if err := cache.Check("alice", time.Now(), [ReplayIDSize]byte{3}); err != nil {
+		t.Fatalf("Check() after expiry failed: %v", err)
+	}
+	if err := cache.Check("alice", time.Now(), recent); err != ErrReplayed {
+		t.Fatalf("Check() replay of an unexpired ID error = %v, want ErrReplayed", err)
+	}
+}
+
+func TestReplayCache_PartitionsByUser(t *testing.T) {
+	cache := NewReplayCache(time.Minute, 2)
+	_ = cache.Check("mallory", time.Now(), [ReplayIDSize]byte{1})
+	_ = cache.Check("mallory", time.Now(), [ReplayIDSize]byte{2})
+	if err := cache.Check("mallory", time.Now(), [ReplayIDSize]byte{3}); err != ErrReplayCacheFull {
+		t.Fatalf("Check() past mallory's quota error = %v, want ErrReplayCacheFull", err)
+	}
+
+	// 一个用户用完配额后，其他用户的请求照常通过；相同的 ID 在不同用户的分区中互不影响
+	if err := cache.Check("alice", time.Now(), [ReplayIDSize]byte{1}); err != nil {
+		t.Fatalf("Check() for alice after mallory filled the cache failed: %v", err)
+	}
+	if err := cache.Check("alice", time.Now(), [ReplayIDSize]byte{1}); err != ErrReplayed {
+		t.Fatalf("alice replay error = %v, want ErrReplayed", err)
+	}
+}
@@ -0,0 +1,41 @@
+package auth
+
+import "fmt"
+
+// SecurityLevel 是用户要求的最低会话安全级别
+type SecurityLevel int
+
+const (
+	// SecurityStandard 允许不经握手、直接用长期密钥加密的流 (v2.2 客户端)
+	SecurityStandard SecurityLevel = iota
+	// SecurityPFS 要求 X25519 握手，提供前向安全
+	SecurityPFS
+	// SecurityPQ 要求 X25519 + ML-KEM-768 混合握手，抵御"先录制、后解密"的量子计算攻击
+	SecurityPQ
+)
+
+var securityLevelNames = map[SecurityLevel]string{
+	SecurityStandard: "standard",
+	SecurityPFS:      "pfs",
+	SecurityPQ:       "pq",
+}
+
+func (l SecurityLevel) String() string {
+	if name, ok := securityLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("SecurityLevel(%d)", int(l))
+}
+
+// ParseSecurityLevel 解析配置中的安全级别，空字符串表示 standard
+func ParseSecurityLevel(name string) (SecurityLevel, error) {
+	if name == "" {
+		return SecurityStandard, nil
+	}
+	for level, n := range securityLevelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return SecurityStandard, fmt.Errorf("unknown security level '%s' (want standard, pfs or pq)", name)
+}
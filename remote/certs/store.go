@@ -0,0 +1,99 @@
+// Package certs 管理监听器的 TLS 证书: 按 SNI 选择证书，并在证书文件变化时自动重新加载。
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Pair 是一对证书和私钥文件路径 (PEM 格式)
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Store 保存当前加载的所有证书。它的 GetCertificate 可以直接用作 tls.Config.GetCertificate，
+// 重新加载时原子地替换整组证书，正在进行的握手不受影响。
+type Store struct {
+	pairs   []Pair
+	certs   atomic.Pointer[[]*tls.Certificate]
+	modTime time.Time
+}
+
+// NewStore 加载所有证书对，任何一对加载失败都返回错误
+func NewStore(pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+	s := &Store{pairs: pairs}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	certs := make([]*tls.Certificate, 0, len(s.pairs))
+	for _, p := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate '%s': %w", p.CertFile, err)
+		}
+		certs = append(certs, &cert)
+	}
+	s.certs.Store(&certs)
+	s.modTime = s.latestModTime()
+	return nil
+}
+
+// latestModTime 返回所有证书和私钥文件中最新的修改时间
+func (s *Store) latestModTime() time.Time {
+	var latest time.Time
+	for _, p := range s.pairs {
+		for _, name := range []string{p.CertFile, p.KeyFile} {
+			if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+	}
+	return latest
+}
+
+// GetCertificate 按客户端的 SNI 和支持的算法选择证书，没有匹配时返回第一张证书
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *s.certs.Load()
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certs[0], nil
+}
+
+// Watch 每隔 interval 检查一次证书文件，发现变化后重新加载。
+// 重新加载失败时继续使用旧证书 (例如证书和私钥只更新了一半)，下一次检查时重试。
+func (s *Store) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reload()
+	}
+}
+
+// reload 在证书文件比上次加载时新的情况下重新加载，返回是否替换了证书
+func (s *Store) reload() bool {
+	if !s.latestModTime().After(s.modTime) {
+		return false
+	}
+	if err := s.load(); err != nil {
+		log.Printf("[TLS] Failed to reload certificates, keeping the previous ones: %v", err)
+		return false
+	}
+	log.Printf("[TLS] Reloaded %d certificate(s).", len(s.pairs))
+	return true
+}
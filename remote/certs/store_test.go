@@ -0,0 +1,96 @@
+package certs
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// helloFor 构造一个支持 TLS 1.3 和 ECDSA P-256 的 ClientHello
+func helloFor(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+}
+
+func servedName(t *testing.T, s *Store, serverName string) string {
+	t.Helper()
+	cert, err := s.GetCertificate(helloFor(serverName))
+	if err != nil {
+		t.Fatalf("GetCertificate(%q): %v", serverName, err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+// copyFile 覆盖 dst 的内容，并把修改时间设为 mtime
+func copyFile(t *testing.T, src, dst string, mtime time.Time) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_SelectsBySNIAndReloads(t *testing.T) {
+	dir := t.TempDir()
+	pairs := []Pair{
+		{CertFile: filepath.Join(dir, "a.crt"), KeyFile: filepath.Join(dir, "a.key")},
+		{CertFile: filepath.Join(dir, "b.crt"), KeyFile: filepath.Join(dir, "b.key")},
+	}
+	for i, host := range []string{"a.example", "b.example"} {
+		if err := GenerateSelfSigned([]string{host}, time.Hour, pairs[i].CertFile, pairs[i].KeyFile); err != nil {
+			t.Fatalf("GenerateSelfSigned: %v", err)
+		}
+	}
+	s, err := NewStore(pairs)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if got := servedName(t, s, "b.example"); got != "b.example" {
+		t.Fatalf("SNI b.example served %q", got)
+	}
+	if got := servedName(t, s, "unknown.example"); got != "a.example" {
+		t.Fatalf("unknown SNI served %q, want the first certificate", got)
+	}
+	if s.reload() {
+		t.Fatal("reloaded although no file changed")
+	}
+
+	// 新证书写在别处，先只替换 b 的证书: 证书和私钥不匹配，继续使用旧证书
+	next := filepath.Join(dir, "next")
+	os.Mkdir(next, 0700)
+	if err := GenerateSelfSigned([]string{"b.example", "c.example"}, time.Hour, filepath.Join(next, "b.crt"), filepath.Join(next, "b.key")); err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	copyFile(t, filepath.Join(next, "b.crt"), pairs[1].CertFile, mtime)
+	if s.reload() {
+		t.Fatal("reloaded a half-updated certificate pair")
+	}
+	if got := servedName(t, s, "c.example"); got != "a.example" {
+		t.Fatalf("SNI c.example served %q before the key was updated", got)
+	}
+
+	// 私钥也更新后重新加载
+	copyFile(t, filepath.Join(next, "b.key"), pairs[1].KeyFile, mtime)
+	if !s.reload() {
+		t.Fatal("did not reload after the pair was updated")
+	}
+	cert, _ := s.GetCertificate(helloFor("c.example"))
+	if cert.Leaf.VerifyHostname("c.example") != nil {
+		t.Fatalf("SNI c.example served %q after reload", cert.Leaf.Subject.CommonName)
+	}
+	if s.reload() {
+		t.Fatal("reloaded again without further changes")
+	}
+}
@@ -0,0 +1,142 @@
+package clientip
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"liuproxy_remote/remote/types"
+)
+
+// readThroughPipe 把 data 写入一条管道，并用 p 解析另一端的 PROXY 协议头
+func readThroughPipe(t *testing.T, p *Policy, data []byte) (net.Conn, []byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	conn, err := p.ReadProxyHeader(server)
+	if err != nil {
+		t.Fatalf("ReadProxyHeader: %v", err)
+	}
+	rest, _ := io.ReadAll(conn)
+	return conn, rest
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	p, err := NewPolicy(&types.RemoteConf{ProxyProtocol: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, rest := readThroughPipe(t, p, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello"))
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Errorf("v1 RemoteAddr = %s", got)
+	}
+	if string(rest) != "hello" {
+		t.Errorf("v1 payload = %q", rest)
+	}
+
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x21, 0, 36)
+	src := netip.MustParseAddr("2001:db8::5").As16()
+	dst := netip.MustParseAddr("2001:db8::1").As16()
+	v2 = append(v2, src[:]...)
+	v2 = append(v2, dst[:]...)
+	v2 = binary.BigEndian.AppendUint16(v2, 40000)
+	v2 = binary.BigEndian.AppendUint16(v2, 443)
+	conn, rest = readThroughPipe(t, p, append(v2, "GET"...))
+	if got := conn.RemoteAddr().String(); got != "[2001:db8::5]:40000" {
+		t.Errorf("v2 RemoteAddr = %s", got)
+	}
+	if string(rest) != "GET" {
+		t.Errorf("v2 payload = %q", rest)
+	}
+
+	// 没有协议头的连接保持原样
+	_, rest = readThroughPipe(t, p, []byte("POST / HTTP/1.1\r\n"))
+	if string(rest) != "POST / HTTP/1.1\r\n" {
+		t.Errorf("plain payload = %q", rest)
+	}
+}
+
+func TestFromHeaders_SkipsTrustedHops(t *testing.T) {
+	p, err := NewPolicy(&types.RemoteConf{
+		TrustedProxies: "10.0.0.0/8",
+		RealIPHeaders:  "CF-Connecting-IP, X-Forwarded-For",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := netip.MustParseAddr("10.1.2.3")
+
+	h := http.Header{}
+	h.Set("X-Forwarded-For", "1.1.1.1, 198.51.100.9, 10.0.0.2")
+	if ip, ok := p.FromHeaders(proxy, h); !ok || ip.String() != "198.51.100.9" {
+		t.Errorf("X-Forwarded-For gave %v, %v", ip, ok)
+	}
+	h.Set("CF-Connecting-IP", "203.0.113.1")
+	if ip, ok := p.FromHeaders(proxy, h); !ok || ip.String() != "203.0.113.1" {
+		t.Errorf("CF-Connecting-IP gave %v, %v", ip, ok)
+	}
+	// 不受信任的来源发送的转发头被忽略
+	if _, ok := p.FromHeaders(netip.MustParseAddr("192.0.2.1"), h); ok {
+		t.Error("headers from an untrusted peer must be ignored")
+	}
+}
+
+func TestNewPolicy_RealIPHeadersNeedTrustedSource(t *testing.T) {
+	// 只监听 TCP 又没有受信任的代理时，转发头永远不会被采用，启动时报错
+	if _, err := NewPolicy(&types.RemoteConf{RealIPHeaders: "X-Real-IP"}); err == nil {
+		t.Error("real_ip_headers without trusted_proxies or trust_unix_socket was accepted")
+	}
+	for _, conf := range []types.RemoteConf{
+		{RealIPHeaders: "X-Real-IP", TrustedProxies: "10.0.0.0/8"},
+		{RealIPHeaders: "X-Real-IP", TrustUnixSocket: true},
+	} {
+		if _, err := NewPolicy(&conf); err != nil {
+			t.Errorf("NewPolicy(%+v): %v", conf, err)
+		}
+	}
+}
+
+func TestRealIP_UnixSocketPeer(t *testing.T) {
+	unixPeer := &net.UnixAddr{Name: "@", Net: "unix"}
+	h := http.Header{}
+	h.Set("X-Real-IP", "203.0.113.7")
+
+	// trust_unix_socket 时 Unix 套接字的对端可以提供转发头和 PROXY 协议头
+	p, err := NewPolicy(&types.RemoteConf{RealIPHeaders: "X-Real-IP", TrustedProxies: "10.0.0.0/8", TrustUnixSocket: true, ProxyProtocol: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, ok := p.RealIP(unixPeer, h); !ok || ip.String() != "203.0.113.7" {
+		t.Errorf("trusted unix peer gave %v, %v", ip, ok)
+	}
+	if !p.acceptsProxyHeader(unixPeer) {
+		t.Error("PROXY header from a trusted unix peer was refused")
+	}
+	if _, ok := p.RealIP(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, h); ok {
+		t.Error("headers from an untrusted TCP peer must be ignored")
+	}
+
+	// 只配置 trusted_proxies 时 Unix 套接字的对端不受信任
+	p, err = NewPolicy(&types.RemoteConf{RealIPHeaders: "X-Real-IP", TrustedProxies: "10.0.0.0/8", ProxyProtocol: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.RealIP(unixPeer, h); ok {
+		t.Error("headers from a unix peer were used without trust_unix_socket")
+	}
+	if p.acceptsProxyHeader(unixPeer) {
+		t.Error("PROXY header from a unix peer was accepted without trust_unix_socket")
+	}
+	if ip, ok := p.RealIP(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, h); !ok || ip.String() != "203.0.113.7" {
+		t.Errorf("trusted TCP peer gave %v, %v", ip, ok)
+	}
+}
@@ -0,0 +1,211 @@
+// Package clientip 确定连接的真实客户端地址 (PROXY 协议和 CDN/反向代理请求头)，
+// 并提供基于客户端 IP 的访问控制。
+package clientip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"liuproxy_remote/remote/types"
+)
+
+// ErrDenied 表示客户端 IP 被访问控制规则拒绝
+var ErrDenied = errors.New("client IP is not allowed")
+
+// Set 是一组 IP 网段
+type Set []netip.Prefix
+
+// ParseSet 解析逗号分隔的 IP 或 CIDR 列表，例如 "10.0.0.0/8, 192.168.1.1"
+func ParseSet(list string) (Set, error) {
+	var set Set
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP '%s': %w", item, err)
+			}
+			set = append(set, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %w", item, err)
+		}
+		set = append(set, prefix.Masked())
+	}
+	return set, nil
+}
+
+// Contains 报告 ip 是否属于集合中的某个网段
+func (s Set) Contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range s {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy 汇总了与客户端地址有关的配置
+type Policy struct {
+	proxyProtocol bool
+	trusted       Set
+	trustUnix     bool
+	headers       []string
+	allow         Set
+	deny          Set
+}
+
+// NewPolicy 根据 [remote] 中的 proxy_protocol、trusted_proxies、trust_unix_socket、real_ip_headers、
+// allow_ips 和 deny_ips 创建策略
+func NewPolicy(conf *types.RemoteConf) (*Policy, error) {
+	p := &Policy{proxyProtocol: conf.ProxyProtocol, trustUnix: conf.TrustUnixSocket}
+	var err error
+	if p.trusted, err = ParseSet(conf.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if p.allow, err = ParseSet(conf.AllowIPs); err != nil {
+		return nil, fmt.Errorf("allow_ips: %w", err)
+	}
+	if p.deny, err = ParseSet(conf.DenyIPs); err != nil {
+		return nil, fmt.Errorf("deny_ips: %w", err)
+	}
+	for _, h := range strings.Split(conf.RealIPHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			p.headers = append(p.headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	if len(p.headers) > 0 && len(p.trusted) == 0 && !p.trustUnix {
+		return nil, errors.New("real_ip_headers requires trusted_proxies or trust_unix_socket")
+	}
+	return p, nil
+}
+
+// ProxyProtocol 报告是否接受 PROXY 协议头
+func (p *Policy) ProxyProtocol() bool {
+	return p.proxyProtocol
+}
+
+// acceptsProxyHeader 报告来自 addr 的连接能否携带 PROXY 协议头。
+// 未配置 trusted_proxies 时接受任何来源 (适用于只能经由负载均衡器访问的部署)；
+// 否则只接受受信任的代理，以及 trust_unix_socket 时 Unix 套接字的对端。
+func (p *Policy) acceptsProxyHeader(addr net.Addr) bool {
+	if !p.proxyProtocol {
+		return false
+	}
+	if len(p.trusted) == 0 {
+		return true
+	}
+	if IsLocalSocket(addr) {
+		return p.trustUnix
+	}
+	ip, ok := AddrIP(addr)
+	return ok && p.trusted.Contains(ip)
+}
+
+// Check 按 deny_ips 和 allow_ips 检查客户端地址。allow_ips 为空表示允许所有未被拒绝的地址。
+func (p *Policy) Check(addr net.Addr) error {
+	ip, ok := AddrIP(addr)
+	if !ok {
+		return nil // 非 IP 地址 (例如 Unix 套接字) 不受 IP 规则约束
+	}
+	if p.deny.Contains(ip) || (len(p.allow) > 0 && !p.allow.Contains(ip)) {
+		return ErrDenied
+	}
+	return nil
+}
+
+// RealIP 在请求的直接来源 peer 是受信任的代理 (包括 trust_unix_socket 时 Unix 套接字的对端) 时，
+// 从转发头中取出客户端 IP，规则与 FromHeaders 相同
+func (p *Policy) RealIP(peer net.Addr, h http.Header) (netip.Addr, bool) {
+	if IsLocalSocket(peer) {
+		if !p.trustUnix {
+			return netip.Addr{}, false
+		}
+		return p.fromHeaders(h)
+	}
+	ip, ok := AddrIP(peer)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return p.FromHeaders(ip, h)
+}
+
+// FromHeaders 在 remote 是受信任的代理时，按 real_ip_headers 的顺序从请求头中取出客户端 IP。
+// X-Forwarded-For 从右向左跳过受信任的代理，取第一个不受信任的地址，避免客户端伪造。
+func (p *Policy) FromHeaders(remote netip.Addr, h http.Header) (netip.Addr, bool) {
+	if !p.trusted.Contains(remote) {
+		return netip.Addr{}, false
+	}
+	return p.fromHeaders(h)
+}
+
+// fromHeaders 按 real_ip_headers 的顺序从已确认来自受信任代理的请求头中取出客户端 IP
+func (p *Policy) fromHeaders(h http.Header) (netip.Addr, bool) {
+	for _, name := range p.headers {
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if name != "X-Forwarded-For" {
+			if ip, err := netip.ParseAddr(strings.TrimSpace(values[0])); err == nil {
+				return ip.Unmap(), true
+			}
+			continue
+		}
+		hops := strings.Split(strings.Join(values, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			if ip = ip.Unmap(); !p.trusted.Contains(ip) || i == 0 {
+				return ip, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// IsLocalSocket 报告 addr 是否为 Unix 套接字的对端。
+// 这类连接只能来自有权限访问套接字的本机进程 (例如同一 Pod 中的 nginx)，
+// 但只有开启 trust_unix_socket 时才被视为受信任的代理
+func IsLocalSocket(addr net.Addr) bool {
+	for {
+		switch a := addr.(type) {
+		case *net.UnixAddr:
+			return true
+		case interface{ Unwrap() net.Addr }:
+			addr = a.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// AddrIP 取出 TCP/UDP 地址中的 IP。包装过的地址 (提供 Unwrap() net.Addr) 会先被解开。
+func AddrIP(addr net.Addr) (netip.Addr, bool) {
+	for {
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			ip, ok := netip.AddrFromSlice(a.IP)
+			return ip.Unmap(), ok
+		case *net.UDPAddr:
+			ip, ok := netip.AddrFromSlice(a.IP)
+			return ip.Unmap(), ok
+		case interface{ Unwrap() net.Addr }:
+			addr = a.Unwrap()
+		default:
+			return netip.Addr{}, false
+		}
+	}
+}
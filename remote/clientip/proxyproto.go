@@ -0,0 +1,171 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY 协议 (HAProxy) 让负载均衡器在转发的 TCP 连接开头告知真实的客户端地址。
+// v1 是一行文本:  "PROXY TCP4 <源地址> <目的地址> <源端口> <目的端口>\r\n"
+// v2 是二进制:    12 字节签名 | 版本/命令(1) | 地址族/协议(1) | 长度(2) | 地址 | TLV
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyHeaderTimeout 限制读取 PROXY 协议头的时间
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLen 是 v1 协议头的最大长度 (含 \r\n)
+	proxyV1MaxLen = 107
+)
+
+// ErrUntrustedProxyHeader 表示不受信任的来源发送了 PROXY 协议头 (可能在伪造客户端地址)
+var ErrUntrustedProxyHeader = errors.New("PROXY protocol header from an untrusted source")
+
+// ReadProxyHeader 在连接开头检测并解析 PROXY 协议 v1/v2 头。
+// 有头部时返回的连接的 RemoteAddr 为真实客户端地址；没有头部时连接保持原样。
+// 已经预读的数据会在之后的 Read 中照常返回。
+func (p *Policy) ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	wrapped := &proxiedConn{Conn: conn, r: r, addr: conn.RemoteAddr()}
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var src net.Addr
+	switch first[0] {
+	case 'P':
+		if prefix, _ := r.Peek(6); string(prefix) != "PROXY " {
+			return wrapped, nil
+		}
+		if src, err = p.readV1(conn, r); err != nil {
+			return nil, err
+		}
+	case '\r':
+		if sig, _ := r.Peek(len(proxyV2Signature)); !bytes.Equal(sig, proxyV2Signature) {
+			return wrapped, nil
+		}
+		if src, err = p.readV2(conn, r); err != nil {
+			return nil, err
+		}
+	default:
+		return wrapped, nil
+	}
+	if src != nil {
+		wrapped.addr = src
+	}
+	return wrapped, nil
+}
+
+// checkSource 确认连接的直接来源可以发送 PROXY 协议头
+func (p *Policy) checkSource(conn net.Conn) error {
+	if !p.acceptsProxyHeader(conn.RemoteAddr()) {
+		return ErrUntrustedProxyHeader
+	}
+	return nil
+}
+
+func (p *Policy) readV1(conn net.Conn, r *bufio.Reader) (net.Addr, error) {
+	if err := p.checkSource(conn); err != nil {
+		return nil, err
+	}
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("PROXY v1 header is too long or not terminated by CRLF")
+	}
+	fields := strings.Fields(text)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", text)
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source address: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func (p *Policy) readV2(conn net.Conn, r *bufio.Reader) (net.Addr, error) {
+	if err := p.checkSource(conn); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses: %w", err)
+	}
+
+	// LOCAL 命令 (健康检查等) 和非 TCP 地址族沿用连接本身的地址
+	if verCmd&0x0f == 0x00 {
+		return nil, nil
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	return nil, nil
+}
+
+// proxiedConn 从预读缓冲中读取数据，并返回 PROXY 协议头中的客户端地址
+type proxiedConn struct {
+	net.Conn
+	r    *bufio.Reader
+	addr net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxiedConn) RemoteAddr() net.Addr       { return c.addr }
+
+// CloseWrite 转发给底层连接，使 TCP 半关闭仍然有效
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
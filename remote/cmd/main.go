@@ -4,13 +4,23 @@ import (
 	"flag"
 	"liuproxy_remote/remote/types"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"liuproxy_remote/remote/certs"
 	"liuproxy_remote/remote/config"
 	"liuproxy_remote/remote/server"
 )
 
 func main() {
+	// 子命令: gen-selfsigned 生成测试用的自签名证书
+	if len(os.Args) > 1 && os.Args[1] == "gen-selfsigned" {
+		genSelfSigned(os.Args[2:])
+		return
+	}
+
 	defaultConfigPath := filepath.Join("remote", "ini", "remote.ini")
 	configPath := flag.String("config", defaultConfigPath, "Path to remote config file")
 	flag.Parse()
@@ -25,3 +35,24 @@ func main() {
 	appServer := server.New(cfg, *configPath)
 	appServer.Run()
 }
+
+// genSelfSigned 实现 gen-selfsigned 子命令，生成的证书可直接用于 tls_cert / tls_key
+func genSelfSigned(args []string) {
+	fs := flag.NewFlagSet("gen-selfsigned", flag.ExitOnError)
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "Comma-separated host names and IPs for the certificate")
+	certFile := fs.String("cert", "cert.pem", "Output certificate file")
+	keyFile := fs.String("key", "key.pem", "Output private key file")
+	days := fs.Int("days", 365, "Validity in days")
+	fs.Parse(args)
+
+	var hostList []string
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hostList = append(hostList, h)
+		}
+	}
+	if err := certs.GenerateSelfSigned(hostList, time.Duration(*days)*24*time.Hour, *certFile, *keyFile); err != nil {
+		log.Fatalf("Failed to generate self-signed certificate: %v", err)
+	}
+	log.Printf("Wrote self-signed certificate for %v to %s and %s", hostList, *certFile, *keyFile)
+}
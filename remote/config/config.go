@@ -2,8 +2,13 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/ini.v1"
 	"liuproxy_remote/remote/types"
@@ -22,6 +27,21 @@ func LoadIni(cfg *types.Config, fileName string) error {
 		return err
 	}
 
+	// 加载用户列表: [users] 节以及可选的 users_file
+	if err := loadUsers(cfg, iniFile, fileName); err != nil {
+		return err
+	}
+
+	// 加载 [listener.NAME] 节定义的监听器
+	if err := loadListeners(cfg, iniFile, fileName); err != nil {
+		return err
+	}
+
+	// TLS 证书的相对路径同样以主配置文件所在目录为基准
+	cfg.RemoteConf.TLSCert = resolvePathList(fileName, cfg.RemoteConf.TLSCert)
+	cfg.RemoteConf.TLSKey = resolvePathList(fileName, cfg.RemoteConf.TLSKey)
+	cfg.RemoteConf.TLSClientCA = resolvePath(fileName, cfg.RemoteConf.TLSClientCA)
+
 	// 优先处理 PaaS 平台注入的 PORT 环境变量
 	envPort := os.Getenv("PORT")
 	if envPort != "" {
@@ -33,6 +53,7 @@ func LoadIni(cfg *types.Config, fileName string) error {
 
 	// 环境变量覆盖逻辑保持不变
 	overrideFromEnvInt(&cfg.CommonConf.Crypt, "CRYPT_KEY")
+	overrideFromEnvBool(&cfg.CommonConf.LegacyCrypt, "LEGACY_CRYPT")
 	// REMOTE_PORT 优先级高于 PORT 定义的端口
 	overrideFromEnvInt(&cfg.RemoteConf.PortWsSvr, "REMOTE_PORT")
 
@@ -48,3 +69,255 @@ func overrideFromEnvInt(target *int, envName string) {
 		}
 	}
 }
+
+// overrideFromEnvBool 与 overrideFromEnvInt 相同，用于布尔开关
+func overrideFromEnvBool(target *bool, envName string) {
+	envValue := os.Getenv(envName)
+	if envValue != "" {
+		if boolValue, err := strconv.ParseBool(envValue); err == nil {
+			*target = boolValue
+		}
+	}
+}
+
+// resolvePath 把相对路径解析为相对于配置文件 fileName 所在目录的路径
+func resolvePath(fileName, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(fileName), path)
+}
+
+// resolvePathList 对逗号分隔的路径列表逐个执行 resolvePath
+func resolvePathList(fileName, list string) string {
+	if list == "" {
+		return ""
+	}
+	parts := strings.Split(list, ",")
+	for i, p := range parts {
+		parts[i] = resolvePath(fileName, strings.TrimSpace(p))
+	}
+	return strings.Join(parts, ",")
+}
+
+// loadUsers 读取 [users] 节、[user.NAME] 节，以及 users_file 指向的独立用户文件。
+// users_file 的格式与主配置文件相同；使用相对路径时，以主配置文件所在目录为基准。
+func loadUsers(cfg *types.Config, iniFile *ini.File, fileName string) error {
+	seen := make(map[string]bool)
+	if err := loadUsersFrom(cfg, iniFile, fileName, seen); err != nil {
+		return err
+	}
+
+	if cfg.RemoteConf.UsersFile == "" {
+		return nil
+	}
+	usersFile := resolvePath(fileName, cfg.RemoteConf.UsersFile)
+	usersIni, err := ini.Load(usersFile)
+	if err != nil {
+		return fmt.Errorf("failed to load users file '%s': %w", usersFile, err)
+	}
+	return loadUsersFrom(cfg, usersIni, usersFile, seen)
+}
+
+// loadUsersFrom 从一个 ini 文件中读取用户。
+// [users] 节中的每个键是用户名，值是该用户唯一一代 (第 1 代) 密钥的口令。
+// [user.NAME] 节支持多代密钥，用于不停机轮换:
+//
+//	[user.alice]
+//	key.2 = new-passphrase
+//	key.1 = old-passphrase
+//	key.1.retire_after = 2026-11-01T00:00:00Z
+//
+// 其中 secret 是 key.1 的简写；suite 可以为该用户单独指定加密套件；
+// security 指定该用户要求的最低会话安全级别 (standard、pfs 或 pq)；
+// padding、padding_first 和 padding_jitter 覆盖监听器的填充设置；
+// certs 限制该用户只能通过身份匹配的客户端证书接入；
+// token 和 ws_path 用于在 WebSocket 升级时认证该用户；
+// socks5_password 是该用户登录内置 SOCKS5 代理的密码。
+func loadUsersFrom(cfg *types.Config, iniFile *ini.File, source string, seen map[string]bool) error {
+	addUser := func(user types.UserConf) error {
+		if seen[user.Name] {
+			return fmt.Errorf("duplicate user '%s' in %s", user.Name, source)
+		}
+		if len(user.Keys) == 0 {
+			return fmt.Errorf("user '%s' in %s has no keys", user.Name, source)
+		}
+		for _, key := range user.Keys {
+			if key.Secret == "" {
+				return fmt.Errorf("user '%s' in %s has an empty secret for key generation %d", user.Name, source, key.Generation)
+			}
+		}
+		seen[user.Name] = true
+		cfg.Users = append(cfg.Users, user)
+		return nil
+	}
+
+	if section, err := iniFile.GetSection("users"); err == nil {
+		for _, key := range section.Keys() {
+			user := types.UserConf{Name: key.Name(), Keys: []types.KeyConf{{Generation: 1, Secret: key.String()}}}
+			if err := addUser(user); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, section := range iniFile.Sections() {
+		name, ok := strings.CutPrefix(section.Name(), "user.")
+		if !ok || name == "" {
+			continue
+		}
+		keys, err := parseUserKeys(section)
+		if err != nil {
+			return fmt.Errorf("invalid section [%s] in %s: %w", section.Name(), source, err)
+		}
+		user := types.UserConf{
+			Name:     name,
+			Keys:     keys,
+			Suite:    section.Key("suite").String(),
+			Security: section.Key("security").String(),
+			Padding: types.PaddingConf{
+				Frame:  section.Key("padding").String(),
+				First:  section.Key("padding_first").String(),
+				Jitter: section.Key("padding_jitter").String(),
+			},
+			Certs:  section.Key("certs").String(),
+			Token:  section.Key("token").String(),
+			WsPath: section.Key("ws_path").String(),
+
+			Socks5Password: section.Key("socks5_password").String(),
+		}
+		if err := addUser(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadListeners 读取 [listener.NAME] 节，例如:
+//
+//	[listener.public]
+//	port = 443
+//	modes = ws
+//	tls_cert = cert.pem
+//	tls_key = key.pem
+//
+//	[listener.private]
+//	bind = 10.0.0.5
+//	port = 7000
+//	modes = mux, multi-conn, udp
+//	users = alice, bob
+//	suite = aes-256-gcm
+//	kcp_port = 29900
+//
+//	[listener.sidecar]
+//	bind = unix:/run/liuproxy/remote.sock
+//	socket_mode = 0660
+//	socket_owner = liuproxy:www-data
+//
+// 证书文件的相对路径以主配置文件所在目录为基准。
+func loadListeners(cfg *types.Config, iniFile *ini.File, fileName string) error {
+	for _, section := range iniFile.Sections() {
+		name, ok := strings.CutPrefix(section.Name(), "listener.")
+		if !ok || name == "" {
+			continue
+		}
+		// 只监听 Unix 套接字的监听器可以不设置端口，是否缺少端口由 server 在解析 bind 后检查
+		port, err := sectionPort(section, "port")
+		if err != nil {
+			return err
+		}
+		kcpPort, err := sectionPort(section, "kcp_port")
+		if err != nil {
+			return err
+		}
+		udpPort, err := sectionPort(section, "udp_port")
+		if err != nil {
+			return err
+		}
+		cfg.Listeners = append(cfg.Listeners, types.ListenerConf{
+			Name:           name,
+			Bind:           section.Key("bind").String(),
+			Port:           port,
+			SocketMode:     section.Key("socket_mode").String(),
+			SocketOwner:    section.Key("socket_owner").String(),
+			Modes:          section.Key("modes").String(),
+			TLSCert:        resolvePathList(fileName, section.Key("tls_cert").String()),
+			TLSKey:         resolvePathList(fileName, section.Key("tls_key").String()),
+			TLSClientCA:    resolvePath(fileName, section.Key("tls_client_ca").String()),
+			TLSClientAllow: section.Key("tls_client_allow").String(),
+			Users:          section.Key("users").String(),
+			Suite:          section.Key("suite").String(),
+			KcpPort:        kcpPort,
+			UdpPort:        udpPort,
+		})
+	}
+	return nil
+}
+
+// sectionPort 读取节中的一个端口号，未设置时返回 0
+func sectionPort(section *ini.Section, name string) (int, error) {
+	key := section.Key(name)
+	if key.String() == "" {
+		return 0, nil
+	}
+	port, err := key.Int()
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("section [%s] has an invalid %s '%s' (want 1-65535)", section.Name(), name, key.String())
+	}
+	return port, nil
+}
+
+// parseUserKeys 解析 [user.NAME] 节中的 secret、key.N 和 key.N.retire_after
+func parseUserKeys(section *ini.Section) ([]types.KeyConf, error) {
+	byGen := make(map[int]*types.KeyConf)
+	get := func(gen int) *types.KeyConf {
+		if byGen[gen] == nil {
+			byGen[gen] = &types.KeyConf{Generation: gen}
+		}
+		return byGen[gen]
+	}
+
+	for _, key := range section.Keys() {
+		name := key.Name()
+		if name == "secret" {
+			get(1).Secret = key.String()
+			continue
+		}
+		rest, ok := strings.CutPrefix(name, "key.")
+		if !ok {
+			continue // 其他用户级选项
+		}
+		genStr, field, _ := strings.Cut(rest, ".")
+		gen, err := strconv.Atoi(genStr)
+		if err != nil || gen <= 0 {
+			return nil, fmt.Errorf("invalid key generation in '%s'", name)
+		}
+		switch field {
+		case "":
+			get(gen).Secret = key.String()
+		case "retire_after":
+			t, err := parseTime(key.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s': %w", name, err)
+			}
+			get(gen).RetireAfter = t
+		default:
+			return nil, fmt.Errorf("unknown key option '%s'", name)
+		}
+	}
+
+	keys := make([]types.KeyConf, 0, len(byGen))
+	for _, k := range byGen {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Generation > keys[j].Generation })
+	return keys, nil
+}
+
+// parseTime 接受 RFC 3339 时间或 YYYY-MM-DD 形式的日期 (UTC 零点)
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,251 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/types"
+)
+
+func TestLoadListeners(t *testing.T) {
+	file, err := ini.Load([]byte(`
+[remote]
+port_ws_svr = 8080
+
+[listener.public]
+port = 443
+modes = ws
+tls_cert = certs/a.pem, /etc/b.pem
+tls_key = certs/a.key, /etc/b.key
+tls_client_ca = ca.pem
+
+[listener.private]
+bind = 10.0.0.5
+port = 7000
+modes = mux, multi-conn, udp
+users = alice, bob
+suite = aes-256-gcm
+kcp_port = 29900
+udp_port = 7001
+
+[listener.sidecar]
+bind = unix:/run/liuproxy/remote.sock
+socket_mode = 0660
+socket_owner = liuproxy:www-data
+
+[listener.]
+port = 1
+`))
+	if err != nil {
+		t.Fatalf("ini.Load: %v", err)
+	}
+	cfg := &types.Config{}
+	main := filepath.Join("/etc", "liuproxy", "remote.ini")
+	if err := loadListeners(cfg, file, main); err != nil {
+		t.Fatalf("loadListeners: %v", err)
+	}
+	want := []types.ListenerConf{
+		{
+			Name: "public", Port: 443, Modes: "ws",
+			TLSCert:     "/etc/liuproxy/certs/a.pem,/etc/b.pem",
+			TLSKey:      "/etc/liuproxy/certs/a.key,/etc/b.key",
+			TLSClientCA: "/etc/liuproxy/ca.pem",
+		},
+		{Name: "private", Bind: "10.0.0.5", Port: 7000, Modes: "mux, multi-conn, udp", Users: "alice, bob", Suite: "aes-256-gcm", KcpPort: 29900, UdpPort: 7001},
+		{Name: "sidecar", Bind: "unix:/run/liuproxy/remote.sock", SocketMode: "0660", SocketOwner: "liuproxy:www-data"},
+	}
+	if !reflect.DeepEqual(cfg.Listeners, want) {
+		t.Fatalf("listeners = %+v\nwant %+v", cfg.Listeners, want)
+	}
+}
+
+func TestLoadListeners_InvalidPorts(t *testing.T) {
+	for _, section := range []string{
+		"[listener.a]\nport = 0",
+		"[listener.a]\nport = 70000",
+		"[listener.a]\nport = http",
+		"[listener.a]\nport = 7000\nkcp_port = -1",
+		"[listener.a]\nport = 7000\nkcp_port = x",
+		"[listener.a]\nport = 7000\nudp_port = 0",
+	} {
+		file, err := ini.Load([]byte(section))
+		if err != nil {
+			t.Fatalf("ini.Load: %v", err)
+		}
+		if err := loadListeners(&types.Config{}, file, "remote.ini"); err == nil {
+			t.Errorf("loadListeners accepted %q", section)
+		}
+	}
+}
+
+func TestLoadUsersFrom(t *testing.T) {
+	file, err := ini.Load([]byte(`
+[users]
+alice = pw-a
+bob = pw-b
+
+[user.carol]
+key.1 = old
+key.3 = newest
+key.1.retire_after = 2026-11-01T08:00:00Z
+key.2 = middle
+key.2.retire_after = 2026-12-01
+suite = aes-256-gcm
+security = pq
+padding = 64-512
+padding_first = 200-800
+padding_jitter = 0-20
+certs = gw-*.example.com
+token = tok
+ws_path = /c4f1
+socks5_password = s5
+
+[user.dave]
+secret = pw-d
+`))
+	if err != nil {
+		t.Fatalf("ini.Load: %v", err)
+	}
+	cfg := &types.Config{}
+	if err := loadUsersFrom(cfg, file, "remote.ini", make(map[string]bool)); err != nil {
+		t.Fatalf("loadUsersFrom: %v", err)
+	}
+	want := []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw-a"}}},
+		{Name: "bob", Keys: []types.KeyConf{{Generation: 1, Secret: "pw-b"}}},
+		{
+			Name: "carol",
+			// 按代数从新到旧排列，与节中的书写顺序无关
+			Keys: []types.KeyConf{
+				{Generation: 3, Secret: "newest"},
+				{Generation: 2, Secret: "middle", RetireAfter: time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)},
+				{Generation: 1, Secret: "old", RetireAfter: time.Date(2026, 11, 1, 8, 0, 0, 0, time.UTC)},
+			},
+			Suite:          "aes-256-gcm",
+			Security:       "pq",
+			Padding:        types.PaddingConf{Frame: "64-512", First: "200-800", Jitter: "0-20"},
+			Certs:          "gw-*.example.com",
+			Token:          "tok",
+			WsPath:         "/c4f1",
+			Socks5Password: "s5",
+		},
+		{Name: "dave", Keys: []types.KeyConf{{Generation: 1, Secret: "pw-d"}}},
+	}
+	if !reflect.DeepEqual(cfg.Users, want) {
+		t.Fatalf("users = %+v\nwant %+v", cfg.Users, want)
+	}
+}
+
+func TestLoadUsersFrom_Invalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+	}{
+		{"duplicate in [users] and [user.NAME]", "[users]\nalice = pw\n[user.alice]\nkey.1 = pw"},
+		{"empty secret in [users]", "[users]\nalice ="},
+		{"no keys", "[user.alice]\nsuite = aes-256-gcm"},
+		{"empty key.N", "[user.alice]\nkey.1 ="},
+		{"retire_after without the key", "[user.alice]\nkey.2 = pw\nkey.1.retire_after = 2026-11-01"},
+		{"generation zero", "[user.alice]\nkey.0 = pw"},
+		{"generation not a number", "[user.alice]\nkey.x = pw"},
+		{"unknown key option", "[user.alice]\nkey.1 = pw\nkey.1.expires = 2026-11-01"},
+		{"invalid retire_after", "[user.alice]\nkey.1 = pw\nkey.1.retire_after = next week"},
+	}
+	for _, c := range cases {
+		file, err := ini.Load([]byte(c.content))
+		if err != nil {
+			t.Fatalf("%s: ini.Load: %v", c.name, err)
+		}
+		if err := loadUsersFrom(&types.Config{}, file, "remote.ini", make(map[string]bool)); err == nil {
+			t.Errorf("%s: loadUsersFrom accepted %q", c.name, c.content)
+		}
+	}
+}
+
+func TestLoadIni_UsersFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	writeFile("conf.d/users.ini", "[users]\nbob = pw-b\n")
+
+	// 相对路径以主配置文件所在目录为基准，而不是当前工作目录
+	main := writeFile("remote.ini", "[remote]\nusers_file = conf.d/users.ini\n[users]\nalice = pw-a\n")
+	cfg := &types.Config{}
+	if err := LoadIni(cfg, main); err != nil {
+		t.Fatalf("LoadIni: %v", err)
+	}
+	if len(cfg.Users) != 2 || cfg.Users[0].Name != "alice" || cfg.Users[1].Name != "bob" {
+		t.Fatalf("users = %+v, want alice from the main file and bob from the users file", cfg.Users)
+	}
+
+	// 同一个用户不能同时出现在主配置文件和用户文件中
+	dup := writeFile("dup.ini", "[remote]\nusers_file = conf.d/users.ini\n[user.bob]\nkey.1 = other\n")
+	if err := LoadIni(&types.Config{}, dup); err == nil || !strings.Contains(err.Error(), "duplicate user 'bob'") {
+		t.Fatalf("LoadIni with a duplicate user: err = %v", err)
+	}
+
+	missing := writeFile("missing.ini", "[remote]\nusers_file = nowhere.ini\n[users]\nalice = pw-a\n")
+	if err := LoadIni(&types.Config{}, missing); err == nil {
+		t.Fatal("LoadIni accepted a missing users file")
+	}
+}
+
+func TestLoadIni_RetiredKeyIsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote.ini")
+	content := "[user.alice]\nkey.2 = new\nkey.1 = old\nkey.1.retire_after = 2000-01-01\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &types.Config{}
+	if err := LoadIni(cfg, path); err != nil {
+		t.Fatalf("LoadIni: %v", err)
+	}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+
+	// 已过 retire_after 的一代密钥不再被接受，新一代密钥照常工作
+	for _, c := range []struct {
+		secret string
+		ok     bool
+	}{{"new", true}, {"old", false}} {
+		cipher, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", c.secret))
+		sealed, _ := cipher.Encrypt([]byte("metadata"))
+		if _, _, _, err := users.Identify(sealed, nil, nil); (err == nil) != c.ok {
+			t.Errorf("key %q: Identify err = %v, want ok=%v", c.secret, err, c.ok)
+		}
+	}
+}
+
+func TestLoadIni_ShippedConfig(t *testing.T) {
+	cfg := &types.Config{}
+	if err := LoadIni(cfg, filepath.Join("..", "ini", "remote.ini")); err != nil {
+		t.Fatalf("LoadIni: %v", err)
+	}
+	// 随附的配置不开启可被暴力破解的整数密钥，而是以 [users] 为默认
+	if cfg.CommonConf.LegacyCrypt {
+		t.Fatal("the shipped config enables legacy_crypt")
+	}
+	if len(cfg.Users) == 0 {
+		t.Fatal("the shipped config has no [users]")
+	}
+	if _, err := auth.NewRegistry(cfg); err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+}
@@ -3,50 +3,145 @@ package securecrypt
 
 import (
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 	"io"
 )
 
-type Cipher struct {
-	aead cipher.AEAD
+// messageSaltSize 是短 nonce 套件每条消息的随机盐长度，与 XChaCha20-Poly1305 的 nonce 相同
+const messageSaltSize = 24
+
+// messageSubkeyInfo 是派生单条消息子密钥时 HKDF 使用的 info
+const messageSubkeyInfo = "liuproxy-v3-message-subkey"
+
+// Cipher 是隧道使用的帧加密器。
+// 每次 Encrypt 都生成随机 nonce，输出格式为 nonce || AEAD 密文。
+// 同一个密钥被所有连接和 UDP 数据报共用，96 位的随机 nonce 在约 2^32 条消息后就可能重复
+// (对 GCM 而言会破坏认证)。因此 nonce 短于 messageSaltSize 的套件 (AES-256-GCM、ChaCha20-Poly1305)
+// 改为 salt(24) || AEAD 密文: 每条消息用随机盐经 HKDF 派生一次性子密钥，nonce 固定为 0。
+type Cipher interface {
+	// Suite 返回加密套件的名字，例如 "xchacha20-poly1305"
+	Suite() string
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+	// EncryptWithAD 与 Encrypt 相同，但额外认证 additionalData (不加密、不传输)
+	EncryptWithAD(plaintext, additionalData []byte) ([]byte, error)
+	// DecryptWithAD 与 Decrypt 相同，additionalData 必须与加密时一致
+	DecryptWithAD(ciphertext, additionalData []byte) ([]byte, error)
+	// NewStream 用 salt 从本加密器的密钥派生一个单方向的流式 AEAD (见 StreamCipher)
+	NewStream(salt []byte) (*StreamCipher, error)
+}
+
+// aeadCipher 是基于任意 cipher.AEAD 的 Cipher 实现
+type aeadCipher struct {
+	suite string
+	key   []byte
+	aead  cipher.AEAD
+	// perMessage 不为 nil 时，该套件的 nonce 太短，每条消息用它和随机盐派生的子密钥加密
+	perMessage AEADFactory
 }
 
 // NewCipher 创建一个硬编码使用 XChaCha20-Poly1305 的加密器。
-func NewCipher(key int) (*Cipher, error) {
+// 密钥直接由整数经 SHA-256 得到，只有约 2^31 种可能，仅为兼容旧客户端保留。
+// 新部署应使用 DeriveKey 和 NewCipherWithKey。
+func NewCipher(key int) (Cipher, error) {
 	keyBytes := []byte(fmt.Sprintf("liuproxy-secure-v2-key-%d", key))
 	hash := sha256.Sum256(keyBytes)
-	finalKey := hash[:]
+	return NewCipherWithKey(SuiteXChaCha20Poly1305, hash[:])
+}
 
-	aead, err := newChaCha20AEAD(finalKey)
+// NewCipherWithKey 使用指定的加密套件和一个已经派生好的 32 字节密钥创建加密器。
+func NewCipherWithKey(suite string, key []byte) (Cipher, error) {
+	factory, ok := lookupSuite(suite)
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher suite '%s'", suite)
+	}
+	aead, err := factory(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Cipher{aead: aead}, nil
+	c := &aeadCipher{suite: suite, key: append([]byte(nil), key...), aead: aead}
+	if aead.NonceSize() < messageSaltSize {
+		c.perMessage = factory
+	}
+	return c, nil
+}
+
+func (c *aeadCipher) Suite() string {
+	return c.suite
+}
+
+func (c *aeadCipher) NewStream(salt []byte) (*StreamCipher, error) {
+	return newStreamCipher(c.suite, c.key, salt)
 }
 
 // Encrypt 方法保持不变
-func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+func (c *aeadCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	return c.EncryptWithAD(plaintext, nil)
+}
+
+// Decrypt 方法保持不变
+func (c *aeadCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	return c.DecryptWithAD(ciphertext, nil)
+}
+
+func (c *aeadCipher) EncryptWithAD(plaintext, additionalData []byte) ([]byte, error) {
+	if c.perMessage != nil {
+		salt := make([]byte, messageSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, fmt.Errorf("failed to generate message salt: %w", err)
+		}
+		aead, err := c.messageAEAD(salt)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), plaintext, additionalData), nil
+	}
+
 	nonce := make([]byte, c.aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
-	ciphertext := c.aead.Seal(nonce, nonce, plaintext, nil)
+	ciphertext := c.aead.Seal(nonce, nonce, plaintext, additionalData)
 	return ciphertext, nil
 }
 
-// Decrypt 方法保持不变
-func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+func (c *aeadCipher) DecryptWithAD(ciphertext, additionalData []byte) ([]byte, error) {
+	if c.perMessage != nil {
+		if len(ciphertext) < messageSaltSize {
+			return nil, fmt.Errorf("ciphertext is too short")
+		}
+		aead, err := c.messageAEAD(ciphertext[:messageSaltSize])
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext[messageSaltSize:], additionalData)
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+		return plaintext, nil
+	}
+
 	nonceSize := c.aead.NonceSize()
 	if len(ciphertext) < nonceSize {
 		return nil, fmt.Errorf("ciphertext is too short")
 	}
 	nonce, encryptedMessage := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := c.aead.Open(nil, nonce, encryptedMessage, nil)
+	plaintext, err := c.aead.Open(nil, nonce, encryptedMessage, additionalData)
 	if err != nil {
 		return nil, fmt.Errorf("decryption failed: %w", err)
 	}
 	return plaintext, nil
 }
+
+// messageAEAD 用 salt 从密钥派生一条消息专用的 AEAD
+func (c *aeadCipher) messageAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha256.New, c.key, salt, messageSubkeyInfo, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive message subkey: %w", err)
+	}
+	return c.perMessage(subkey)
+}
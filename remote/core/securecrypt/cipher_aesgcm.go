@@ -0,0 +1,25 @@
+// --- internal/core/securecrypt/cipher_aesgcm.go ---
+package securecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// newAESGCMAEAD 根据给定的 32 字节密钥创建一个 AES-256-GCM AEAD 实例。
+// 在支持 AES-NI/PCLMULQDQ 的 CPU 上，它明显快于 ChaCha20 系列。
+func newAESGCMAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("AES-256-GCM requires a 32-byte key, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES block cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES-256-GCM instance: %w", err)
+	}
+	return aead, nil
+}
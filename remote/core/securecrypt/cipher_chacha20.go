@@ -16,3 +16,12 @@ func newChaCha20AEAD(key []byte) (cipher.AEAD, error) {
 	}
 	return aead, nil
 }
+
+// newChaCha20IETFAEAD 根据给定的密钥创建一个 12 字节 nonce 的 ChaCha20-Poly1305 (RFC 8439) AEAD 实例。
+func newChaCha20IETFAEAD(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ChaCha20-Poly1305 instance: %w", err)
+	}
+	return aead, nil
+}
@@ -91,3 +91,23 @@ func TestCipher_Decrypt_TamperedData(t *testing.T) {
 		t.Logf("Successfully caught expected error on tampered data: %v", err)
 	}
 }
+
+func TestCipher_DecryptWithAD_Mismatch(t *testing.T) {
+	cipher, _ := NewCipher(125)
+	plaintext := []byte("frame bound to its stream")
+
+	ciphertext, err := cipher.EncryptWithAD(plaintext, []byte("uplink-0"))
+	if err != nil {
+		t.Fatalf("EncryptWithAD() failed: %v", err)
+	}
+	if _, err := cipher.DecryptWithAD(ciphertext, []byte("uplink-1")); err == nil {
+		t.Fatal("DecryptWithAD() should have failed with different additional data")
+	}
+	if _, err := cipher.Decrypt(ciphertext); err == nil {
+		t.Fatal("Decrypt() should have failed on a ciphertext sealed with additional data")
+	}
+	decrypted, err := cipher.DecryptWithAD(ciphertext, []byte("uplink-0"))
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("DecryptWithAD() = %q, %v", decrypted, err)
+	}
+}
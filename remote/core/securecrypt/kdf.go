@@ -0,0 +1,25 @@
+// --- kdf.go ---
+package securecrypt
+
+import (
+	"crypto/sha256"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id 参数，取自 RFC 9106 推荐的第二组配置 (t=3, m=64MiB, p=4)。
+// 客户端必须使用完全相同的参数，修改它们等同于更换所有用户的密钥。
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	KeySize       = 32
+)
+
+// DeriveKey 使用 Argon2id 从口令派生出 KeySize 字节的密钥。
+// 盐由用户名确定性地生成，这样两端无需交换盐，
+// 而不同用户即使使用相同口令也会得到不同的密钥。
+func DeriveKey(name, passphrase string) []byte {
+	salt := sha256.Sum256([]byte("liuproxy-v3-argon2id-salt:" + name))
+	return argon2.IDKey([]byte(passphrase), salt[:16], argon2Time, argon2Memory, argon2Threads, KeySize)
+}
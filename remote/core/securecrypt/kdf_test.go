@@ -0,0 +1,39 @@
+package securecrypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveKey_DeterministicAndSalted(t *testing.T) {
+	k1 := DeriveKey("alice", "correct horse battery staple")
+	k2 := DeriveKey("alice", "correct horse battery staple")
+	if !bytes.Equal(k1, k2) {
+		t.Fatal("DeriveKey() is not deterministic for the same name and passphrase")
+	}
+	if len(k1) != KeySize {
+		t.Fatalf("DeriveKey() returned %d bytes, want %d", len(k1), KeySize)
+	}
+
+	// 相同口令、不同用户名必须得到不同的密钥
+	k3 := DeriveKey("bob", "correct horse battery staple")
+	if bytes.Equal(k1, k3) {
+		t.Fatal("DeriveKey() returned the same key for different users")
+	}
+}
+
+func TestDerivedKey_IncompatibleWithLegacy(t *testing.T) {
+	legacy, _ := NewCipher(125)
+	modern, err := NewCipherWithKey(DefaultSuite, DeriveKey("default", "125"))
+	if err != nil {
+		t.Fatalf("NewCipherWithKey() failed: %v", err)
+	}
+
+	ciphertext, _ := modern.Encrypt([]byte("hello"))
+	if _, err := legacy.Decrypt(ciphertext); err == nil {
+		t.Fatal("legacy cipher decrypted a frame sealed with a KDF-derived key")
+	}
+	if _, err := modern.Decrypt(ciphertext); err != nil {
+		t.Fatalf("Decrypt() failed: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// --- keyring.go ---
+package securecrypt
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrNoMatchingKey 表示密钥环中没有任何有效密钥能解开给定的密文
+var ErrNoMatchingKey = errors.New("no active key matches the ciphertext")
+
+// Key 是密钥环中的一代密钥在某个加密套件下的加密器。
+// 同一代密钥接受多个套件时 (suite = auto)，密钥环中会有多个 Generation 相同的 Key。
+type Key struct {
+	// Generation 是密钥的代数，数字越大越新
+	Generation int
+	// RetireAfter 之后该密钥不再被接受；零值表示永不退役
+	RetireAfter time.Time
+	Cipher      Cipher
+}
+
+// Active 报告该密钥在 now 时刻是否仍可使用
+func (k *Key) Active(now time.Time) bool {
+	return k.RetireAfter.IsZero() || now.Before(k.RetireAfter)
+}
+
+// Keyring 是一组同时被接受的密钥，按代数从新到旧排列。
+// 轮换密钥时，先把新密钥加入密钥环并给旧密钥设置退役时间，
+// 等所有客户端都换上新密钥后，旧密钥会自动失效。
+type Keyring struct {
+	keys []*Key
+}
+
+// NewKeyring 创建密钥环，keys 会按代数从新到旧重新排序，同一代内保持传入顺序。
+func NewKeyring(keys ...*Key) *Keyring {
+	sorted := append([]*Key(nil), keys...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Generation > sorted[j].Generation
+	})
+	return &Keyring{keys: sorted}
+}
+
+// Keys 返回密钥环中的所有密钥 (包括已退役的)，从新到旧
+func (kr *Keyring) Keys() []*Key {
+	return kr.keys
+}
+
+// Current 返回最新一代密钥中排在最前面的一个
+func (kr *Keyring) Current() *Key {
+	if len(kr.keys) == 0 {
+		return nil
+	}
+	return kr.keys[0]
+}
+
+// Open 依次用每个仍有效的密钥尝试解密 ciphertext，
+// 返回匹配的密钥和明文。调用方应在整个流中继续使用这个密钥。
+func (kr *Keyring) Open(ciphertext []byte) (*Key, []byte, error) {
+	now := time.Now()
+	for _, key := range kr.keys {
+		if !key.Active(now) {
+			continue
+		}
+		if plaintext, err := key.Cipher.Decrypt(ciphertext); err == nil {
+			return key, plaintext, nil
+		}
+	}
+	return nil, nil, ErrNoMatchingKey
+}
@@ -0,0 +1,42 @@
+package securecrypt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyring_OpenMatchesOlderGeneration(t *testing.T) {
+	oldCipher, _ := NewCipher(1)
+	newCipher, _ := NewCipher(2)
+	kr := NewKeyring(
+		&Key{Generation: 1, RetireAfter: time.Now().Add(time.Hour), Cipher: oldCipher},
+		&Key{Generation: 2, Cipher: newCipher},
+	)
+
+	if kr.Current().Generation != 2 {
+		t.Fatalf("Current() generation = %d, want 2", kr.Current().Generation)
+	}
+
+	ciphertext, _ := oldCipher.Encrypt([]byte("still on the old key"))
+	key, plaintext, err := kr.Open(ciphertext)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if key.Generation != 1 || string(plaintext) != "still on the old key" {
+		t.Fatalf("Open() matched generation %d with plaintext %q", key.Generation, plaintext)
+	}
+}
+
+func TestKeyring_OpenRejectsRetiredKey(t *testing.T) {
+	oldCipher, _ := NewCipher(1)
+	newCipher, _ := NewCipher(2)
+	kr := NewKeyring(
+		&Key{Generation: 1, RetireAfter: time.Now().Add(-time.Minute), Cipher: oldCipher},
+		&Key{Generation: 2, Cipher: newCipher},
+	)
+
+	ciphertext, _ := oldCipher.Encrypt([]byte("too late"))
+	if _, _, err := kr.Open(ciphertext); err != ErrNoMatchingKey {
+		t.Fatalf("Open() error = %v, want ErrNoMatchingKey", err)
+	}
+}
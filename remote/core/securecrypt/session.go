@@ -0,0 +1,70 @@
+// --- session.go ---
+package securecrypt
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// sessionKeyInfo 是派生会话密钥时 HKDF 使用的 info，修改它会使所有客户端无法握手
+const sessionKeyInfo = "liuproxy-v3-session-key"
+
+// 握手中各公开参数的字节数
+const (
+	X25519PublicKeySize          = 32
+	MLKEM768EncapsulationKeySize = mlkem.EncapsulationKeySize768
+	MLKEM768CiphertextSize       = mlkem.CiphertextSize768
+)
+
+// GenerateX25519 生成一个一次性的 X25519 密钥对，用于单个会话的握手。
+func GenerateX25519() (*ecdh.PrivateKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate X25519 key: %w", err)
+	}
+	return priv, nil
+}
+
+// X25519SharedSecret 用本方私钥和对方公钥计算共享秘密。
+func X25519SharedSecret(priv *ecdh.PrivateKey, peerPublic []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 public key: %w", err)
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("X25519 key agreement failed: %w", err)
+	}
+	return secret, nil
+}
+
+// MLKEM768Encapsulate 用对方的 ML-KEM-768 封装公钥生成共享秘密及其密文。
+// 共享秘密只有持有对应解封装私钥的一方才能从密文中恢复。
+func MLKEM768Encapsulate(encapsulationKey []byte) (sharedKey, ciphertext []byte, err error) {
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ML-KEM-768 encapsulation key: %w", err)
+	}
+	sharedKey, ciphertext = ek.Encapsulate()
+	return sharedKey, ciphertext, nil
+}
+
+// DeriveSessionKey 用 HKDF-SHA256 从一个或多个共享秘密派生 KeySize 字节的会话密钥。
+// transcript 是握手中双方公开参数的拼接，它的哈希作为盐，
+// 使会话密钥与这一次握手绑定。多个共享秘密 (例如混合密钥交换) 按顺序拼接后作为输入。
+func DeriveSessionKey(transcript []byte, secrets ...[]byte) ([]byte, error) {
+	var ikm []byte
+	for _, s := range secrets {
+		ikm = append(ikm, s...)
+	}
+	salt := sha256.Sum256(transcript)
+	key, err := hkdf.Key(sha256.New, ikm, salt[:], sessionKeyInfo, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive session key: %w", err)
+	}
+	return key, nil
+}
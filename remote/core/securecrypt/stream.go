@@ -0,0 +1,96 @@
+// --- stream.go ---
+package securecrypt
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// StreamSaltSize 是流式模式中每个方向随机盐的字节数
+const StreamSaltSize = 32
+
+// streamSubkeyInfo 是派生流子密钥时 HKDF 使用的 info
+const streamSubkeyInfo = "liuproxy-v3-stream-subkey"
+
+// ErrNonceExhausted 表示计数器 nonce 即将回绕，流必须关闭
+var ErrNonceExhausted = errors.New("stream nonce counter exhausted")
+
+// StreamCipher 是单个流单个方向上的 AEAD，风格与 Shadowsocks AEAD 相同:
+// 每个方向用一个随机盐经 HKDF 从主密钥派生子密钥，nonce 是从 0 开始递增的小端计数器。
+// 因此帧中不再携带 nonce，也不需要每帧读取 crypto/rand。
+// StreamCipher 不是并发安全的，每个方向各用一个。
+type StreamCipher struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+// newStreamCipher 用主密钥和盐派生子密钥，创建指定套件的 StreamCipher
+func newStreamCipher(suite string, masterKey, salt []byte) (*StreamCipher, error) {
+	if len(salt) != StreamSaltSize {
+		return nil, fmt.Errorf("stream salt must be %d bytes, got %d", StreamSaltSize, len(salt))
+	}
+	subkey, err := hkdf.Key(sha256.New, masterKey, salt, streamSubkeyInfo, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive stream subkey: %w", err)
+	}
+	factory, ok := lookupSuite(suite)
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher suite '%s'", suite)
+	}
+	aead, err := factory(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamCipher{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+// Overhead 返回每帧的认证标签长度
+func (s *StreamCipher) Overhead() int {
+	return s.aead.Overhead()
+}
+
+// Seal 加密 plaintext 并追加到 dst，然后递增 nonce
+func (s *StreamCipher) Seal(dst, plaintext, additionalData []byte) ([]byte, error) {
+	if err := s.checkNonce(); err != nil {
+		return nil, err
+	}
+	out := s.aead.Seal(dst, s.nonce, plaintext, additionalData)
+	s.increment()
+	return out, nil
+}
+
+// Open 解密 ciphertext 并追加到 dst，然后递增 nonce。
+// 帧被丢弃、重排或重复时，nonce 不再对齐，解密必然失败。
+func (s *StreamCipher) Open(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	if err := s.checkNonce(); err != nil {
+		return nil, err
+	}
+	out, err := s.aead.Open(dst, s.nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	s.increment()
+	return out, nil
+}
+
+// checkNonce 在计数器的 64 位低位全部为 1 时拒绝继续使用，避免 nonce 重用
+func (s *StreamCipher) checkNonce() error {
+	for _, b := range s.nonce[:8] {
+		if b != 0xff {
+			return nil
+		}
+	}
+	return ErrNonceExhausted
+}
+
+func (s *StreamCipher) increment() {
+	for i := range s.nonce {
+		s.nonce[i]++
+		if s.nonce[i] != 0 {
+			return
+		}
+	}
+}
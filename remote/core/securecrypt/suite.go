@@ -0,0 +1,132 @@
+// --- suite.go ---
+package securecrypt
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"golang.org/x/sys/cpu"
+)
+
+// 已注册的加密套件名字
+const (
+	SuiteXChaCha20Poly1305 = "xchacha20-poly1305"
+	SuiteChaCha20Poly1305  = "chacha20-poly1305"
+	SuiteAES256GCM         = "aes-256-gcm"
+
+	// SuiteAuto 不是一个真正的套件: 服务端接受所有已注册套件，并按客户端实际使用的套件回复；
+	// 客户端则通过 PreferredSuite 按自己的流量类型选择本机最快的套件。
+	SuiteAuto = "auto"
+
+	// DefaultSuite 是未配置套件时使用的套件，与 v2.2 客户端兼容
+	DefaultSuite = SuiteXChaCha20Poly1305
+)
+
+// AEADFactory 根据 KeySize 字节的密钥创建一个 AEAD 实例
+type AEADFactory func(key []byte) (cipher.AEAD, error)
+
+var (
+	suitesMu sync.RWMutex
+	suites   = make(map[string]AEADFactory)
+	// suiteOrder 记录注册顺序，auto 模式下按此顺序试解密
+	suiteOrder []string
+)
+
+func init() {
+	RegisterSuite(SuiteXChaCha20Poly1305, newChaCha20AEAD)
+	RegisterSuite(SuiteAES256GCM, newAESGCMAEAD)
+	RegisterSuite(SuiteChaCha20Poly1305, newChaCha20IETFAEAD)
+}
+
+// RegisterSuite 注册一个加密套件。重复注册同名套件会 panic。
+func RegisterSuite(name string, factory AEADFactory) {
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	if name == SuiteAuto {
+		panic("securecrypt: suite name 'auto' is reserved")
+	}
+	if _, exists := suites[name]; exists {
+		panic(fmt.Sprintf("securecrypt: suite '%s' registered twice", name))
+	}
+	suites[name] = factory
+	suiteOrder = append(suiteOrder, name)
+}
+
+func lookupSuite(name string) (AEADFactory, bool) {
+	suitesMu.RLock()
+	defer suitesMu.RUnlock()
+	factory, ok := suites[name]
+	return factory, ok
+}
+
+// Suites 返回所有已注册套件的名字 (按字母排序)
+func Suites() []string {
+	suitesMu.RLock()
+	defer suitesMu.RUnlock()
+	names := append([]string(nil), suiteOrder...)
+	sort.Strings(names)
+	return names
+}
+
+// HasAESHardware 报告本机 CPU 是否支持 AES-GCM 硬件加速
+func HasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	}
+	return false
+}
+
+// HasShortNonce 报告 suite 的 nonce 是否短于 messageSaltSize。
+// 这类套件 (AES-256-GCM、ChaCha20-Poly1305) 在随机 nonce 模式下每条消息都要派生一次性子密钥，
+// 只适合元数据、握手和 UDP 数据报这样的单条消息；数据帧必须使用流式模式 (见 StreamCipher)。
+func HasShortNonce(suite string) bool {
+	factory, ok := lookupSuite(suite)
+	if !ok {
+		return false
+	}
+	aead, err := factory(make([]byte, KeySize))
+	return err == nil && aead.NonceSize() < messageSaltSize
+}
+
+// PreferredSuite 返回本机上最快的套件。streamFrames 表示流量以流式模式的数据帧为主:
+// 此时有 AES 硬件加速的 CPU 上 AES-256-GCM 最快；而随机 nonce 模式 (单条消息、UDP 数据报) 中
+// AES-256-GCM 每条消息都要派生子密钥，即使有硬件加速也慢于 XChaCha20-Poly1305 (见 BenchmarkSuites)。
+func PreferredSuite(streamFrames bool) string {
+	if streamFrames && HasAESHardware() {
+		return SuiteAES256GCM
+	}
+	return SuiteXChaCha20Poly1305
+}
+
+// ResolveSuites 把配置中的套件名展开为需要接受的套件列表。
+// 空字符串表示 DefaultSuite；"auto" 表示所有已注册套件。服务端按返回的顺序试解密元数据和 UDP 数据报，
+// 它们都是随机 nonce 模式的单条消息，因此该模式下最快的套件排在最前面。
+func ResolveSuites(name string) ([]string, error) {
+	switch name {
+	case "":
+		return []string{DefaultSuite}, nil
+	case SuiteAuto:
+		preferred := PreferredSuite(false)
+		suitesMu.RLock()
+		defer suitesMu.RUnlock()
+		resolved := []string{preferred}
+		for _, s := range suiteOrder {
+			if s != preferred {
+				resolved = append(resolved, s)
+			}
+		}
+		return resolved, nil
+	}
+	if _, ok := lookupSuite(name); !ok {
+		return nil, fmt.Errorf("unknown cipher suite '%s' (available: %v, or '%s')", name, Suites(), SuiteAuto)
+	}
+	return []string{name}, nil
+}
@@ -0,0 +1,118 @@
+package securecrypt
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSuites_EncryptDecrypt(t *testing.T) {
+	key := DeriveKey("alice", "suite test")
+	plaintext := []byte("the same message under every suite")
+
+	for _, suite := range Suites() {
+		t.Run(suite, func(t *testing.T) {
+			c, err := NewCipherWithKey(suite, key)
+			if err != nil {
+				t.Fatalf("NewCipherWithKey() failed: %v", err)
+			}
+			if c.Suite() != suite {
+				t.Fatalf("Suite() = %s, want %s", c.Suite(), suite)
+			}
+			ciphertext, err := c.Encrypt(plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt() failed: %v", err)
+			}
+			decrypted, err := c.Decrypt(ciphertext)
+			if err != nil {
+				t.Fatalf("Decrypt() failed: %v", err)
+			}
+			if !bytes.Equal(plaintext, decrypted) {
+				t.Fatalf("Decrypt() = %q, want %q", decrypted, plaintext)
+			}
+		})
+	}
+}
+
+func TestSuites_ShortNonceUsesMessageSubkeys(t *testing.T) {
+	key := DeriveKey("alice", "suite test")
+	plaintext := []byte("random 96-bit nonces are not safe under a shared key")
+	for _, suite := range []string{SuiteAES256GCM, SuiteChaCha20Poly1305} {
+		c, _ := NewCipherWithKey(suite, key)
+		ciphertext, err := c.Encrypt(plaintext)
+		if err != nil {
+			t.Fatalf("%s: Encrypt() failed: %v", suite, err)
+		}
+		// salt(24) || 密文 || 标签(16)，不携带 nonce
+		if want := messageSaltSize + len(plaintext) + 16; len(ciphertext) != want {
+			t.Fatalf("%s: ciphertext is %d bytes, want %d", suite, len(ciphertext), want)
+		}
+		// 直接用长期密钥和线路上的字节作 nonce 无法解开，说明密钥确实是逐条派生的
+		factory, _ := lookupSuite(suite)
+		raw, _ := factory(key)
+		if _, err := raw.Open(nil, ciphertext[:raw.NonceSize()], ciphertext[messageSaltSize:], nil); err == nil {
+			t.Fatalf("%s: ciphertext opened under the long-term key", suite)
+		}
+		ciphertext[0] ^= 0x01
+		if _, err := c.Decrypt(ciphertext); err == nil {
+			t.Fatalf("%s: Decrypt() accepted a modified salt", suite)
+		}
+	}
+}
+
+func TestResolveSuites_AutoPrefersRandomNonceSpeed(t *testing.T) {
+	resolved, err := ResolveSuites(SuiteAuto)
+	if err != nil {
+		t.Fatalf("ResolveSuites() failed: %v", err)
+	}
+	// 服务端试解密的都是随机 nonce 模式的单条消息，AES 硬件加速在这种模式下没有优势
+	if resolved[0] != SuiteXChaCha20Poly1305 {
+		t.Fatalf("ResolveSuites(auto)[0] = %s, want %s", resolved[0], SuiteXChaCha20Poly1305)
+	}
+	if len(resolved) != len(Suites()) {
+		t.Fatalf("ResolveSuites(auto) returned %d suites, want %d", len(resolved), len(Suites()))
+	}
+	if _, err := ResolveSuites("rot13"); err == nil {
+		t.Fatal("ResolveSuites() accepted an unknown suite")
+	}
+}
+
+func TestPreferredSuite(t *testing.T) {
+	if got := PreferredSuite(false); got != SuiteXChaCha20Poly1305 {
+		t.Fatalf("PreferredSuite(false) = %s, want %s", got, SuiteXChaCha20Poly1305)
+	}
+	want := SuiteXChaCha20Poly1305
+	if HasAESHardware() {
+		want = SuiteAES256GCM
+	}
+	if got := PreferredSuite(true); got != want {
+		t.Fatalf("PreferredSuite(true) = %s, want %s", got, want)
+	}
+	for suite, short := range map[string]bool{SuiteXChaCha20Poly1305: false, SuiteAES256GCM: true, SuiteChaCha20Poly1305: true, "rot13": false} {
+		if HasShortNonce(suite) != short {
+			t.Errorf("HasShortNonce(%s) = %v, want %v", suite, !short, short)
+		}
+	}
+}
+
+// BenchmarkSuites 比较各套件在随机 nonce 模式下加密+解密单条消息 (64 B 到 4 KB) 的吞吐量。
+// nonce 较短的套件每条消息都要派生子密钥，小消息上明显慢于 XChaCha20-Poly1305，数据帧的比较见 BenchmarkFrameModes。
+// 运行: go test -bench Suites ./remote/core/securecrypt
+func BenchmarkSuites(b *testing.B) {
+	key := DeriveKey("bench", "bench")
+	for _, size := range []int{64, 1400, 4096} {
+		for _, suite := range Suites() {
+			c, _ := NewCipherWithKey(suite, key)
+			payload := make([]byte, size)
+			b.Run(fmt.Sprintf("%s/%dB", suite, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					ciphertext, _ := c.Encrypt(payload)
+					if _, err := c.Decrypt(ciphertext); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
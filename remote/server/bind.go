@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// unixBindPrefix 是 Unix 套接字监听地址的前缀，例如 "unix:/run/remote.sock" 或抽象套接字 "unix:@remote"
+const unixBindPrefix = "unix:"
+
+// bindAddr 是一个监听地址。host 为空表示所有地址 (IPv4/IPv6 双栈)；
+// 明确写出的地址只监听对应的协议族，例如 "0.0.0.0" 只接受 IPv4，"::" 只接受 IPv6。
+// unix 不为空时是 Unix 套接字的路径，以 "@" 开头表示 Linux 抽象命名空间中的套接字
+type bindAddr struct {
+	host   string
+	family string // "4"、"6" 或 "" (双栈)
+	unix   string
+}
+
+// parseBindAddrs 解析 bind 配置项，空字符串返回一个双栈地址
+func parseBindAddrs(bind string) ([]bindAddr, error) {
+	var addrs []bindAddr
+	for _, item := range strings.Split(bind, ",") {
+		item = strings.TrimSpace(item)
+		if path, ok := strings.CutPrefix(item, unixBindPrefix); ok {
+			if path == "" || path == "@" {
+				return nil, fmt.Errorf("invalid bind address '%s' (want unix:/path or unix:@name)", item)
+			}
+			addrs = append(addrs, bindAddr{unix: path})
+			continue
+		}
+		item = strings.TrimSuffix(strings.TrimPrefix(item, "["), "]")
+		if item == "" {
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address '%s' (want an IP address)", item)
+		}
+		family := "6"
+		if ip.To4() != nil {
+			family = "4"
+		}
+		addrs = append(addrs, bindAddr{host: ip.String(), family: family})
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, bindAddr{})
+	}
+	return addrs, nil
+}
+
+// isUnix 报告该地址是否为 Unix 套接字
+func (b bindAddr) isUnix() bool {
+	return b.unix != ""
+}
+
+// network 返回 proto ("tcp" 或 "udp") 在该地址上使用的网络名。Unix 套接字只用于 TCP 上的入站模式
+func (b bindAddr) network(proto string) string {
+	if b.isUnix() {
+		return "unix"
+	}
+	return proto + b.family
+}
+
+// addr 返回该地址上 port 端口的 host:port 形式，Unix 套接字返回其路径
+func (b bindAddr) addr(port int) string {
+	if b.isUnix() {
+		return b.unix
+	}
+	return net.JoinHostPort(b.host, strconv.Itoa(port))
+}
+
+// ipBindAddrs 返回 binds 中的 IP 地址，没有时返回一个双栈地址。
+// 用于只能监听 IP 地址的端口 (例如 KCP)
+func ipBindAddrs(binds []bindAddr) []bindAddr {
+	var out []bindAddr
+	for _, b := range binds {
+		if !b.isUnix() {
+			out = append(out, b)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, bindAddr{})
+	}
+	return out
+}
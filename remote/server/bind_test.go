@@ -0,0 +1,55 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBindAddrs(t *testing.T) {
+	cases := []struct {
+		bind string
+		want []bindAddr
+	}{
+		{"", []bindAddr{{}}},
+		{" , ", []bindAddr{{}}},
+		{"0.0.0.0", []bindAddr{{host: "0.0.0.0", family: "4"}}},
+		{"::", []bindAddr{{host: "::", family: "6"}}},
+		{"127.0.0.1, [::1]", []bindAddr{{host: "127.0.0.1", family: "4"}, {host: "::1", family: "6"}}},
+		{"::ffff:10.0.0.1", []bindAddr{{host: "10.0.0.1", family: "4"}}},
+		{"unix:/run/remote.sock, 10.0.0.5", []bindAddr{{unix: "/run/remote.sock"}, {host: "10.0.0.5", family: "4"}}},
+		{"unix:@remote", []bindAddr{{unix: "@remote"}}},
+	}
+	for _, c := range cases {
+		got, err := parseBindAddrs(c.bind)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseBindAddrs(%q) = %+v, %v; want %+v", c.bind, got, err, c.want)
+		}
+	}
+
+	for _, bind := range []string{"localhost", "10.0.0.256", "unix:", "unix:@", "10.0.0.1:80"} {
+		if got, err := parseBindAddrs(bind); err == nil {
+			t.Errorf("parseBindAddrs(%q) = %+v, want an error", bind, got)
+		}
+	}
+}
+
+func TestBindAddr_NetworkAndAddr(t *testing.T) {
+	cases := []struct {
+		b       bindAddr
+		network string
+		addr    string
+	}{
+		{bindAddr{}, "tcp", ":443"},
+		{bindAddr{host: "127.0.0.1", family: "4"}, "tcp4", "127.0.0.1:443"},
+		{bindAddr{host: "::1", family: "6"}, "tcp6", "[::1]:443"},
+		{bindAddr{unix: "/run/remote.sock"}, "unix", "/run/remote.sock"},
+	}
+	for _, c := range cases {
+		if got := c.b.network("tcp"); got != c.network {
+			t.Errorf("%+v network = %s, want %s", c.b, got, c.network)
+		}
+		if got := c.b.addr(443); got != c.addr {
+			t.Errorf("%+v addr = %s, want %s", c.b, got, c.addr)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build kcp
+
+package server
+
+import (
+	"log"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"liuproxy_remote/remote/tunnel"
+)
+
+// serveKCP 在 addr 上运行 KCP 监听器，直到监听器关闭。
+// KCP 层不再加密 (流内的元数据和帧已经加密)，只做可靠传输和 FEC。连接按所属监听器的入站配置 in 处理。
+func (s *AppServer) serveKCP(addr string, opts kcpOptions, in *tunnel.Inbound) {
+	listener, err := kcp.ListenWithOptions(addr, nil, opts.DataShard, opts.ParityShard)
+	if err != nil {
+		log.Fatalf("Failed to listen on KCP port %s: %v", addr, err)
+	}
+	defer listener.Close()
+	if err := listener.SetReadBuffer(opts.SocketBuffer); err != nil {
+		log.Printf("[REMOTE-KCP] Failed to set socket read buffer: %v", err)
+	}
+	if err := listener.SetWriteBuffer(opts.SocketBuffer); err != nil {
+		log.Printf("[REMOTE-KCP] Failed to set socket write buffer: %v", err)
+	}
+	log.Printf(">>> SUCCESS: GoRemote v3 (KCP) server listening on %s (%s)", addr, opts)
+
+	for {
+		conn, err := listener.AcceptKCP()
+		if err != nil {
+			log.Printf("[REMOTE-KCP] KCP listener stopped: %v", err)
+			return
+		}
+		conn.SetStreamMode(true)
+		conn.SetWriteDelay(false)
+		conn.SetNoDelay(opts.NoDelay, opts.Interval, opts.Resend, opts.NC)
+		conn.SetWindowSize(opts.SndWnd, opts.RcvWnd)
+		conn.SetMtu(opts.MTU)
+		conn.SetACKNoDelay(opts.NoDelay == 1)
+
+		s.waitGroup.Add(1)
+		go func() {
+			defer s.waitGroup.Done()
+			tunnel.HandleKCPConnection(conn, in)
+		}()
+	}
+}
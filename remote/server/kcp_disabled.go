@@ -0,0 +1,15 @@
+//go:build !kcp
+
+package server
+
+import (
+	"log"
+
+	"liuproxy_remote/remote/tunnel"
+)
+
+// serveKCP 在不带 kcp 构建标签的版本中不可用。
+// 需要 KCP 时用 -tags kcp 重新构建。
+func (s *AppServer) serveKCP(addr string, opts kcpOptions, in *tunnel.Inbound) {
+	log.Fatalln("kcp_port is set, but this binary was built without KCP support (rebuild with -tags kcp).")
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"liuproxy_remote/remote/types"
+)
+
+// KCP 的默认窗口、MTU、FEC 分片数和套接字缓冲区大小
+const (
+	defaultKCPSndWnd      = 1024
+	defaultKCPRcvWnd      = 1024
+	defaultKCPMTU         = 1350
+	defaultKCPDataShard   = 10
+	defaultKCPParityShard = 3
+	kcpSocketBuffer       = 4 << 20
+)
+
+// kcpProfile 是 KCP 拥塞控制相关的四个参数，含义见 ikcp_nodelay
+type kcpProfile struct {
+	NoDelay  int // 是否启用 nodelay 模式 (0/1)
+	Interval int // 内部刷新间隔 (毫秒)
+	Resend   int // 快速重传阈值，0 表示关闭快速重传
+	NC       int // 是否关闭拥塞控制 (0/1)
+}
+
+// kcpProfiles 是可选的参数预设，与 kcptun 的同名模式一致
+var kcpProfiles = map[string]kcpProfile{
+	"normal": {NoDelay: 0, Interval: 40, Resend: 2, NC: 1},
+	"fast":   {NoDelay: 0, Interval: 30, Resend: 2, NC: 1},
+	"fast2":  {NoDelay: 1, Interval: 20, Resend: 2, NC: 1},
+	"fast3":  {NoDelay: 1, Interval: 10, Resend: 2, NC: 1},
+}
+
+// kcpOptions 是 KCP 监听器的全部参数
+type kcpOptions struct {
+	kcpProfile
+	SndWnd       int
+	RcvWnd       int
+	MTU          int
+	DataShard    int
+	ParityShard  int
+	SocketBuffer int
+}
+
+// newKCPOptions 根据 kcp_profile 选择预设，再应用 kcp_* 中的单项设置
+func newKCPOptions(conf *types.RemoteConf) (kcpOptions, error) {
+	name := strings.ToLower(strings.TrimSpace(conf.KcpProfile))
+	if name == "" {
+		name = "fast"
+	}
+	profile, ok := kcpProfiles[name]
+	if !ok {
+		return kcpOptions{}, fmt.Errorf("unknown kcp_profile '%s' (want normal, fast, fast2 or fast3)", conf.KcpProfile)
+	}
+	opts := kcpOptions{
+		kcpProfile:   profile,
+		SndWnd:       defaultKCPSndWnd,
+		RcvWnd:       defaultKCPRcvWnd,
+		MTU:          defaultKCPMTU,
+		DataShard:    defaultKCPDataShard,
+		ParityShard:  defaultKCPParityShard,
+		SocketBuffer: kcpSocketBuffer,
+	}
+
+	overrides := []struct {
+		key    string
+		value  string
+		target *int
+	}{
+		{"kcp_nodelay", conf.KcpNoDelay, &opts.NoDelay},
+		{"kcp_interval", conf.KcpInterval, &opts.Interval},
+		{"kcp_resend", conf.KcpResend, &opts.Resend},
+		{"kcp_nc", conf.KcpNC, &opts.NC},
+	}
+	for _, o := range overrides {
+		if o.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(o.value))
+		if err != nil || n < 0 {
+			return kcpOptions{}, fmt.Errorf("invalid %s '%s'", o.key, o.value)
+		}
+		*o.target = n
+	}
+	if opts.Interval < 10 || opts.Interval > 5000 {
+		return kcpOptions{}, fmt.Errorf("kcp_interval must be between 10 and 5000 ms")
+	}
+
+	if conf.KcpSndWnd > 0 {
+		opts.SndWnd = conf.KcpSndWnd
+	}
+	if conf.KcpRcvWnd > 0 {
+		opts.RcvWnd = conf.KcpRcvWnd
+	}
+	if conf.KcpMTU > 0 {
+		if conf.KcpMTU < 576 || conf.KcpMTU > 1500 {
+			return kcpOptions{}, fmt.Errorf("kcp_mtu must be between 576 and 1500")
+		}
+		opts.MTU = conf.KcpMTU
+	}
+
+	if conf.KcpFEC != "" {
+		data, parity, ok := strings.Cut(conf.KcpFEC, ",")
+		d, err1 := strconv.Atoi(strings.TrimSpace(data))
+		p, err2 := strconv.Atoi(strings.TrimSpace(parity))
+		if !ok || err1 != nil || err2 != nil || d < 0 || p < 0 || (d == 0) != (p == 0) {
+			return kcpOptions{}, fmt.Errorf("invalid kcp_fec '%s' (want \"data,parity\", e.g. \"10,3\", or \"0,0\")", conf.KcpFEC)
+		}
+		opts.DataShard, opts.ParityShard = d, p
+	}
+	return opts, nil
+}
+
+func (o kcpOptions) String() string {
+	return fmt.Sprintf("nodelay=%d interval=%dms resend=%d nc=%d sndwnd=%d rcvwnd=%d mtu=%d fec=%d,%d",
+		o.NoDelay, o.Interval, o.Resend, o.NC, o.SndWnd, o.RcvWnd, o.MTU, o.DataShard, o.ParityShard)
+}
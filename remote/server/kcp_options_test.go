@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+
+	"liuproxy_remote/remote/types"
+)
+
+func TestNewKCPOptions(t *testing.T) {
+	defaults := func(p kcpProfile) kcpOptions {
+		return kcpOptions{
+			kcpProfile:   p,
+			SndWnd:       defaultKCPSndWnd,
+			RcvWnd:       defaultKCPRcvWnd,
+			MTU:          defaultKCPMTU,
+			DataShard:    defaultKCPDataShard,
+			ParityShard:  defaultKCPParityShard,
+			SocketBuffer: kcpSocketBuffer,
+		}
+	}
+	with := func(o kcpOptions, f func(*kcpOptions)) kcpOptions {
+		f(&o)
+		return o
+	}
+
+	cases := []struct {
+		name string
+		conf types.RemoteConf
+		want kcpOptions
+	}{
+		{"default profile", types.RemoteConf{}, defaults(kcpProfiles["fast"])},
+		{"normal", types.RemoteConf{KcpProfile: "normal"}, defaults(kcpProfiles["normal"])},
+		{"fast2", types.RemoteConf{KcpProfile: "fast2"}, defaults(kcpProfiles["fast2"])},
+		{"profile name is case-insensitive", types.RemoteConf{KcpProfile: " Fast3 "}, defaults(kcpProfiles["fast3"])},
+		{"profile overrides", types.RemoteConf{KcpProfile: "normal", KcpNoDelay: "1", KcpInterval: " 15 ", KcpResend: "0", KcpNC: "0"},
+			defaults(kcpProfile{NoDelay: 1, Interval: 15, Resend: 0, NC: 0})},
+		{"windows and mtu", types.RemoteConf{KcpSndWnd: 256, KcpRcvWnd: 512, KcpMTU: 1200},
+			with(defaults(kcpProfiles["fast"]), func(o *kcpOptions) { o.SndWnd, o.RcvWnd, o.MTU = 256, 512, 1200 })},
+		{"fec", types.RemoteConf{KcpFEC: "4, 2"},
+			with(defaults(kcpProfiles["fast"]), func(o *kcpOptions) { o.DataShard, o.ParityShard = 4, 2 })},
+		{"fec off", types.RemoteConf{KcpFEC: "0,0"},
+			with(defaults(kcpProfiles["fast"]), func(o *kcpOptions) { o.DataShard, o.ParityShard = 0, 0 })},
+	}
+	for _, c := range cases {
+		got, err := newKCPOptions(&c.conf)
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %+v, %v; want %+v", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestNewKCPOptions_Invalid(t *testing.T) {
+	cases := []struct {
+		name string
+		conf types.RemoteConf
+	}{
+		{"unknown profile", types.RemoteConf{KcpProfile: "turbo"}},
+		{"non-numeric override", types.RemoteConf{KcpResend: "two"}},
+		{"negative override", types.RemoteConf{KcpNC: "-1"}},
+		{"interval too small", types.RemoteConf{KcpInterval: "5"}},
+		{"interval too large", types.RemoteConf{KcpInterval: "5001"}},
+		{"mtu too small", types.RemoteConf{KcpMTU: 500}},
+		{"mtu too large", types.RemoteConf{KcpMTU: 9000}},
+		{"fec without parity", types.RemoteConf{KcpFEC: "10"}},
+		{"fec not numeric", types.RemoteConf{KcpFEC: "a,b"}},
+		{"fec negative", types.RemoteConf{KcpFEC: "-1,3"}},
+		{"fec half off", types.RemoteConf{KcpFEC: "10,0"}},
+	}
+	for _, c := range cases {
+		if got, err := newKCPOptions(&c.conf); err == nil {
+			t.Errorf("%s: got %+v, want an error", c.name, got)
+		}
+	}
+}
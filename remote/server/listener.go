@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"liuproxy_remote/remote/tunnel"
+	"liuproxy_remote/remote/types"
+)
+
+// defaultSocks5Bind 是未配置 socks5_bind 时内置 SOCKS5 代理的监听地址
+const defaultSocks5Bind = "127.0.0.1"
+
+// remoteListener 是一个监听端口 (可以绑定多个地址) 及其入站配置
+type remoteListener struct {
+	name  string
+	binds []bindAddr
+	port  int
+	// socket 是 Unix 套接字地址使用的文件权限和属主
+	socket unixSocketOptions
+	// inbound 是该监听器的入站配置: 用户表只包含允许的用户，Modes 是允许的入站模式
+	inbound *tunnel.Inbound
+	// tlsConfig 不为 nil 时，每个连接在分发前先完成 TLS 握手
+	tlsConfig *tls.Config
+	// clientAuth 不为 nil 时，每个 TLS 连接都必须先通过客户端证书验证
+	clientAuth *clientVerifier
+	// kcpPort 不为 0 时，在监听器的每个 IP 地址上同时运行 KCP 监听器，参数为 kcpOpts
+	kcpPort int
+	kcpOpts kcpOptions
+	// udpPort 不为 0 时，开启 QUIC 的监听器在这个端口上接受旧格式的 UDP 请求
+	udpPort int
+}
+
+// listenerConfs 返回要启动的监听器: [listener.NAME] 节，
+// 或者没有这些节时由 port_ws_svr、bind 和 [remote] 的 TLS 设置定义的默认监听器，
+// 以及设置了 socks5_port 时监听 socks5_bind 的 SOCKS5 监听器
+func listenerConfs(cfg *types.Config) []types.ListenerConf {
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	rc := cfg.RemoteConf
+	confs := []types.ListenerConf{{
+		Name:           "default",
+		Bind:           rc.Bind,
+		Port:           rc.PortWsSvr,
+		SocketMode:     rc.SocketMode,
+		SocketOwner:    rc.SocketOwner,
+		TLSCert:        rc.TLSCert,
+		TLSKey:         rc.TLSKey,
+		TLSClientCA:    rc.TLSClientCA,
+		TLSClientAllow: rc.TLSClientAllow,
+		KcpPort:        rc.KcpPort,
+		UdpPort:        rc.UdpPort,
+	}}
+	if rc.Socks5Port > 0 {
+		// SOCKS5 不加密，不沿用对外开放的 bind，未设置 socks5_bind 时由 newRemoteListener 改为只监听回环地址
+		confs = append(confs, types.ListenerConf{
+			Name:  "socks5",
+			Bind:  rc.Socks5Bind,
+			Port:  rc.Socks5Port,
+			Modes: "socks5",
+		})
+	}
+	return confs
+}
+
+// checkRemoteListenerOptions 确认配置了 [listener.*] 节时，[remote] 中没有只属于默认监听器的设置:
+// 这些设置会被忽略，kcp_port 还会让 KCP 绕过各监听器的用户和模式限制
+func checkRemoteListenerOptions(cfg *types.Config) error {
+	if len(cfg.Listeners) == 0 {
+		return nil
+	}
+	rc := cfg.RemoteConf
+	switch {
+	case rc.KcpPort > 0:
+		return errors.New("kcp_port in [remote] is not used with [listener.*] sections; set kcp_port in a listener section instead")
+	case rc.UdpPort > 0:
+		return errors.New("udp_port in [remote] is not used with [listener.*] sections; set udp_port in a listener section instead")
+	case rc.Socks5Port > 0 || rc.Socks5Bind != "":
+		return errors.New("socks5_port and socks5_bind in [remote] are not used with [listener.*] sections; add a listener with modes = socks5 instead")
+	}
+	return nil
+}
+
+// newRemoteListener 根据 conf 创建监听器。base 是所有监听器共享的入站配置 (用户表、防重放缓存、访问控制)，
+// 监听器在它的基础上限制用户和入站模式。
+func newRemoteListener(cfg *types.Config, conf types.ListenerConf, base *tunnel.Inbound) (*remoteListener, error) {
+	binds, err := parseBindAddrs(conf.Bind)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range binds {
+		if !b.isUnix() && conf.Port <= 0 {
+			if len(cfg.Listeners) == 0 {
+				return nil, errors.New("remote port (port_ws_svr) is not configured")
+			}
+			return nil, errors.New("port is required unless every bind address is a unix socket")
+		}
+	}
+	socket, err := parseUnixSocketOptions(conf.SocketMode, conf.SocketOwner)
+	if err != nil {
+		return nil, err
+	}
+	modes, err := tunnel.ParseModes(conf.Modes)
+	if err != nil {
+		return nil, err
+	}
+	// SOCKS5 不加密，没有写出 bind 时不监听所有地址: 只提供 SOCKS5 的监听器默认只监听回环地址，
+	// 与其他模式共用的监听器必须显式写出 bind
+	if modes.Has(tunnel.ModeSOCKS5) && len(binds) == 1 && binds[0] == (bindAddr{}) {
+		if modes != tunnel.ModeSOCKS5 {
+			return nil, errors.New("a listener with the socks5 mode and other modes requires an explicit bind")
+		}
+		binds = []bindAddr{{host: defaultSocks5Bind, family: "4"}}
+	}
+	// Multi-Conn 连接以元数据长度开头，可能与 SOCKS5 问候的第一个字节 (0x05) 相同
+	if modes.Has(tunnel.ModeSOCKS5) && modes.Has(tunnel.ModeMultiConn) {
+		return nil, errors.New("modes socks5 and multi-conn cannot share a listener")
+	}
+	var kcpOpts kcpOptions
+	if conf.KcpPort > 0 {
+		// KCP 连接上运行的是 Mux 会话，只能按 mux 模式接入
+		if !modes.Has(tunnel.ModeMux) {
+			return nil, errors.New("kcp_port requires the mux mode")
+		}
+		if kcpOpts, err = newKCPOptions(&cfg.RemoteConf); err != nil {
+			return nil, fmt.Errorf("KCP: %w", err)
+		}
+	}
+	users, err := base.Users.Subset(splitList(conf.Users))
+	if err != nil {
+		return nil, err
+	}
+	if users, err = users.WithSuite(conf.Suite); err != nil {
+		return nil, err
+	}
+
+	// 监听器只覆盖证书相关的设置，grpc_service、tls_client_fallback 等沿用 [remote]。
+	// 回落只对要求客户端证书的监听器有意义，其余监听器忽略 tls_client_fallback
+	tlsConf := cfg.RemoteConf
+	tlsConf.TLSCert = conf.TLSCert
+	tlsConf.TLSKey = conf.TLSKey
+	tlsConf.TLSClientCA = conf.TLSClientCA
+	tlsConf.TLSClientAllow = conf.TLSClientAllow
+	if len(cfg.Listeners) > 0 && conf.TLSClientCA == "" {
+		tlsConf.TLSClientFallback = false
+	}
+	tlsConfig, clientAuth, err := newTLSConfig(&tlsConf)
+	if err != nil {
+		return nil, fmt.Errorf("TLS: %w", err)
+	}
+	if cfg.RemoteConf.Quic && modes.Has(tunnel.ModeUDP) && tlsConfig == nil {
+		return nil, errors.New("QUIC (quic = true) requires tls_cert and tls_key on listeners with the udp mode")
+	}
+	// QUIC 占用监听端口的 UDP，旧格式的 UDP 请求只能使用另一个端口
+	if conf.UdpPort > 0 {
+		if !cfg.RemoteConf.Quic || !modes.Has(tunnel.ModeUDP) {
+			return nil, errors.New("udp_port requires quic = true and the udp mode")
+		}
+		if conf.UdpPort == conf.Port || conf.UdpPort == conf.KcpPort {
+			return nil, errors.New("udp_port must differ from port (used by QUIC) and kcp_port")
+		}
+	}
+
+	in := new(tunnel.Inbound)
+	*in = *base
+	in.Users = users
+	in.Modes = modes
+	if modes.Has(tunnel.ModeWS) {
+		if in.HTTP, err = tunnel.NewHTTPHandler(in); err != nil {
+			return nil, fmt.Errorf("HTTP routing: %w", err)
+		}
+	}
+	return &remoteListener{
+		name:       conf.Name,
+		binds:      binds,
+		port:       conf.Port,
+		socket:     socket,
+		inbound:    in,
+		tlsConfig:  tlsConfig,
+		clientAuth: clientAuth,
+		kcpPort:    conf.KcpPort,
+		kcpOpts:    kcpOpts,
+		udpPort:    conf.UdpPort,
+	}, nil
+}
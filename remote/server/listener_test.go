@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/certs"
+	"liuproxy_remote/remote/clientip"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/tunnel"
+	"liuproxy_remote/remote/types"
+)
+
+// testBaseInbound 返回有用户 alice 和 bob 的共享入站配置，回落地址为 fallback
+func testBaseInbound(t *testing.T, fallback string) *tunnel.Inbound {
+	t.Helper()
+	cfg := &types.Config{}
+	cfg.BufferSize = 4096
+	cfg.RemoteConf.Fallback = fallback
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}},
+		{Name: "bob", Keys: []types.KeyConf{{Generation: 1, Secret: "pw2"}}},
+	}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	policy, err := clientip.NewPolicy(&cfg.RemoteConf)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	return &tunnel.Inbound{Cfg: cfg, Users: users, Replay: auth.NewReplayCache(time.Minute, 16), ClientIP: policy}
+}
+
+// serveTestListener 在 127.0.0.1 上接受连接并交给 dispatchTCPConnection
+func serveTestListener(t *testing.T, base *tunnel.Inbound, conf types.ListenerConf) string {
+	t.Helper()
+	l, err := newRemoteListener(base.Cfg, conf, base)
+	if err != nil {
+		t.Fatalf("newRemoteListener: %v", err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	s := &AppServer{cfg: base.Cfg, inbound: base}
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go s.dispatchTCPConnection(l, conn)
+		}
+	}()
+	return tcp.Addr().String()
+}
+
+// fallbackRecorder 启动一个回落地址，收到的每个连接的前几个字节写入返回的通道，然后回复 "fallback"
+func fallbackRecorder(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 8)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 512)
+			c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _ := io.ReadAtLeast(c, buf, 1)
+			received <- buf[:n]
+			c.Write([]byte("fallback"))
+			c.Close()
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+// sealedFrame 返回 "长度(2字节) | 密文" 形式的帧
+func sealedFrame(t *testing.T, c securecrypt.Cipher, payload []byte) []byte {
+	t.Helper()
+	sealed, err := c.Encrypt(payload)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(sealed))), sealed...)
+}
+
+// streamMetadata 构造一个目标为 127.0.0.1:port 的旧格式元数据
+func streamMetadata(streamType tunnel.StreamType, port int) []byte {
+	meta := []byte{byte(streamType), tunnel.AddrTypeIPv4, 127, 0, 0, 1}
+	return binary.BigEndian.AppendUint16(meta, uint16(port))
+}
+
+func TestDispatchTCPConnection_ModeGating(t *testing.T) {
+	fallback, received := fallbackRecorder(t)
+	base := testBaseInbound(t, fallback)
+	alice, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	bob, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("bob", "pw2"))
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	smuxSYN := []byte{2, 0, 0, 0, 3, 0, 0, 0, 2, 2, 4, 0, 3, 0, 0, 0, 0, 2, 'h', 'i'}
+	httpGet := []byte("GET / HTTP/1.1\r\nHost: example\r\n\r\n")
+	tcpStream := sealedFrame(t, alice, streamMetadata(tunnel.StreamTCP, echoPort))
+	udpStream := sealedFrame(t, alice, streamMetadata(tunnel.StreamUDP, 0))
+	bobStream := sealedFrame(t, bob, streamMetadata(tunnel.StreamTCP, echoPort))
+
+	cases := []struct {
+		name     string
+		conf     types.ListenerConf
+		probe    []byte
+		fallback bool
+	}{
+		{"mux on a ws listener", types.ListenerConf{Modes: "ws"}, smuxSYN, true},
+		{"http on a mux listener", types.ListenerConf{Modes: "mux"}, httpGet, true},
+		{"http on a ws listener", types.ListenerConf{Modes: "ws"}, httpGet, false},
+		{"multi-conn on a mux listener", types.ListenerConf{Modes: "mux"}, tcpStream, true},
+		{"multi-conn on a multi-conn listener", types.ListenerConf{Modes: "multi-conn"}, tcpStream, false},
+		{"udp stream without the udp mode", types.ListenerConf{Modes: "multi-conn"}, udpStream, true},
+		{"udp stream with the udp mode", types.ListenerConf{Modes: "multi-conn,udp"}, udpStream, false},
+		{"user outside the listener's subset", types.ListenerConf{Modes: "multi-conn", Users: "alice"}, bobStream, true},
+	}
+	for _, c := range cases {
+		c.conf.Name, c.conf.Port = c.name, 1 // 端口只用于通过配置检查
+		addr := serveTestListener(t, base, c.conf)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: Dial: %v", c.name, err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(c.probe)
+		reply := make([]byte, len("fallback"))
+		_, err = io.ReadFull(conn, reply)
+		conn.Close()
+
+		gotFallback := err == nil && string(reply) == "fallback"
+		if gotFallback != c.fallback {
+			t.Errorf("%s: reply %q, %v; want fallback=%v", c.name, reply, err, c.fallback)
+		}
+		if gotFallback {
+			if got := <-received; !bytes.Equal(got, c.probe) {
+				t.Errorf("%s: fallback received %x, want the probe %x", c.name, got, c.probe)
+			}
+		}
+	}
+}
+
+func TestNewRemoteListener_KCP(t *testing.T) {
+	base := testBaseInbound(t, "")
+	cases := []struct {
+		name string
+		conf types.ListenerConf
+		ok   bool
+	}{
+		{"mux listener", types.ListenerConf{Port: 7000, Modes: "mux", KcpPort: 29900}, true},
+		{"all modes", types.ListenerConf{Port: 7000, KcpPort: 29900}, true},
+		{"without mux", types.ListenerConf{Port: 7000, Modes: "ws,udp", KcpPort: 29900}, false},
+	}
+	for _, c := range cases {
+		l, err := newRemoteListener(base.Cfg, c.conf, base)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err = %v, want ok=%v", c.name, err, c.ok)
+			continue
+		}
+		if err == nil && (l.kcpPort != c.conf.KcpPort || l.kcpOpts.MTU != defaultKCPMTU) {
+			t.Errorf("%s: kcp port %d, options %s", c.name, l.kcpPort, l.kcpOpts)
+		}
+	}
+}
+
+func TestNewRemoteListener_LegacyUDPPort(t *testing.T) {
+	base := testBaseInbound(t, "")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := certs.GenerateSelfSigned([]string{"localhost"}, time.Hour, certFile, keyFile); err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	cases := []struct {
+		name string
+		quic bool
+		conf types.ListenerConf
+		ok   bool
+	}{
+		{"quic listener", true, types.ListenerConf{Port: 443, UdpPort: 7001}, true},
+		{"without quic", false, types.ListenerConf{Port: 443, UdpPort: 7001}, false},
+		{"without the udp mode", true, types.ListenerConf{Port: 443, Modes: "ws,mux", UdpPort: 7001}, false},
+		{"same as port", true, types.ListenerConf{Port: 443, UdpPort: 443}, false},
+		{"same as kcp_port", true, types.ListenerConf{Port: 443, KcpPort: 7001, UdpPort: 7001}, false},
+	}
+	for _, c := range cases {
+		cfg := *base.Cfg
+		cfg.RemoteConf.Quic = c.quic
+		c.conf.TLSCert, c.conf.TLSKey = certFile, keyFile
+		l, err := newRemoteListener(&cfg, c.conf, base)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err = %v, want ok=%v", c.name, err, c.ok)
+			continue
+		}
+		if err == nil && l.udpPort != c.conf.UdpPort {
+			t.Errorf("%s: udp port %d, want %d", c.name, l.udpPort, c.conf.UdpPort)
+		}
+	}
+}
+
+func TestNewRemoteListener_Socks5Bind(t *testing.T) {
+	base := testBaseInbound(t, "")
+	loopback := []bindAddr{{host: "127.0.0.1", family: "4"}}
+	cases := []struct {
+		name      string
+		listeners bool
+		conf      types.ListenerConf
+		want      []bindAddr // nil 表示配置无效
+	}{
+		{"[remote] defaults to loopback", false, listenerConfs(&types.Config{RemoteConf: types.RemoteConf{Bind: "0.0.0.0", PortWsSvr: 8080, Socks5Port: 1080}})[1], loopback},
+		{"[remote] explicit bind", false, listenerConfs(&types.Config{RemoteConf: types.RemoteConf{Bind: "0.0.0.0", PortWsSvr: 8080, Socks5Port: 1080, Socks5Bind: "10.0.0.5"}})[1], []bindAddr{{host: "10.0.0.5", family: "4"}}},
+		{"socks5 listener defaults to loopback", true, types.ListenerConf{Port: 1080, Modes: "socks5"}, loopback},
+		{"socks5 listener explicit bind", true, types.ListenerConf{Bind: "0.0.0.0", Port: 1080, Modes: "socks5"}, []bindAddr{{host: "0.0.0.0", family: "4"}}},
+		{"socks5 shared without bind", true, types.ListenerConf{Port: 1080, Modes: "ws, socks5"}, nil},
+		{"socks5 shared with bind", true, types.ListenerConf{Bind: "10.0.0.5", Port: 1080, Modes: "ws, socks5"}, []bindAddr{{host: "10.0.0.5", family: "4"}}},
+		{"tunnel listener without bind", true, types.ListenerConf{Port: 443, Modes: "ws"}, []bindAddr{{}}},
+	}
+	for _, c := range cases {
+		cfg := *base.Cfg
+		if c.listeners {
+			cfg.Listeners = []types.ListenerConf{c.conf}
+		}
+		l, err := newRemoteListener(&cfg, c.conf, base)
+		if (err == nil) != (c.want != nil) {
+			t.Errorf("%s: err = %v, want ok=%v", c.name, err, c.want != nil)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(l.binds, c.want) {
+			t.Errorf("%s: binds %+v, want %+v", c.name, l.binds, c.want)
+		}
+	}
+}
+
+func TestCheckRemoteListenerOptions(t *testing.T) {
+	listeners := []types.ListenerConf{{Name: "public", Port: 443}}
+	cases := []struct {
+		name string
+		cfg  types.Config
+		ok   bool
+	}{
+		{"default listener", types.Config{RemoteConf: types.RemoteConf{KcpPort: 29900, UdpPort: 7001, Socks5Port: 1080, Socks5Bind: "10.0.0.5"}}, true},
+		{"listeners only", types.Config{Listeners: listeners}, true},
+		{"kcp_port", types.Config{Listeners: listeners, RemoteConf: types.RemoteConf{KcpPort: 29900}}, false},
+		{"udp_port", types.Config{Listeners: listeners, RemoteConf: types.RemoteConf{UdpPort: 7001}}, false},
+		{"socks5_port", types.Config{Listeners: listeners, RemoteConf: types.RemoteConf{Socks5Port: 1080}}, false},
+		{"socks5_bind", types.Config{Listeners: listeners, RemoteConf: types.RemoteConf{Socks5Bind: "10.0.0.5"}}, false},
+	}
+	for _, c := range cases {
+		if err := checkRemoteListenerOptions(&c.cfg); (err == nil) != c.ok {
+			t.Errorf("%s: err = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+// paddedMetadata 构造一个目标为 127.0.0.1:port、密文恰好为 sealedLen 字节的带填充元数据帧
+func paddedMetadata(t *testing.T, c securecrypt.Cipher, port, sealedLen int) []byte {
+	t.Helper()
+	meta := []byte{1<<4 | byte(tunnel.StreamTCP), tunnel.MetaFlagPadding, tunnel.AddrTypeIPv4, 127, 0, 0, 1}
+	meta = binary.BigEndian.AppendUint16(meta, uint16(port))
+	meta = append(meta, make([]byte, sealedLen-len(meta)-40)...) // XChaCha20-Poly1305: nonce(24) + 标签(16)
+	frame := sealedFrame(t, c, meta)
+	if got := int(binary.BigEndian.Uint16(frame)); got != sealedLen {
+		t.Fatalf("metadata is %d bytes, want %d", got, sealedLen)
+	}
+	return frame
+}
+
+func TestIsMuxConnection(t *testing.T) {
+	alice, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	cases := []struct {
+		name   string
+		prefix []byte
+		mux    bool
+	}{
+		{"smux SYN then PSH", []byte{2, 0, 0, 0, 3, 0, 0, 0, 2, 2, 4, 0, 3, 0, 0, 0}, true},
+		{"two SYNs", []byte{1, 0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 5, 0, 0, 0}, true},
+		{"SYN alone", []byte{2, 0, 0, 0, 3, 0, 0, 0}, true},
+		{"SYN with a body", []byte{2, 0, 9, 0, 3, 0, 0, 0, 2, 2, 4, 0, 3, 0, 0, 0}, false},
+		{"even stream ID", []byte{2, 0, 0, 0, 2, 0, 0, 0, 2, 2, 4, 0, 2, 0, 0, 0}, false},
+		{"version 4", []byte{4, 0, 0, 0, 3, 0, 0, 0, 4, 2, 4, 0, 3, 0, 0, 0}, false},
+	}
+	for _, c := range cases {
+		// 末尾不足的字节不会再到达，Peek 立即返回
+		if got := isMuxConnection(bufio.NewReader(bytes.NewReader(c.prefix))); got != c.mux {
+			t.Errorf("%s: isMuxConnection = %v, want %v", c.name, got, c.mux)
+		}
+	}
+
+	// 长度为 256、512、768 的 Multi-Conn 元数据前两个字节与 SYN 帧头相同，但不能被当作 Mux 会话
+	for _, n := range []int{256, 512, 768} {
+		for range 1000 {
+			frame := paddedMetadata(t, alice, 9, n)
+			if isMuxConnection(bufio.NewReader(bytes.NewReader(frame))) {
+				t.Fatalf("Multi-Conn metadata of %d bytes (%x) detected as mux", n, frame[:16])
+			}
+		}
+	}
+}
+
+func TestDispatchTCPConnection_MultiConnMetadataLengths(t *testing.T) {
+	base := testBaseInbound(t, "")
+	alice, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	addr := serveTestListener(t, base, types.ListenerConf{Name: "default", Port: 1})
+
+	// padding_first = 200-800 时客户端的元数据可能恰好是这些长度
+	for _, n := range []int{255, 256, 512, 768} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(paddedMetadata(t, alice, echo.Addr().(*net.TCPAddr).Port, n))
+		conn.Write(sealedFrame(t, alice, []byte("\x00\x05hello"))) // 带填充的帧: payloadLen(2) | payload
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			t.Fatalf("%d-byte metadata: read reply: %v", n, err)
+		}
+		sealed := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		io.ReadFull(conn, sealed)
+		if got, err := alice.Decrypt(sealed); err != nil || len(got) < 7 || string(got[2:7]) != "hello" {
+			t.Fatalf("%d-byte metadata: echo = %q, %v", n, got, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"liuproxy_remote/remote/tunnel"
+)
+
+const (
+	// quicIdleTimeout 是 QUIC 连接没有任何活动时被关闭的时间
+	quicIdleTimeout = 60 * time.Second
+	// quicKeepAlivePeriod 是 QUIC 保活包的发送间隔，使 NAT 映射保持有效
+	quicKeepAlivePeriod = 15 * time.Second
+)
+
+// serveQUIC 在 UDP 监听端口上运行 QUIC 监听器，直到监听器关闭。
+// QUIC 复用监听器的 TLS 证书 (要求 TLS 1.3)，通过 ALPN "liuproxy" 区分；
+// UDP 中继通过 QUIC 数据报进行，由 udpHandler 处理；同一端口上的非 QUIC 包被丢弃。
+func (s *AppServer) serveQUIC(l *remoteListener, udpListener *net.UDPConn, udpHandler *tunnel.UDPHandler) {
+	tlsConfig := l.tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{tunnel.QUICALPN}
+
+	transport := &quic.Transport{Conn: udpListener}
+	listener, err := transport.Listen(tlsConfig, &quic.Config{
+		EnableDatagrams: true,
+		MaxIdleTimeout:  quicIdleTimeout,
+		KeepAlivePeriod: quicKeepAlivePeriod,
+	})
+	if err != nil {
+		log.Fatalf("Failed to start QUIC listener: %v", err)
+	}
+	defer listener.Close()
+	log.Printf(">>> SUCCESS: GoRemote v3 (QUIC) server listening on %s", udpListener.LocalAddr())
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Printf("[REMOTE-QUIC] QUIC listener stopped: %v", err)
+			return
+		}
+		s.waitGroup.Add(1)
+		go func() {
+			defer s.waitGroup.Done()
+			s.dispatchQUICConnection(l, conn, udpHandler)
+		}()
+	}
+}
+
+// dispatchQUICConnection 验证客户端证书 (mTLS)，然后交给 QUIC 处理器
+func (s *AppServer) dispatchQUICConnection(l *remoteListener, conn *quic.Conn, udpHandler *tunnel.UDPHandler) {
+	var peer net.Addr = conn.RemoteAddr()
+	if l.clientAuth != nil {
+		identity, err := l.clientAuth.verifyState(conn.ConnectionState().TLS)
+		if err != nil {
+			log.Printf("[REMOTE-QUIC] Rejected QUIC client %s: %v", peer, err)
+			conn.CloseWithError(tunnel.QUICCodeRefused, "refused")
+			return
+		}
+		peer = &tunnel.PeerAddr{Addr: peer, Identity: identity}
+	}
+	tunnel.HandleQUICConnection(conn, peer, l.inbound, udpHandler)
+}
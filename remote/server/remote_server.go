@@ -2,58 +2,196 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/clientip"
+	"liuproxy_remote/remote/stats"
 	"liuproxy_remote/remote/tunnel"
 	"log"
 	"net"
+	"strconv"
 	"time"
 )
 
+const (
+	// defaultReplayWindow 是未配置 replay_window 时的防重放时间窗口
+	defaultReplayWindow = 120 * time.Second
+	// replayCacheMaxEntries 限制每个用户在时间窗口内最多记录的流元数据和握手 ID 数，达到上限时拒绝该用户的新请求
+	replayCacheMaxEntries = 1 << 16
+	// datagramReplayMaxEntries 是每个用户的 UDP 数据报 ID 配额，与连接的配额分开计算
+	datagramReplayMaxEntries = 1 << 18
+)
+
 // runRemote 负责初始化和运行 remote 模式的所有服务
 func (s *AppServer) runRemote() {
 	log.Println("Initializing remote listeners...")
 
-	// 1. 确定监听端口
-	listenPort := s.cfg.RemoteConf.PortWsSvr
-	if listenPort <= 0 {
-		log.Fatalln("Remote port (port_ws_svr) is not configured.")
-		return
+	// 1. 确定要启动的监听器 (默认只有一个，由 port_ws_svr 定义)
+	confs := listenerConfs(s.cfg)
+	if err := checkRemoteListenerOptions(s.cfg); err != nil {
+		log.Fatalln(err)
 	}
-	addr := fmt.Sprintf("0.0.0.0:%d", listenPort)
 
-	// 2. 启动 TCP 监听器
-	tcpListener, err := net.Listen("tcp", addr)
+	clientIP, err := clientip.NewPolicy(&s.cfg.RemoteConf)
 	if err != nil {
-		log.Fatalf("Failed to listen on TCP port %s: %v", addr, err)
+		log.Fatalf("Failed to set up client IP handling: %v", err)
 	}
-	defer tcpListener.Close()
-	log.Printf(">>> SUCCESS: GoRemote v3 (TCP) server listening on %s", addr)
 
-	// --- 新增: UDP 监听 ---
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	// 加载用户表，所有监听器共享，每个监听器可以只接受其中的一部分用户
+	users, err := auth.NewRegistry(s.cfg)
 	if err != nil {
-		log.Fatalf("Failed to resolve UDP address %s: %v", addr, err)
+		log.Fatalf("Failed to load users: %v", err)
 	}
-	udpListener, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		log.Fatalf("Failed to listen on UDP port %s: %v", addr, err)
+	replayWindow := time.Duration(s.cfg.RemoteConf.ReplayWindow) * time.Second
+	if replayWindow <= 0 {
+		replayWindow = defaultReplayWindow
+	}
+	s.inbound = &tunnel.Inbound{
+		Cfg:            s.cfg,
+		Users:          users,
+		Replay:         auth.NewReplayCache(replayWindow, replayCacheMaxEntries),
+		DatagramReplay: auth.NewReplayCache(replayWindow, datagramReplayMaxEntries),
+		// 真实客户端地址和 IP 访问控制
+		ClientIP: clientIP,
 	}
-	defer udpListener.Close()
-	log.Printf(">>> SUCCESS: GoRemote v3 (UDP) server listening on %s", addr)
+	go stats.Report(time.Duration(s.cfg.RemoteConf.StatsInterval) * time.Second)
 
-	logLocalIPs(listenPort)
+	// 2. 创建每个监听器，全部有效后再启动
+	listeners := make([]*remoteListener, 0, len(confs))
+	unixBound := false
+	for _, conf := range confs {
+		l, err := newRemoteListener(s.cfg, conf, s.inbound)
+		if err != nil {
+			log.Fatalf("Invalid listener '%s': %v", conf.Name, err)
+		}
+		listeners = append(listeners, l)
+		for _, b := range l.binds {
+			unixBound = unixBound || b.isUnix()
+		}
+	}
+	// 只监听 TCP 时 trust_unix_socket 不起作用，依赖它的 real_ip_headers 会被悄悄忽略
+	if s.cfg.RemoteConf.TrustUnixSocket && !unixBound {
+		log.Fatalln("trust_unix_socket is set, but no listener binds a unix socket.")
+	}
+	ports := make([]int, 0, len(listeners))
+	for _, l := range listeners {
+		s.startListener(l)
+		// 只有隧道端口需要写进客户端配置
+		if l.port > 0 && l.inbound.Modes&tunnel.AllModes != 0 {
+			ports = append(ports, l.port)
+		}
+	}
+	if len(ports) > 0 {
+		logLocalIPs(ports...)
+	}
+}
 
-	// --- 新增: 启动 UDP 包处理循环 ---
-	udpHandler := tunnel.NewUDPHandler(s.cfg, udpListener)
-	s.waitGroup.Add(1)
-	go func() {
-		defer s.waitGroup.Done()
-		udpHandler.Listen()
-	}()
+// startListener 在监听器的每个地址上打开 TCP 端口 (以及 udp 模式下的 UDP 端口)，并开始接受连接
+func (s *AppServer) startListener(l *remoteListener) {
+	in := l.inbound
+	for _, b := range l.binds {
+		addr := b.addr(l.port)
+		var tcpListener net.Listener
+		var err error
+		kind := "TCP"
+		if b.isUnix() {
+			// Unix 套接字上的连接与 TCP 连接一样经过 dispatchTCPConnection 分发
+			kind = "Unix"
+			tcpListener, err = listenUnix(addr, l.socket)
+		} else {
+			tcpListener, err = net.Listen(b.network("tcp"), addr)
+		}
+		if err != nil {
+			log.Fatalf("Failed to listen on %s socket %s: %v", kind, addr, err)
+		}
+		log.Printf(">>> SUCCESS: GoRemote v3 (%s) server listening on %s (listener '%s', modes %s)", kind, tcpListener.Addr(), l.name, in.Modes)
+		s.waitGroup.Add(1)
+		go func() {
+			defer s.waitGroup.Done()
+			s.acceptTCP(l, tcpListener)
+		}()
+
+		// UDP 端口只在 IP 地址上监听
+		if b.isUnix() || !in.Allows(tunnel.ModeUDP) {
+			continue
+		}
+		// --- 新增: UDP 监听 ---
+		udpAddr, err := net.ResolveUDPAddr(b.network("udp"), addr)
+		if err != nil {
+			log.Fatalf("Failed to resolve UDP address %s: %v", addr, err)
+		}
+		udpListener, err := net.ListenUDP(b.network("udp"), udpAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on UDP port %s: %v", addr, err)
+		}
+		log.Printf(">>> SUCCESS: GoRemote v3 (UDP) server listening on %s (listener '%s')", udpListener.LocalAddr(), l.name)
 
-	// 3. 接受连接并处理
+		// --- 新增: 启动 UDP 包处理循环 ---
+		s.waitGroup.Add(1)
+		if !s.cfg.RemoteConf.Quic {
+			udpHandler := tunnel.NewUDPHandler(in, udpListener)
+			go func() {
+				defer s.waitGroup.Done()
+				udpHandler.Listen()
+			}()
+			continue
+		}
+		// 开启 QUIC 时 UDP 端口由 QUIC 使用，UDP 请求通过 QUIC 数据报传输。
+		// QUIC 无法可靠地区分旧格式的 UDP 包，它们改由 udp_port 上的独立套接字接收
+		var legacyListener *net.UDPConn
+		if l.udpPort > 0 {
+			legacyAddr, err := net.ResolveUDPAddr(b.network("udp"), b.addr(l.udpPort))
+			if err != nil {
+				log.Fatalf("Failed to resolve UDP address %s: %v", b.addr(l.udpPort), err)
+			}
+			if legacyListener, err = net.ListenUDP(b.network("udp"), legacyAddr); err != nil {
+				log.Fatalf("Failed to listen on UDP port %s: %v", legacyAddr, err)
+			}
+			log.Printf(">>> SUCCESS: GoRemote v3 (legacy UDP) server listening on %s (listener '%s')", legacyListener.LocalAddr(), l.name)
+		}
+		udpHandler := tunnel.NewUDPHandler(in, legacyListener)
+		go func() {
+			defer s.waitGroup.Done()
+			s.serveQUIC(l, udpListener, udpHandler)
+		}()
+		if legacyListener != nil {
+			s.waitGroup.Add(1)
+			go func() {
+				defer s.waitGroup.Done()
+				udpHandler.Listen()
+			}()
+		}
+	}
+
+	// 可选: KCP 监听器 (独立的 UDP 端口，与 mux 模式一样受监听器的用户和模式限制)
+	if l.kcpPort > 0 {
+		for _, b := range ipBindAddrs(l.binds) {
+			kcpAddr := b.addr(l.kcpPort)
+			s.waitGroup.Add(1)
+			go func() {
+				defer s.waitGroup.Done()
+				s.serveKCP(kcpAddr, l.kcpOpts, in)
+			}()
+		}
+	}
+
+	// 可选: 由监听器自行终结 TLS，之后的分发逻辑作用于解密后的数据流。
+	// TLS 在每个连接的分发开始时进行，因为它之前可能还有 PROXY 协议头
+	if l.tlsConfig != nil {
+		log.Printf(">>> SUCCESS: TLS enabled on listener '%s'", l.name)
+	}
+	if in.ClientIP.ProxyProtocol() {
+		log.Printf(">>> SUCCESS: PROXY protocol v1/v2 headers accepted on listener '%s'", l.name)
+	}
+}
+
+// acceptTCP 接受 listener 上的连接并逐个分发
+func (s *AppServer) acceptTCP(l *remoteListener, listener net.Listener) {
+	defer listener.Close()
 	for {
-		conn, err := tcpListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			log.Printf("Failed to accept connection: %v", err)
 			continue
@@ -63,13 +201,14 @@ func (s *AppServer) runRemote() {
 			defer s.waitGroup.Done()
 			//tunnel.HandleTCPConnection(conn, s.cfg)
 			// 在这里进行模式判断
-			s.dispatchTCPConnection(conn)
+			s.dispatchTCPConnection(l, conn)
 		}()
 	}
 }
 
 // dispatchTCPConnection 根据第一个字节判断连接模式
-func (s *AppServer) dispatchTCPConnection(conn net.Conn) {
+func (s *AppServer) dispatchTCPConnection(l *remoteListener, conn net.Conn) {
+	in := l.inbound
 	defer func() {
 		if r := recover(); r != nil {
 			//log.Printf("[REMOTE-DISPATCH] Panic recovered: %v", r)
@@ -77,13 +216,48 @@ func (s *AppServer) dispatchTCPConnection(conn net.Conn) {
 		}
 	}()
 
+	// 负载均衡器发送的 PROXY 协议头给出真实的客户端地址，之后的日志和访问控制都使用它
+	if in.ClientIP.ProxyProtocol() {
+		proxied, err := in.ClientIP.ReadProxyHeader(conn)
+		if err != nil {
+			log.Printf("[REMOTE-DISPATCH] Invalid PROXY protocol header from %s: %v. Closing connection.", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+	if err := in.ClientIP.Check(conn.RemoteAddr()); err != nil {
+		log.Printf("[REMOTE-DISPATCH] Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+
+	// mTLS: 先验证客户端证书，证书身份随 RemoteAddr 传递给后续的处理器
+	if l.clientAuth != nil {
+		identity, err := l.clientAuth.verify(conn.(*tls.Conn))
+		if err != nil {
+			if !s.cfg.RemoteConf.TLSClientFallback {
+				log.Printf("[REMOTE-DISPATCH] Rejected TLS client %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			tunnel.HandleRejectedConnection(conn, bufio.NewReader(conn), in, err)
+			return
+		}
+		conn = tunnel.WithIdentity(conn, identity)
+	}
+
 	reader := bufio.NewReader(conn)
 
 	// 设置一个短暂的读取超时，以应对不发送任何数据的客户端
 	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
 
-	// 预读2个字节
+	// 预读2个字节，看起来像 smux 帧头时再预读完整的帧头 (见 isMuxConnection)
 	header, err := reader.Peek(2)
+	isMux := err == nil && isMuxConnection(reader)
 	// 判断后立即清除超时
 	conn.SetReadDeadline(time.Time{})
 
@@ -93,26 +267,87 @@ func (s *AppServer) dispatchTCPConnection(conn net.Conn) {
 		return
 	}
 
+	// 监听器未开启的模式按未通过认证处理 (配置了回落地址时转交过去)
+	mode := tunnel.ModeMultiConn
+	switch {
+	case in.Modes.Has(tunnel.ModeSOCKS5) && header[0] == 0x05:
+		mode = tunnel.ModeSOCKS5
+	case tunnel.IsHandshake(header):
+		mode = tunnel.ModeMux | tunnel.ModeMultiConn // 握手之后再检查
+	case tunnel.IsHTTPRequest(header):
+		mode = tunnel.ModeWS
+	case isMux:
+		mode = tunnel.ModeMux
+	}
+	if !in.Allows(mode) {
+		tunnel.HandleRejectedConnection(conn, reader, in, fmt.Errorf("mode %s is not enabled on listener '%s'", mode, l.name))
+		return
+	}
+
 	switch {
-	// 情况一: WebSocket 模式 (检查 "GE" from "GET /...")
-	case header[0] == 'G' && header[1] == 'E':
-		log.Printf("[REMOTE-DISPATCH] WebSocket mode detected from %s.", conn.RemoteAddr())
-		tunnel.HandleWebSocketConnection(conn, reader, s.cfg)
+	// 内置 SOCKS5 代理 (只在开启了 socks5 模式的监听器上识别)
+	case mode == tunnel.ModeSOCKS5:
+		tunnel.HandleSOCKS5Connection(conn, reader, in)
+
+	// 情况零: 会话握手 (前向安全)，握手之后才是 Multi-Conn 流或 Mux 会话
+	case tunnel.IsHandshake(header):
+		tunnel.HandleHandshakeConnection(conn, reader, in)
 
-	// 情况二: Mux 模式 (检查 smux v1 或 v2 或 v3 头部)
-	case (header[0] == 1 || header[0] == 2 || header[0] == 3) && header[1] == 0:
+	// 情况一: HTTP 请求 (GET、POST、HEAD 等)。WebSocket 隧道路径上的升级请求进入隧道，
+	// 其余请求由伪装站点处理
+	case tunnel.IsHTTPRequest(header):
+		//log.Printf("[REMOTE-DISPATCH] HTTP request detected from %s.", conn.RemoteAddr())
+		tunnel.HandleHTTPConnection(conn, reader, in)
+
+	// 情况二: Mux 模式
+	case isMux:
 		//log.Printf("[REMOTE-DISPATCH] MUX mode detected (version %d) from %s.", header[0], conn.RemoteAddr())
-		tunnel.HandleMuxSession(conn, reader, s.cfg)
+		tunnel.HandleMuxSession(conn, reader, in)
 
 	// 情况三: Multi-Conn 模式
 	default:
 		//log.Printf("[REMOTE-DISPATCH] Multi-Conn mode detected from %s.", conn.RemoteAddr())
-		tunnel.HandleTCPConnection(conn, reader, s.cfg)
+		tunnel.HandleTCPConnection(conn, reader, in)
 	}
 }
 
-// logLocalIPs finds and prints available non-loopback IPv4 addresses.
-func logLocalIPs(port int) {
+// smux 帧头: ver(1) | cmd(1) | length(2, 小端) | sid(4, 小端)
+const (
+	smuxHeaderSize = 8
+	smuxCmdSYN     = 0
+	smuxCmdPSH     = 2
+)
+
+// isMuxConnection 报告 reader 开头是否为 smux v1、v2 或 v3 会话。
+//
+// Multi-Conn 连接以 2 字节大端的元数据长度开头，长度为 256、512 或 768 时前两个字节与 smux 的 SYN 帧头
+// 一样是 [1-3] 0，只看这两个字节会把它们误判为 Mux 会话。因此继续检查完整的帧头:
+// smux 客户端的第一个帧一定是长度为 0、流 ID 为奇数的 SYN，紧随其后的是同一版本的 SYN 或 PSH 帧；
+// 而 Multi-Conn 连接在这些位置上是元数据密文开头的随机 nonce (或盐)，全部吻合的概率约为 2^-32。
+// Multi-Conn 客户端一次发出整个元数据 (至少 258 字节)，所以第二个帧头没有在读取超时前到达时按 SYN 判断。
+func isMuxConnection(reader *bufio.Reader) bool {
+	header, _ := reader.Peek(2)
+	if len(header) < 2 || header[0] < 1 || header[0] > 3 || header[1] != smuxCmdSYN {
+		return false
+	}
+	header, _ = reader.Peek(2 * smuxHeaderSize)
+	if len(header) < smuxHeaderSize || !isSmuxSYN(header) {
+		return false
+	}
+	if len(header) < 2*smuxHeaderSize {
+		return true
+	}
+	next := header[smuxHeaderSize:]
+	return next[0] == header[0] && (next[1] == smuxCmdSYN || next[1] == smuxCmdPSH) && binary.LittleEndian.Uint32(next[4:8])%2 == 1
+}
+
+// isSmuxSYN 报告 header 是否为客户端打开流的 SYN 帧头: 长度为 0，流 ID 为奇数
+func isSmuxSYN(header []byte) bool {
+	return header[1] == smuxCmdSYN && binary.LittleEndian.Uint16(header[2:4]) == 0 && binary.LittleEndian.Uint32(header[4:8])%2 == 1
+}
+
+// logLocalIPs finds and prints available non-loopback IPv4 and global IPv6 addresses for each port.
+func logLocalIPs(ports ...int) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		log.Printf("Could not get network interfaces: %v", err)
@@ -133,12 +368,15 @@ func logLocalIPs(port int) {
 			case *net.IPAddr:
 				ip = v.IP
 			}
-			if ip == nil || ip.IsLoopback() {
+			// 链路本地的 IPv6 地址需要附带网卡名，不适合写进客户端配置
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
 				continue
 			}
-			ip = ip.To4()
-			if ip != nil {
-				log.Printf("  -> %s:%d", ip.String(), port)
+			if ipv4 := ip.To4(); ipv4 != nil {
+				ip = ipv4
+			}
+			for _, port := range ports {
+				log.Printf("  -> %s", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
 			}
 		}
 	}
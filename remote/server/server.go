@@ -1,6 +1,7 @@
 package server
 
 import (
+	"liuproxy_remote/remote/tunnel"
 	"liuproxy_remote/remote/types"
 	"log"
 	"sync"
@@ -8,7 +9,9 @@ import (
 
 // AppServer 是应用的主结构体，持有配置和核心组件
 type AppServer struct {
-	cfg       *types.Config
+	cfg *types.Config
+	// inbound 是所有监听器共享的入站配置，每个监听器在它的基础上限制用户和入站模式
+	inbound   *tunnel.Inbound
 	waitGroup sync.WaitGroup
 }
 
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/certs"
+	"liuproxy_remote/remote/types"
+)
+
+const (
+	// certReloadInterval 是检查证书文件是否变化的间隔
+	certReloadInterval = 30 * time.Second
+	// clientHandshakeTimeout 限制验证客户端证书前完成 TLS 握手的时间
+	clientHandshakeTimeout = 10 * time.Second
+)
+
+// newTLSConfig 根据 tls_cert / tls_key 创建监听器的 TLS 配置，并启动证书热加载。
+// 配置了 tls_client_ca 时还返回客户端证书验证器。未配置证书时返回 nil。
+func newTLSConfig(conf *types.RemoteConf) (*tls.Config, *clientVerifier, error) {
+	if conf.TLSCert == "" && conf.TLSKey == "" {
+		if conf.TLSClientCA != "" {
+			return nil, nil, fmt.Errorf("tls_client_ca requires tls_cert and tls_key")
+		}
+		return nil, nil, nil
+	}
+	certFiles := splitList(conf.TLSCert)
+	keyFiles := splitList(conf.TLSKey)
+	if len(certFiles) != len(keyFiles) {
+		return nil, nil, fmt.Errorf("tls_cert lists %d file(s) but tls_key lists %d", len(certFiles), len(keyFiles))
+	}
+	pairs := make([]certs.Pair, len(certFiles))
+	for i := range certFiles {
+		pairs[i] = certs.Pair{CertFile: certFiles[i], KeyFile: keyFiles[i]}
+	}
+
+	store, err := certs.NewStore(pairs)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier, err := newClientVerifier(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	go store.Watch(certReloadInterval)
+	log.Printf("[TLS] Loaded %d certificate(s); changes are picked up every %s.", len(pairs), certReloadInterval)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		// 隧道的 WebSocket 和伪装站点都基于 HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	}
+	if conf.GrpcService != "" {
+		// gRPC 传输需要 HTTP/2
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if verifier != nil {
+		// 只请求证书而不在握手中验证，验证由 clientVerifier 在握手后完成，
+		// 这样没有有效证书的连接也能完成握手并被转交给回落地址
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	return tlsConfig, verifier, nil
+}
+
+// clientVerifier 在 TLS 握手完成后验证客户端证书 (mTLS) 并确定连接的身份
+type clientVerifier struct {
+	roots *x509.CertPool
+	allow []string
+}
+
+// newClientVerifier 根据 tls_client_ca 和 tls_client_allow 创建验证器，未配置 CA 时返回 nil
+func newClientVerifier(conf *types.RemoteConf) (*clientVerifier, error) {
+	if conf.TLSClientCA == "" {
+		if conf.TLSClientFallback {
+			return nil, fmt.Errorf("tls_client_fallback requires tls_client_ca")
+		}
+		return nil, nil
+	}
+	if conf.TLSClientFallback && conf.Fallback == "" {
+		return nil, fmt.Errorf("tls_client_fallback requires a fallback address")
+	}
+	pemData, err := os.ReadFile(conf.TLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls_client_ca: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in tls_client_ca '%s'", conf.TLSClientCA)
+	}
+	log.Printf("[TLS] Client certificates are required (CA bundle: %s).", conf.TLSClientCA)
+	return &clientVerifier{roots: roots, allow: auth.ParseIdentityPatterns(conf.TLSClientAllow)}, nil
+}
+
+// verify 完成 TLS 握手，验证客户端证书链，并返回证书身份
+func (v *clientVerifier) verify(conn *tls.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(clientHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return v.verifyState(conn.ConnectionState())
+}
+
+// verifyState 验证已完成握手的连接 (TLS 或 QUIC) 出示的客户端证书链，并返回证书身份
+func (v *clientVerifier) verifyState(state tls.ConnectionState) (string, error) {
+	peerCerts := state.PeerCertificates
+	if len(peerCerts) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range peerCerts[1:] {
+		intermediates.AddCert(c)
+	}
+	leaf := peerCerts[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return "", fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	identity := certIdentity(leaf)
+	if len(v.allow) > 0 && !auth.MatchIdentity(v.allow, identity) {
+		return "", fmt.Errorf("client certificate '%s' is not allowed", identity)
+	}
+	return identity, nil
+}
+
+// certIdentity 返回证书的身份: 依次取第一个 DNS SAN、URI SAN、邮箱 SAN，最后是 Subject CN
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// splitList 拆分逗号分隔的配置项，忽略空白项
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
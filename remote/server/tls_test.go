@@ -0,0 +1,275 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/certs"
+	"liuproxy_remote/remote/clientip"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/tunnel"
+	"liuproxy_remote/remote/types"
+)
+
+// testCA 是测试用的客户端证书 CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM 格式的 CA 证书文件
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(t.TempDir(), name+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue 用 CA 签发一个客户端证书，tmpl 只需填写身份相关的字段
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if tmpl.ExtKeyUsage == nil {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://fleet/gw-1")
+	cases := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"DNS SAN first", &x509.Certificate{DNSNames: []string{"gw-1.example.com", "gw-2.example.com"}, URIs: []*url.URL{spiffe}, Subject: pkix.Name{CommonName: "cn"}}, "gw-1.example.com"},
+		{"URI SAN", &x509.Certificate{URIs: []*url.URL{spiffe}, EmailAddresses: []string{"ops@example.com"}}, "spiffe://fleet/gw-1"},
+		{"email SAN", &x509.Certificate{EmailAddresses: []string{"ops@example.com"}, Subject: pkix.Name{CommonName: "cn"}}, "ops@example.com"},
+		{"subject CN", &x509.Certificate{Subject: pkix.Name{CommonName: "gateway-7"}}, "gateway-7"},
+	}
+	for _, c := range cases {
+		if got := certIdentity(c.cert); got != c.want {
+			t.Errorf("%s: certIdentity = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestClientVerifier_VerifyState(t *testing.T) {
+	ca := newTestCA(t, "client-ca")
+	other := newTestCA(t, "other-ca")
+	v, err := newClientVerifier(&types.RemoteConf{TLSClientCA: ca.file, TLSClientAllow: "gw-*.example.com, spiffe://fleet/*"})
+	if err != nil {
+		t.Fatalf("newClientVerifier: %v", err)
+	}
+	spiffe, _ := url.Parse("spiffe://fleet/gw-9")
+
+	cases := []struct {
+		name     string
+		cert     tls.Certificate
+		identity string
+		ok       bool
+	}{
+		{"DNS SAN matching a wildcard", ca.issue(t, &x509.Certificate{DNSNames: []string{"gw-1.example.com"}}), "gw-1.example.com", true},
+		{"URI SAN matching a wildcard", ca.issue(t, &x509.Certificate{URIs: []*url.URL{spiffe}}), "spiffe://fleet/gw-9", true},
+		{"DNS SAN in another domain", ca.issue(t, &x509.Certificate{DNSNames: []string{"gw-1.eu.example.org"}}), "", false},
+		{"identity outside tls_client_allow", ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}}), "", false},
+		{"signed by another CA", other.issue(t, &x509.Certificate{DNSNames: []string{"gw-1.example.com"}}), "", false},
+		{"server-only certificate", ca.issue(t, &x509.Certificate{DNSNames: []string{"gw-1.example.com"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}), "", false},
+	}
+	for _, c := range cases {
+		identity, err := v.verifyState(tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert.Leaf}})
+		if (err == nil) != c.ok || identity != c.identity {
+			t.Errorf("%s: verifyState = %q, %v; want %q, ok=%v", c.name, identity, err, c.identity, c.ok)
+		}
+	}
+	if _, err := v.verifyState(tls.ConnectionState{}); err == nil {
+		t.Error("verifyState accepted a connection without a certificate")
+	}
+
+	// tls_client_allow 留空时接受 CA 签发的任何证书
+	anyCert, _ := newClientVerifier(&types.RemoteConf{TLSClientCA: ca.file})
+	laptop := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}})
+	if identity, err := anyCert.verifyState(tls.ConnectionState{PeerCertificates: []*x509.Certificate{laptop.Leaf}}); err != nil || identity != "laptop" {
+		t.Errorf("verifyState without tls_client_allow = %q, %v; want laptop", identity, err)
+	}
+}
+
+// certInbound 返回有用户 alice (certs = gw-*.example.com) 和 bob (不限制证书) 的入站配置
+func certInbound(t *testing.T, fallback string) *tunnel.Inbound {
+	t.Helper()
+	cfg := &types.Config{}
+	cfg.BufferSize = 4096
+	cfg.RemoteConf.Fallback = fallback
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}, Certs: "gw-*.example.com"},
+		{Name: "bob", Keys: []types.KeyConf{{Generation: 1, Secret: "pw2"}}},
+	}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	policy, _ := clientip.NewPolicy(&cfg.RemoteConf)
+	return &tunnel.Inbound{Cfg: cfg, Users: users, Replay: auth.NewReplayCache(time.Minute, 16), ClientIP: policy}
+}
+
+// echoRoundTrip 通过 conn 打开一个到 echoPort 的 Multi-Conn 流并发送一帧，报告是否收到了回显
+func echoRoundTrip(t *testing.T, conn net.Conn, c securecrypt.Cipher, echoPort int) bool {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(sealedFrame(t, c, streamMetadata(tunnel.StreamTCP, echoPort)))
+	conn.Write(sealedFrame(t, c, []byte("hello")))
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return false
+	}
+	sealed := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, sealed); err != nil {
+		return false
+	}
+	got, err := c.Decrypt(sealed)
+	return err == nil && string(got) == "hello"
+}
+
+func TestDispatchTCPConnection_ClientCertificates(t *testing.T) {
+	ca := newTestCA(t, "client-ca")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := certs.GenerateSelfSigned([]string{"localhost"}, time.Hour, certFile, keyFile); err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	alice, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	bob, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("bob", "pw2"))
+	gateway := ca.issue(t, &x509.Certificate{DNSNames: []string{"gw-1.example.com"}})
+	laptop := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}})
+	mtls := types.ListenerConf{Name: "mtls", Port: 1, TLSCert: certFile, TLSKey: keyFile, TLSClientCA: ca.file}
+
+	dial := func(addr string, cert *tls.Certificate) net.Conn {
+		t.Helper()
+		conf := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			conf.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", addr, conf)
+		if err != nil {
+			t.Fatalf("tls.Dial: %v", err)
+		}
+		return conn
+	}
+
+	// 用户的 certs 限制: alice 只能通过 gw-*.example.com 的证书接入，bob 不受限制
+	addr := serveTestListener(t, certInbound(t, ""), mtls)
+	for _, c := range []struct {
+		name   string
+		cert   *tls.Certificate
+		cipher securecrypt.Cipher
+		ok     bool
+	}{
+		{"alice with a gateway certificate", &gateway, alice, true},
+		{"alice with another certificate", &laptop, alice, false},
+		{"bob with another certificate", &laptop, bob, true},
+	} {
+		conn := dial(addr, c.cert)
+		if got := echoRoundTrip(t, conn, c.cipher, echoPort); got != c.ok {
+			t.Errorf("%s: echo = %v, want %v", c.name, got, c.ok)
+		}
+		conn.Close()
+	}
+
+	// 没有证书的 TLS 连接在 tls_client_fallback 关闭时被直接断开
+	conn := dial(addr, nil)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example\r\n\r\n"))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Errorf("cert-less client got %d bytes, want the connection closed", n)
+	}
+	conn.Close()
+
+	// tls_client_fallback = true 时没有证书的连接被转交给回落地址
+	fallback, received := fallbackRecorder(t)
+	base := certInbound(t, fallback)
+	base.Cfg.RemoteConf.TLSClientFallback = true
+	addr = serveTestListener(t, base, mtls)
+	conn = dial(addr, nil)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	probe := []byte("GET / HTTP/1.1\r\nHost: example\r\n\r\n")
+	conn.Write(probe)
+	reply := make([]byte, len("fallback"))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "fallback" {
+		t.Fatalf("cert-less client with tls_client_fallback got %q, %v; want the fallback reply", reply, err)
+	}
+	if got := <-received; string(got) != string(probe) {
+		t.Errorf("fallback received %q, want %q", got, probe)
+	}
+	conn.Close()
+
+	// 没有 TLS 的监听器上，设置了 certs 的用户无法接入
+	fallback, received = fallbackRecorder(t)
+	addr = serveTestListener(t, certInbound(t, fallback), types.ListenerConf{Name: "plain", Port: 1})
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer plain.Close()
+	if echoRoundTrip(t, plain, alice, echoPort) {
+		t.Fatal("a user with certs connected without a client certificate")
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a user with certs and no certificate was not sent to the fallback")
+	}
+}
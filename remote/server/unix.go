@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixSocketOptions 是 Unix 套接字文件的权限和属主，uid/gid 为 -1 表示不修改
+type unixSocketOptions struct {
+	mode    os.FileMode
+	hasMode bool
+	uid     int
+	gid     int
+}
+
+// parseUnixSocketOptions 解析 socket_mode (八进制) 和 socket_owner ("用户"、"用户:组" 或 ":组"，名字或数字 ID)
+func parseUnixSocketOptions(mode, owner string) (unixSocketOptions, error) {
+	opts := unixSocketOptions{uid: -1, gid: -1}
+	if mode = strings.TrimSpace(mode); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return opts, fmt.Errorf("invalid socket_mode '%s' (want an octal permission such as 0660)", mode)
+		}
+		opts.mode, opts.hasMode = os.FileMode(m), true
+	}
+	if owner = strings.TrimSpace(owner); owner != "" {
+		userName, groupName, _ := strings.Cut(owner, ":")
+		var err error
+		if userName != "" {
+			if opts.uid, err = lookupID(userName, lookupUser); err != nil {
+				return opts, fmt.Errorf("invalid socket_owner '%s': %w", owner, err)
+			}
+		}
+		if groupName != "" {
+			if opts.gid, err = lookupID(groupName, lookupGroup); err != nil {
+				return opts, fmt.Errorf("invalid socket_owner '%s': %w", owner, err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// lookupID 把数字 ID 或用户/组名解析为数字 ID
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	idStr, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(idStr)
+}
+
+// listenUnix 在 path 上监听 Unix 套接字并设置文件的权限和属主。
+// 设置了 socket_mode 时，套接字创建时只带有其中属主的权限，修改属主之后才放开到 socket_mode，
+// 其他用户不会在中途连上权限还没有收紧的套接字。
+// 上次运行遗留的套接字文件会被删除，但仍有进程在监听时报错。
+// 抽象套接字 (以 "@" 开头) 没有文件，opts 对它不起作用。
+func listenUnix(path string, opts unixSocketOptions) (net.Listener, error) {
+	if strings.HasPrefix(path, "@") {
+		return net.Listen("unix", path)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	var listener net.Listener
+	var err error
+	if opts.hasMode {
+		listener, err = listenWithMode(path, opts.mode&0o600)
+	} else {
+		listener, err = net.Listen("unix", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.uid != -1 || opts.gid != -1 {
+		if err := os.Chown(path, opts.uid, opts.gid); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket owner: %w", err)
+		}
+	}
+	if opts.hasMode {
+		if err := os.Chmod(path, opts.mode); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket mode: %w", err)
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket 删除 path 上遗留的套接字文件。path 不是套接字或者仍有进程在监听时返回错误
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
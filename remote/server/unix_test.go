@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseUnixSocketOptions(t *testing.T) {
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	cases := []struct {
+		mode, owner string
+		want        unixSocketOptions
+	}{
+		{"", "", unixSocketOptions{uid: -1, gid: -1}},
+		{"0660", "", unixSocketOptions{mode: 0o660, hasMode: true, uid: -1, gid: -1}},
+		{" 600 ", "", unixSocketOptions{mode: 0o600, hasMode: true, uid: -1, gid: -1}},
+		{"", "1000", unixSocketOptions{uid: 1000, gid: -1}},
+		{"", "1000:2000", unixSocketOptions{uid: 1000, gid: 2000}},
+		{"", ":2000", unixSocketOptions{uid: -1, gid: 2000}},
+		{"", "root:root", unixSocketOptions{uid: 0, gid: 0}},
+		{"", uid + ":" + gid, unixSocketOptions{uid: os.Getuid(), gid: os.Getgid()}},
+	}
+	for _, c := range cases {
+		got, err := parseUnixSocketOptions(c.mode, c.owner)
+		if err != nil || got != c.want {
+			t.Errorf("parseUnixSocketOptions(%q, %q) = %+v, %v; want %+v", c.mode, c.owner, got, err, c.want)
+		}
+	}
+
+	for _, c := range [][2]string{
+		{"0999", ""},
+		{"rw-rw----", ""},
+		{"1777", ""},
+		{"", "no-such-user-liuproxy"},
+		{"", ":no-such-group-liuproxy"},
+	} {
+		if got, err := parseUnixSocketOptions(c[0], c[1]); err == nil {
+			t.Errorf("parseUnixSocketOptions(%q, %q) = %+v, want an error", c[0], c[1], got)
+		}
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// 不存在的路径
+	if err := removeStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("missing path: %v", err)
+	}
+
+	// 普通文件不会被删除
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, []byte("data"), 0600)
+	if err := removeStaleSocket(regular); err == nil {
+		t.Error("removed a regular file")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Errorf("regular file is gone: %v", err)
+	}
+
+	// 仍在监听的套接字
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	if err := removeStaleSocket(live); err == nil {
+		t.Error("removed a socket that is still in use")
+	}
+
+	// 遗留的套接字文件被删除
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	sl.(*net.UnixListener).SetUnlinkOnClose(false)
+	sl.Close()
+	if err := removeStaleSocket(stale); err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale socket still exists: %v", err)
+	}
+}
+
+func TestListenUnix_Mode(t *testing.T) {
+	dir := t.TempDir()
+
+	// 套接字创建时只带有 socket_mode 中属主的权限，不受进程 umask 的影响
+	created := filepath.Join(dir, "created.sock")
+	l, err := listenWithMode(created, 0o600)
+	if err != nil {
+		t.Fatalf("listenWithMode: %v", err)
+	}
+	defer l.Close()
+	if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket created with mode %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+
+	opts, _ := parseUnixSocketOptions("0660", strconv.Itoa(os.Getuid()))
+	path := filepath.Join(dir, "remote.sock")
+	l, err = listenUnix(path, opts)
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	defer l.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode %v, %v; want 0660", info.Mode().Perm(), err)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package server
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu 串行化对进程 umask 的临时修改
+var umaskMu sync.Mutex
+
+// listenWithMode 在 path 上监听 Unix 套接字，套接字文件创建时的权限即为 mode。
+// umask 是进程级的设置，修改期间其他 goroutine 创建的文件权限只会更严格
+func listenWithMode(path string, mode os.FileMode) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(0o777 &^ mode))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
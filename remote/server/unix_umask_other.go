@@ -0,0 +1,13 @@
+//go:build !unix
+
+package server
+
+import (
+	"net"
+	"os"
+)
+
+// listenWithMode 在没有 umask 的平台上直接监听，权限由 listenUnix 随后设置
+func listenWithMode(path string, _ os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
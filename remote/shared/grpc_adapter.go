@@ -0,0 +1,213 @@
+package shared
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// gRPC 消息格式: 压缩标志(1) | 长度(4, 大端) | protobuf 消息。
+// gun 风格的 Tun/TunMulti 方法的消息只有一个 (可重复的) bytes 字段 1:
+//
+//	message Hunk      { bytes data = 1; }
+//	message MultiHunk { repeated bytes data = 1; }
+//
+// 两者的编码相同，因此读取时把所有字段 1 依次拼接即可同时支持两种方法。
+const (
+	grpcHeaderLen = 5
+	// maxGRPCMessage 限制单个 gRPC 消息的大小 (与 gRPC 默认的 4 MiB 接收上限一致)
+	maxGRPCMessage = 4 << 20
+	// maxHunk 是写入时单个消息携带的最大数据量
+	maxHunk = 32 << 10
+)
+
+var (
+	// ErrGRPCCompressed 表示收到了压缩的 gRPC 消息 (不支持)
+	ErrGRPCCompressed = errors.New("compressed gRPC messages are not supported")
+	// ErrGRPCTooLarge 表示 gRPC 消息超过了 maxGRPCMessage
+	ErrGRPCTooLarge = errors.New("gRPC message too large")
+	// ErrGRPCMalformed 表示 gRPC 消息中的 protobuf 编码不合法
+	ErrGRPCMalformed = errors.New("malformed gRPC message")
+)
+
+// GRPCConnAdapter 把 gRPC 双向流 (HTTP/2 请求体和响应体) 适配为 net.Conn
+type GRPCConnAdapter struct {
+	body   io.ReadCloser
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+
+	pending [][]byte // 已解析但尚未读完的数据块
+	header  [grpcHeaderLen]byte
+
+	// err 是读取时遇到的协议错误 (不包括请求体正常结束)，见 Err
+	errMu sync.Mutex
+	err   error
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewGRPCConnAdapter 在已经发送了响应头的 gRPC 请求上创建连接。
+// local 和 remote 分别作为 LocalAddr 和 RemoteAddr 返回。
+func NewGRPCConnAdapter(w http.ResponseWriter, r *http.Request, local, remote net.Addr) *GRPCConnAdapter {
+	return &GRPCConnAdapter{
+		body:   r.Body,
+		w:      w,
+		rc:     http.NewResponseController(w),
+		local:  local,
+		remote: remote,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *GRPCConnAdapter) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readMessage(); err != nil {
+			if errors.Is(err, ErrGRPCCompressed) || errors.Is(err, ErrGRPCTooLarge) || errors.Is(err, ErrGRPCMalformed) {
+				c.errMu.Lock()
+				if c.err == nil {
+					c.err = err
+				}
+				c.errMu.Unlock()
+			}
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending[0])
+	if c.pending[0] = c.pending[0][n:]; len(c.pending[0]) == 0 {
+		c.pending = c.pending[1:]
+	}
+	return n, nil
+}
+
+// readMessage 读取一个 gRPC 消息，把其中的数据块放入 pending
+func (c *GRPCConnAdapter) readMessage() error {
+	if _, err := io.ReadFull(c.body, c.header[:]); err != nil {
+		return err
+	}
+	if c.header[0] != 0 {
+		return ErrGRPCCompressed
+	}
+	size := binary.BigEndian.Uint32(c.header[1:])
+	if size > maxGRPCMessage {
+		return fmt.Errorf("%w: %d bytes exceeds the %d byte limit", ErrGRPCTooLarge, size, maxGRPCMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(c.body, msg); err != nil {
+		return err
+	}
+
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad field tag", ErrGRPCMalformed)
+		}
+		msg = msg[n:]
+		field, wireType := tag>>3, tag&0x07
+		switch wireType {
+		case 0: // varint
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return fmt.Errorf("%w: bad varint", ErrGRPCMalformed)
+			}
+			msg = msg[n:]
+		case 1: // 64 位
+			if len(msg) < 8 {
+				return fmt.Errorf("%w: truncated field", ErrGRPCMalformed)
+			}
+			msg = msg[8:]
+		case 2: // 变长
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return fmt.Errorf("%w: truncated field", ErrGRPCMalformed)
+			}
+			data := msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+			if field == 1 && len(data) > 0 {
+				c.pending = append(c.pending, data)
+			}
+		case 5: // 32 位
+			if len(msg) < 4 {
+				return fmt.Errorf("%w: truncated field", ErrGRPCMalformed)
+			}
+			msg = msg[4:]
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d", ErrGRPCMalformed, wireType)
+		}
+	}
+	return nil
+}
+
+// Err 返回读取请求流时遇到的协议错误 (压缩、超长或格式不合法的消息)，
+// 请求体正常结束或连接被关闭时返回 nil。处理函数据此决定 trailer 中的 grpc-status。
+func (c *GRPCConnAdapter) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+func (c *GRPCConnAdapter) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxHunk)]
+		b = b[len(chunk):]
+
+		// 消息体 = 字段 1 的标签 (0x0A) | 数据长度 (varint) | 数据
+		var lenBuf [binary.MaxVarintLen64]byte
+		lenLen := binary.PutUvarint(lenBuf[:], uint64(len(chunk)))
+		frame := make([]byte, 0, grpcHeaderLen+1+lenLen+len(chunk))
+		frame = append(frame, 0)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(1+lenLen+len(chunk)))
+		frame = append(frame, 0x0A)
+		frame = append(frame, lenBuf[:lenLen]...)
+		frame = append(frame, chunk...)
+		if _, err := c.w.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, c.rc.Flush()
+}
+
+// Close 结束读写，并等待进行中的写入返回。响应流在处理函数返回时结束，
+// 处理函数必须在返回前调用 Close，之后的 Write 不会再触碰 ResponseWriter。
+func (c *GRPCConnAdapter) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.body.Close()
+		if !c.writeMu.TryLock() {
+			_ = c.rc.SetWriteDeadline(time.Now()) // 解除被流量控制阻塞的写入
+			c.writeMu.Lock()
+		}
+		c.writeMu.Unlock()
+	})
+	return nil
+}
+
+func (c *GRPCConnAdapter) LocalAddr() net.Addr  { return c.local }
+func (c *GRPCConnAdapter) RemoteAddr() net.Addr { return c.remote }
+func (c *GRPCConnAdapter) SetDeadline(t time.Time) error {
+	_ = c.rc.SetReadDeadline(t)
+	return c.rc.SetWriteDeadline(t)
+}
+func (c *GRPCConnAdapter) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+func (c *GRPCConnAdapter) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
@@ -0,0 +1,110 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// grpcMessage 给 protobuf 消息体加上 gRPC 消息头
+func grpcMessage(compressed byte, msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{compressed}, uint32(len(msg))), msg...)
+}
+
+// bytesField 编码一个变长 (wire type 2) 字段
+func bytesField(field int, data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(field<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// readAdapter 创建一个请求体为 body 的连接，读出全部数据
+func readAdapter(body []byte) ([]byte, *GRPCConnAdapter, error) {
+	r := httptest.NewRequest(http.MethodPost, "/svc/Tun", bytes.NewReader(body))
+	c := NewGRPCConnAdapter(httptest.NewRecorder(), r, nil, nil)
+	data, err := io.ReadAll(c)
+	return data, c, err
+}
+
+func TestGRPCConnAdapter_Read(t *testing.T) {
+	// 未知字段: varint(2)、64 位(3)、变长(4)、32 位(5)
+	unknown := binary.AppendUvarint(nil, 2<<3|0)
+	unknown = binary.AppendUvarint(unknown, 300)
+	unknown = append(unknown, 3<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	unknown = append(unknown, bytesField(4, []byte("ignored"))...)
+	unknown = append(unknown, 5<<3|5, 1, 2, 3, 4)
+
+	cases := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"hunk", grpcMessage(0, bytesField(1, []byte("hello"))), "hello"},
+		{"multi hunk", grpcMessage(0, append(bytesField(1, []byte("hel")), bytesField(1, []byte("lo"))...)), "hello"},
+		{"several messages", append(grpcMessage(0, bytesField(1, []byte("he"))), grpcMessage(0, bytesField(1, []byte("llo")))...), "hello"},
+		{"unknown fields", grpcMessage(0, append(append(unknown, bytesField(1, []byte("hello"))...), unknown...)), "hello"},
+		{"empty message", append(grpcMessage(0, nil), grpcMessage(0, bytesField(1, []byte("hello")))...), "hello"},
+	}
+	for _, c := range cases {
+		data, conn, err := readAdapter(c.body)
+		if err != nil || string(data) != c.want {
+			t.Errorf("%s: read %q, %v; want %q", c.name, data, err, c.want)
+		}
+		if conn.Err() != nil {
+			t.Errorf("%s: Err() = %v after a clean end of stream", c.name, conn.Err())
+		}
+	}
+}
+
+func TestGRPCConnAdapter_ReadErrors(t *testing.T) {
+	oversized := binary.BigEndian.AppendUint32([]byte{0}, maxGRPCMessage+1)
+	cases := []struct {
+		name string
+		body []byte
+		want error
+	}{
+		{"compressed", grpcMessage(1, bytesField(1, []byte("hello"))), ErrGRPCCompressed},
+		{"oversized", oversized, ErrGRPCTooLarge},
+		{"truncated tag varint", grpcMessage(0, []byte{0x80}), ErrGRPCMalformed},
+		{"truncated length varint", grpcMessage(0, []byte{1<<3 | 2, 0x80}), ErrGRPCMalformed},
+		{"truncated value varint", grpcMessage(0, []byte{2 << 3, 0xFF}), ErrGRPCMalformed},
+		{"length past the end", grpcMessage(0, []byte{1<<3 | 2, 10, 'x'}), ErrGRPCMalformed},
+		{"truncated fixed64", grpcMessage(0, []byte{3<<3 | 1, 1, 2}), ErrGRPCMalformed},
+		{"unsupported wire type", grpcMessage(0, []byte{1<<3 | 3}), ErrGRPCMalformed},
+	}
+	for _, c := range cases {
+		_, conn, err := readAdapter(c.body)
+		if !errors.Is(err, c.want) || !errors.Is(conn.Err(), c.want) {
+			t.Errorf("%s: read error %v, Err() %v; want %v", c.name, err, conn.Err(), c.want)
+		}
+	}
+
+	// 在消息中途结束的请求体是客户端取消，不是协议错误
+	_, conn, err := readAdapter(grpcMessage(0, bytesField(1, []byte("hello")))[:8])
+	if err == nil || conn.Err() != nil {
+		t.Errorf("truncated body: read error %v, Err() %v; want an error and no protocol error", err, conn.Err())
+	}
+}
+
+func TestGRPCConnAdapter_WriteRoundTrip(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/svc/Tun", http.NoBody)
+	c := NewGRPCConnAdapter(w, r, nil, nil)
+	payload := bytes.Repeat([]byte("0123456789"), maxHunk/5) // 两个多 Hunk
+	if n, err := c.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+
+	data, _, err := readAdapter(w.Body.Bytes())
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("round trip read %d bytes, %v; want %d bytes", len(data), err, len(payload))
+	}
+	c.Close()
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Fatal("Write after Close succeeded")
+	}
+}
@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter 是一个可并发累加的命名计数器
+type Counter struct {
+	name  string
+	value atomic.Int64
+}
+
+// Add 累加计数器
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+// Value 返回当前值
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// Name 返回计数器的名字
+func (c *Counter) Name() string {
+	return c.name
+}
+
+var (
+	mu       sync.Mutex
+	counters = make(map[string]*Counter)
+)
+
+// Get 返回指定名字的计数器，不存在时创建。
+// 固定的计数器应在包级变量中保存 Get 的结果，避免每次查表。
+func Get(name string) *Counter {
+	mu.Lock()
+	defer mu.Unlock()
+	c, ok := counters[name]
+	if !ok {
+		c = &Counter{name: name}
+		counters[name] = c
+	}
+	return c
+}
+
+// Snapshot 返回所有计数器当前值的副本
+func Snapshot() map[string]int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	snap := make(map[string]int64, len(counters))
+	for name, c := range counters {
+		snap[name] = c.Value()
+	}
+	return snap
+}
+
+// Report 每隔 interval 把所有非零计数器输出到日志，直到进程退出。
+// interval <= 0 时直接返回。
+func Report(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		snap := Snapshot()
+		names := make([]string, 0, len(snap))
+		for name, v := range snap {
+			if v != 0 {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		var sb strings.Builder
+		for i, name := range names {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(name)
+			sb.WriteByte('=')
+			sb.WriteString(strconv.FormatInt(snap[name], 10))
+		}
+		log.Printf("[STATS] %s", sb.String())
+	}
+}
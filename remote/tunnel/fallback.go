@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"liuproxy_remote/remote/stats"
+)
+
+// metadataReadTimeout 限制开启回落后读取第一个元数据包的时间。
+// 声明了较长长度却不发送数据的探测连接超时后同样会被转交给回落地址。
+const metadataReadTimeout = 15 * time.Second
+
+// minMetadataLen 是合法元数据密文的最小长度: 最短的 nonce (12) + 认证标签 (16) + 最短的元数据 (5)
+const minMetadataLen = 12 + 16 + 5
+
+var fallbackConnections = stats.Get("fallback_connections")
+
+// fallbackEnabled 报告是否配置了回落地址
+func (in *Inbound) fallbackEnabled() bool {
+	return in.Cfg.RemoteConf.Fallback != ""
+}
+
+// fallback 把未通过认证的连接透明地转交给回落地址 (例如本机的 nginx)。
+// consumed 是已经从连接中读出的字节，会先原样发给回落地址；
+// reader 中剩余的数据和之后的数据随后继续转发，探测方看到的就是一个普通的 Web 服务器。
+// 未配置回落地址时返回 false，调用方应直接关闭连接。
+func (in *Inbound) fallback(inboundConn net.Conn, reader io.Reader, consumed []byte, reason error) bool {
+	if !in.fallbackEnabled() {
+		return false
+	}
+	fallbackConnections.Add(1)
+	inboundConn.SetReadDeadline(time.Time{})
+	log.Printf("[REMOTE-FALLBACK] Forwarding %s to %s: %v", inboundConn.RemoteAddr(), in.Cfg.RemoteConf.Fallback, reason)
+
+	backend, err := net.DialTimeout("tcp", in.Cfg.RemoteConf.Fallback, 5*time.Second)
+	if err != nil {
+		log.Printf("[REMOTE-FALLBACK] Failed to dial fallback %s: %v", in.Cfg.RemoteConf.Fallback, err)
+		return true
+	}
+	defer backend.Close()
+	if _, err := backend.Write(consumed); err != nil {
+		return true
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(backend, reader)
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(inboundConn, backend)
+		closeWrite(inboundConn)
+	}()
+	wg.Wait()
+	return true
+}
+
+// recordingReader 记录从 r 读出的所有字节。认证失败时这些字节作为 consumed 原样交给回落地址，
+// 之后的数据仍从 r 读取，回落地址看到的就是完整的原始请求。
+type recordingReader struct {
+	r    io.Reader
+	data []byte
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.data = append(rr.data, p[:n]...)
+	return n, err
+}
+
+// writeTracker 记录是否已经向连接写出过数据。写出过回复的连接不能再转交给回落地址。
+type writeTracker struct {
+	net.Conn
+	wrote bool
+}
+
+func (w *writeTracker) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.Conn.Write(p)
+}
+
+// smux 帧头: ver(1) | cmd(1) | length(2, 小端) | sid(4, 小端)
+const (
+	smuxHeaderSize = 8
+	smuxCmdSYN     = 0
+	smuxCmdFIN     = 1
+	smuxCmdPSH     = 2
+	// maxMuxProbeBytes 限制在第一个流的元数据完整之前最多读取的字节数
+	maxMuxProbeBytes = 128 * 1024
+)
+
+// checkMuxProbe 在把连接交给 smux 之前，从 r 中按 smux 帧格式读出第一个流的元数据并试解密，
+// 以便在服务端回复任何数据之前识别出探测连接。这里只认证用户，防重放等检查仍在流的处理中进行。
+func (in *Inbound) checkMuxProbe(r io.Reader, peer net.Addr) error {
+	header := make([]byte, smuxHeaderSize)
+	var sid uint32
+	var data []byte
+	for total := 0; ; {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return fmt.Errorf("failed to read smux frame header: %w", err)
+		}
+		length := int(binary.LittleEndian.Uint16(header[2:4]))
+		total += smuxHeaderSize + length
+		if total > maxMuxProbeBytes {
+			return errors.New("no stream metadata in the first smux frames")
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("failed to read smux frame: %w", err)
+		}
+
+		id := binary.LittleEndian.Uint32(header[4:8])
+		switch header[1] {
+		case smuxCmdSYN:
+			if sid == 0 {
+				sid = id
+			}
+		case smuxCmdPSH:
+			if sid != 0 && id == sid {
+				data = append(data, body...)
+			}
+		case smuxCmdFIN:
+			if sid != 0 && id == sid {
+				return errors.New("first smux stream closed before sending metadata")
+			}
+		}
+
+		if len(data) < 2 {
+			continue
+		}
+		metaLen := int(binary.BigEndian.Uint16(data))
+		if metaLen < minMetadataLen {
+			return fmt.Errorf("metadata length %d is too short", metaLen)
+		}
+		if len(data) < 2+metaLen {
+			continue
+		}
+		_, _, _, err := in.openMetadata(data[2:2+metaLen], nil, nil, peer)
+		return err
+	}
+}
@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// fallbackTarget 启动一个回落地址，它读取 want 长度的请求后回复 "fallback"，收到的请求写入返回的通道
+func fallbackTarget(t *testing.T, want int) (string, <-chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, want)
+		io.ReadFull(c, buf)
+		received <- buf
+		c.Write([]byte("fallback"))
+	}()
+	return l.Addr().String(), received
+}
+
+// expectFallback 确认 probe 被原样转交给回落地址，并且客户端收到了回落地址的回复
+func expectFallback(t *testing.T, client net.Conn, probe []byte, received <-chan []byte) {
+	t.Helper()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(probe); err != nil {
+		t.Fatalf("write probe: %v", err)
+	}
+	reply := make([]byte, len("fallback"))
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "fallback" {
+		t.Fatalf("client got %q, %v; want the fallback reply", reply, err)
+	}
+	if got := <-received; !bytes.Equal(got, probe) {
+		t.Fatalf("fallback received %x, want the probe %x", got, probe)
+	}
+}
+
+// smuxFrame 编码一个 smux v2 帧
+func smuxFrame(cmd byte, sid uint32, body []byte) []byte {
+	frame := []byte{2, cmd}
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(len(body)))
+	frame = binary.LittleEndian.AppendUint32(frame, sid)
+	return append(frame, body...)
+}
+
+func TestFallback_BadHandshake(t *testing.T) {
+	in, _ := testInbound(t)
+	probe := []byte{handshakeMagic[0], handshakeMagic[1], handshakeModeStream, kexX25519, 0, 64}
+	junk := make([]byte, 64)
+	rand.Read(junk)
+	probe = append(probe, junk...)
+	addr, received := fallbackTarget(t, len(probe))
+	in.Cfg.RemoteConf.Fallback = addr
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleHandshakeConnection(server, bufio.NewReader(server), in)
+	expectFallback(t, client, probe, received)
+}
+
+func TestFallback_BadMuxProbe(t *testing.T) {
+	in, _ := testInbound(t)
+	junk := make([]byte, 2+64)
+	rand.Read(junk)
+	binary.BigEndian.PutUint16(junk, 64)
+	probe := append(smuxFrame(smuxCmdSYN, 1, nil), smuxFrame(smuxCmdPSH, 1, junk)...)
+	addr, received := fallbackTarget(t, len(probe))
+	in.Cfg.RemoteConf.Fallback = addr
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleMuxSession(server, bufio.NewReader(server), in)
+	expectFallback(t, client, probe, received)
+}
+
+func TestFallback_MuxSessionPassesProbeCheck(t *testing.T) {
+	in, cipher := testInbound(t)
+	in.Cfg.RemoteConf.Fallback = "127.0.0.1:1" // 不应被使用
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleMuxSession(server, bufio.NewReader(server), in)
+
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	session, err := smux.Client(client, smuxConfig)
+	if err != nil {
+		t.Fatalf("smux.Client: %v", err)
+	}
+	defer session.Close()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := echo.Addr().(*net.TCPAddr)
+	meta := append([]byte{StreamTCP, AddrTypeIPv4}, target.IP.To4()...)
+	writeTestFrame(t, stream, cipher, binary.BigEndian.AppendUint16(meta, uint16(target.Port)))
+	writeTestFrame(t, stream, cipher, []byte("hello over mux"))
+	if got := readTestFrame(t, stream, cipher); string(got) != "hello over mux" {
+		t.Fatalf("echo = %q", got)
+	}
+}
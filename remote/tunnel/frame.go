@@ -0,0 +1,339 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/stats"
+)
+
+// 元数据之后的数据帧有两种格式，由元数据中的标志决定:
+//
+//   - 随机 nonce 模式 (v2.2 默认): len(2) | nonce | AEAD 密文。
+//     每帧都用长期密钥 (或握手会话密钥) 加密，并携带随机 nonce。
+//     只用于 XChaCha20-Poly1305；nonce 较短的套件在这种模式下每帧都要派生子密钥，
+//     比 XChaCha20-Poly1305 还慢，因此它们的数据帧必须使用流式模式 (errStreamKeysRequired)。
+//   - 流式模式 (MetaFlagStreamKeys): len(2) | AEAD 密文。
+//     每个方向用随机盐派生子密钥，nonce 为递增计数器，不再随帧传输。
+//     上行的盐在元数据中，下行的盐由服务端在第一帧之前以明文发送。
+//
+// 两种模式中 len 都是其后密文的长度。
+//
+// 流式模式下，元数据还可以带 MetaFlagSealedLength，此时长度头也被加密
+// (与 Shadowsocks AEAD 分块相同):
+//
+//	Seal(len(2)) | Seal(payload)
+//
+// 长度块和数据块各消耗一个计数器 nonce，线路上只剩下密文，
+// 中间设备无法再从明文长度头推断每帧大小。
+//
+// 元数据带有 MetaFlagBindFrames 时，两种模式下每帧都额外认证附加数据:
+//
+//	方向(1) | 流标识(16) | 帧序号(8, 大端)
+//
+// 流标识是 ReplayGuard 中的唯一 ID，帧序号在每个方向上从 0 开始逐帧递增 (保活帧不计)。
+// 附加数据不在线路上传输，因此帧格式不变；但被重排、反射回另一方向或
+// 拼接到另一个流 (包括同一 smux 会话中的另一个流) 的帧都无法通过认证。
+//
+// 元数据带有 MetaFlagPadding 时，两个方向上每帧加密前的明文都变为:
+//
+//	payloadLen(2) | payload | padding
+//
+// 解密后去掉填充；payloadLen 为 0 的帧只有填充，读取时跳过。
+// 上行填充由客户端决定，下行填充和延迟抖动由用户的 auth.PaddingPolicy 决定。
+// 客户端的第一个包 (元数据) 在可选字段之后带有填充，padding_first 限定其长度 (见 checkFirstPacket)。
+
+// errStreamKeysRequired 表示 nonce 较短的套件 (aes-256-gcm、chacha20-poly1305) 的客户端没有使用流式模式
+var errStreamKeysRequired = errors.New("this cipher suite requires stream keys for data frames")
+
+// maxFramePlaintext 是填充后单帧明文的上限，为 nonce 和认证标签留出余量
+const maxFramePlaintext = 0xffff - 64
+
+var (
+	paddingTxBytes = stats.Get("padding_tx_bytes")
+	paddingRxBytes = stats.Get("padding_rx_bytes")
+)
+
+// 帧方向，用于附加数据
+const (
+	frameDirUplink   byte = 0x01 // 客户端 -> 服务端
+	frameDirDownlink byte = 0x02 // 服务端 -> 客户端
+)
+
+// frameOptions 描述一个流协商出的帧格式
+type frameOptions struct {
+	streamKeys   bool
+	bindFrames   bool
+	sealedLength bool
+	padding      bool
+}
+
+// frameOptionsFromMeta 根据元数据中的标志确定帧格式
+func frameOptionsFromMeta(meta *Metadata) frameOptions {
+	return frameOptions{
+		streamKeys:   meta.Flags&MetaFlagStreamKeys != 0,
+		bindFrames:   meta.Flags&MetaFlagBindFrames != 0,
+		sealedLength: meta.Flags&MetaFlagSealedLength != 0,
+		padding:      meta.Flags&MetaFlagPadding != 0,
+	}
+}
+
+// frameBinding 为一个方向上的帧依次生成附加数据
+type frameBinding struct {
+	ad  [1 + auth.ReplayIDSize + 8]byte
+	seq uint64
+}
+
+func newFrameBinding(dir byte, streamID [auth.ReplayIDSize]byte) *frameBinding {
+	b := &frameBinding{}
+	b.ad[0] = dir
+	copy(b.ad[1:], streamID[:])
+	return b
+}
+
+// peek 返回下一帧的附加数据但不推进序号。nil 的 frameBinding 返回 nil (不绑定)。
+func (b *frameBinding) peek() []byte {
+	if b == nil {
+		return nil
+	}
+	binary.BigEndian.PutUint64(b.ad[1+auth.ReplayIDSize:], b.seq)
+	return b.ad[:]
+}
+
+// next 返回下一帧的附加数据并推进序号
+func (b *frameBinding) next() []byte {
+	ad := b.peek()
+	if b != nil {
+		b.seq++
+	}
+	return ad
+}
+
+// frameReader 从入站一侧读取并解密上行帧
+type frameReader struct {
+	r      io.Reader
+	cipher securecrypt.Cipher
+	stream *securecrypt.StreamCipher
+	bind   *frameBinding
+	// sealedLen 不为 nil 时长度头是加密的，它是密文长度头的读取缓冲
+	sealedLen []byte
+	// padded 表示帧明文带有填充
+	padded bool
+	lenBuf [2]byte
+}
+
+// frameWriter 加密下行数据并写入入站一侧
+type frameWriter struct {
+	w      io.Writer
+	cipher securecrypt.Cipher
+	stream *securecrypt.StreamCipher
+	bind   *frameBinding
+	// sealedLength 表示长度头也要加密
+	sealedLength bool
+	// policy 是下行填充和延迟抖动策略；padded 表示客户端请求了流量整形，帧明文带有填充
+	policy *auth.PaddingPolicy
+	padded bool
+	plain  []byte
+	// salt 是尚未发送的下行盐，随第一帧一起写出
+	salt []byte
+	buf  []byte
+}
+
+// newFrameCodec 为一个流创建上行读取器和下行写入器，user 的填充策略用于下行帧
+func newFrameCodec(meta *Metadata, user *auth.User, cipher securecrypt.Cipher, r io.Reader, w io.Writer) (*frameReader, *frameWriter, error) {
+	opts := frameOptionsFromMeta(meta)
+	if !opts.streamKeys && securecrypt.HasShortNonce(cipher.Suite()) {
+		return nil, nil, fmt.Errorf("suite '%s': %w", cipher.Suite(), errStreamKeysRequired)
+	}
+	fr := &frameReader{r: r, cipher: cipher, padded: opts.padding}
+	fw := &frameWriter{w: w, cipher: cipher, policy: &user.Padding, padded: opts.padding}
+	if opts.bindFrames {
+		// ReadMetadata 保证绑定时一定带有 ReplayGuard
+		fr.bind = newFrameBinding(frameDirUplink, meta.Guard.ID)
+		fw.bind = newFrameBinding(frameDirDownlink, meta.Guard.ID)
+	}
+	if !opts.streamKeys {
+		return fr, fw, nil
+	}
+
+	upStream, err := cipher.NewStream(meta.UplinkSalt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive uplink stream key: %w", err)
+	}
+	salt := make([]byte, securecrypt.StreamSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate downlink salt: %w", err)
+	}
+	downStream, err := cipher.NewStream(salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive downlink stream key: %w", err)
+	}
+	fr.stream = upStream
+	fw.stream = downStream
+	fw.salt = salt
+	if opts.sealedLength {
+		fr.sealedLen = make([]byte, 2+upStream.Overhead())
+		fw.sealedLength = true
+	}
+	return fr, fw, nil
+}
+
+// ReadFrame 读取并解密一个上行帧。明文长度为 0 的帧被视为保活并跳过；
+// 加密长度头不允许为 0。
+func (f *frameReader) ReadFrame() ([]byte, error) {
+	for {
+		ad := f.bind.peek()
+		payloadLen, err := f.readLength(ad)
+		if err != nil {
+			return nil, err
+		}
+		if payloadLen == 0 {
+			if f.sealedLen != nil {
+				return nil, errors.New("sealed length header is zero")
+			}
+			continue
+		}
+		f.bind.next()
+
+		buf := make([]byte, payloadLen)
+		if _, err := io.ReadFull(f.r, buf); err != nil {
+			return nil, err
+		}
+		var plain []byte
+		if f.stream != nil {
+			plain, err = f.stream.Open(buf[:0], buf, ad)
+		} else {
+			plain, err = f.cipher.DecryptWithAD(buf, ad)
+		}
+		if err != nil || !f.padded {
+			return plain, err
+		}
+
+		payload, err := stripPadding(plain)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) == 0 {
+			continue // 只有填充的帧
+		}
+		return payload, nil
+	}
+}
+
+// checkFirstPacket 统计元数据中的填充，并确认请求了流量整形的客户端按用户的 padding_first 填充了第一个包
+func checkFirstPacket(user *auth.User, meta *Metadata) error {
+	if meta.Flags&MetaFlagPadding == 0 {
+		return nil
+	}
+	paddingRxBytes.Add(int64(meta.Padding))
+	return user.Padding.CheckFirst(meta.Padding)
+}
+
+// stripPadding 从 payloadLen(2) | payload | padding 格式的明文中取出 payload
+func stripPadding(plain []byte) ([]byte, error) {
+	if len(plain) < 2 {
+		return nil, errors.New("padded frame is too short")
+	}
+	n := int(binary.BigEndian.Uint16(plain))
+	if n > len(plain)-2 {
+		return nil, fmt.Errorf("padded frame declares %d payload bytes but has only %d", n, len(plain)-2)
+	}
+	paddingRxBytes.Add(int64(len(plain) - 2 - n))
+	return plain[2 : 2+n], nil
+}
+
+// readLength 读取下一帧的长度头，必要时先解密
+func (f *frameReader) readLength(ad []byte) (uint16, error) {
+	if f.sealedLen == nil {
+		if _, err := io.ReadFull(f.r, f.lenBuf[:]); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint16(f.lenBuf[:]), nil
+	}
+
+	if _, err := io.ReadFull(f.r, f.sealedLen); err != nil {
+		return 0, err
+	}
+	plain, err := f.stream.Open(f.lenBuf[:0], f.sealedLen, ad)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open sealed length: %w", err)
+	}
+	return binary.BigEndian.Uint16(plain), nil
+}
+
+// WriteFrame 加密 payload 并作为一个帧写出 (长度头和密文在一次 Write 中发送)
+func (f *frameWriter) WriteFrame(payload []byte) error {
+	// 延迟抖动和填充一样，只用于请求了流量整形的客户端
+	if f.padded {
+		if delay := f.policy.NextDelay(); delay > 0 {
+			time.Sleep(delay)
+		}
+		payload = f.addPadding(payload)
+	}
+
+	f.buf = append(f.buf[:0], f.salt...)
+	f.salt = nil
+
+	ad := f.bind.next()
+	if f.sealedLength {
+		return f.writeSealedFrame(payload, ad)
+	}
+
+	lenPos := len(f.buf)
+	f.buf = append(f.buf, 0, 0)
+	if f.stream != nil {
+		sealed, err := f.stream.Seal(f.buf, payload, ad)
+		if err != nil {
+			return err
+		}
+		f.buf = sealed
+	} else {
+		encrypted, err := f.cipher.EncryptWithAD(payload, ad)
+		if err != nil {
+			return err
+		}
+		f.buf = append(f.buf, encrypted...)
+	}
+	binary.BigEndian.PutUint16(f.buf[lenPos:], uint16(len(f.buf)-lenPos-2))
+
+	_, err := f.w.Write(f.buf)
+	return err
+}
+
+// addPadding 把 payload 编码为 payloadLen(2) | payload | padding。
+// 填充长度按策略随机选取，但不会让帧超出 16 位长度头的上限。
+func (f *frameWriter) addPadding(payload []byte) []byte {
+	padLen := f.policy.NextPadding()
+	if room := maxFramePlaintext - 2 - len(payload); padLen > room {
+		padLen = max(room, 0)
+	}
+	f.plain = binary.BigEndian.AppendUint16(f.plain[:0], uint16(len(payload)))
+	f.plain = append(f.plain, payload...)
+	// 填充内容会被加密，全 0 即可
+	f.plain = append(f.plain, make([]byte, padLen)...)
+	paddingTxBytes.Add(int64(padLen))
+	return f.plain
+}
+
+// writeSealedFrame 以 Seal(len) | Seal(payload) 的格式写出一帧，len 是数据块密文的长度
+func (f *frameWriter) writeSealedFrame(payload, ad []byte) error {
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(payload)+f.stream.Overhead()))
+	sealed, err := f.stream.Seal(f.buf, lenBuf[:], ad)
+	if err != nil {
+		return err
+	}
+	if sealed, err = f.stream.Seal(sealed, payload, ad); err != nil {
+		return err
+	}
+	f.buf = sealed
+
+	_, err = f.w.Write(f.buf)
+	return err
+}
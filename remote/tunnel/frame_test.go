@@ -0,0 +1,278 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+)
+
+// testFrameMeta 返回带有 flags 的元数据，按需填入 ReplayGuard 和上行盐
+func testFrameMeta(flags byte) *Metadata {
+	meta := &Metadata{Type: StreamTCP, Flags: flags}
+	rand.Read(meta.Guard.ID[:])
+	if flags&MetaFlagStreamKeys != 0 {
+		meta.UplinkSalt = make([]byte, securecrypt.StreamSaltSize)
+		rand.Read(meta.UplinkSalt)
+	}
+	return meta
+}
+
+// clientFrameWriter 按 meta 协商的格式构造客户端一侧的上行写入器
+func clientFrameWriter(t *testing.T, meta *Metadata, c securecrypt.Cipher, w io.Writer) *frameWriter {
+	t.Helper()
+	opts := frameOptionsFromMeta(meta)
+	fw := &frameWriter{w: w, cipher: c, policy: &auth.PaddingPolicy{}, padded: opts.padding, sealedLength: opts.sealedLength}
+	if opts.bindFrames {
+		fw.bind = newFrameBinding(frameDirUplink, meta.Guard.ID)
+	}
+	if opts.streamKeys {
+		stream, err := c.NewStream(meta.UplinkSalt)
+		if err != nil {
+			t.Fatalf("NewStream: %v", err)
+		}
+		fw.stream = stream
+	}
+	return fw
+}
+
+// clientFrameReader 按 meta 协商的格式构造客户端一侧的下行读取器，流式模式下先读出下行盐
+func clientFrameReader(t *testing.T, meta *Metadata, c securecrypt.Cipher, r io.Reader) *frameReader {
+	t.Helper()
+	opts := frameOptionsFromMeta(meta)
+	fr := &frameReader{r: r, cipher: c, padded: opts.padding}
+	if opts.bindFrames {
+		fr.bind = newFrameBinding(frameDirDownlink, meta.Guard.ID)
+	}
+	if opts.streamKeys {
+		salt := make([]byte, securecrypt.StreamSaltSize)
+		if _, err := io.ReadFull(r, salt); err != nil {
+			t.Fatalf("read downlink salt: %v", err)
+		}
+		stream, err := c.NewStream(salt)
+		if err != nil {
+			t.Fatalf("NewStream: %v", err)
+		}
+		fr.stream = stream
+		if opts.sealedLength {
+			fr.sealedLen = make([]byte, 2+stream.Overhead())
+		}
+	}
+	return fr
+}
+
+func testFrameCipher(t *testing.T) securecrypt.Cipher {
+	t.Helper()
+	c, err := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	if err != nil {
+		t.Fatalf("NewCipherWithKey: %v", err)
+	}
+	return c
+}
+
+func TestFrameCodec_StreamKeys(t *testing.T) {
+	c := testFrameCipher(t)
+	user := &auth.User{Name: "alice"}
+	meta := testFrameMeta(MetaFlagStreamKeys)
+
+	var uplink, downlink bytes.Buffer
+	fr, fw, err := newFrameCodec(meta, user, c, &uplink, &downlink)
+	if err != nil {
+		t.Fatalf("newFrameCodec: %v", err)
+	}
+
+	// 上行: 帧中不再携带 nonce，相同明文的两帧密文不同 (计数器递增)
+	cw := clientFrameWriter(t, meta, c, &uplink)
+	for range 2 {
+		if err := cw.WriteFrame([]byte("hello")); err != nil {
+			t.Fatalf("client WriteFrame: %v", err)
+		}
+	}
+	overhead := fr.stream.Overhead()
+	if uplink.Len() != 2*(2+len("hello")+overhead) {
+		t.Fatalf("uplink is %d bytes, want two frames of len(2) | ciphertext", uplink.Len())
+	}
+	wire := uplink.Bytes()
+	if bytes.Equal(wire[2:2+5+overhead], wire[2+5+overhead+2:]) {
+		t.Fatal("identical frames produced identical ciphertext")
+	}
+	for range 2 {
+		got, err := fr.ReadFrame()
+		if err != nil || string(got) != "hello" {
+			t.Fatalf("server ReadFrame = %q, %v", got, err)
+		}
+	}
+
+	// 下行: 盐随第一帧以明文发送，之后只有密文
+	fw.WriteFrame([]byte("first"))
+	fw.WriteFrame([]byte("second"))
+	if downlink.Len() != securecrypt.StreamSaltSize+2*(2+overhead)+len("first")+len("second") {
+		t.Fatalf("downlink is %d bytes, want salt followed by two frames", downlink.Len())
+	}
+	cr := clientFrameReader(t, meta, c, &downlink)
+	for _, want := range []string{"first", "second"} {
+		got, err := cr.ReadFrame()
+		if err != nil || string(got) != want {
+			t.Fatalf("client ReadFrame = %q, %v; want %q", got, err, want)
+		}
+	}
+}
+
+func TestFrameCodec_ShortNonceSuitesRequireStreamKeys(t *testing.T) {
+	user := &auth.User{Name: "alice"}
+	for _, suite := range securecrypt.Suites() {
+		c, _ := securecrypt.NewCipherWithKey(suite, securecrypt.DeriveKey("alice", "pw"))
+		_, _, err := newFrameCodec(testFrameMeta(0), user, c, nil, io.Discard)
+		if short := securecrypt.HasShortNonce(suite); (err != nil) != short {
+			t.Errorf("%s: random-nonce frames err = %v, want rejected=%v", suite, err, short)
+		}
+		if _, _, err := newFrameCodec(testFrameMeta(MetaFlagStreamKeys), user, c, nil, io.Discard); err != nil {
+			t.Errorf("%s: stream frames: %v", suite, err)
+		}
+	}
+}
+
+func TestFrameCodec_BindFramesRejectsMovedFrames(t *testing.T) {
+	c := testFrameCipher(t)
+	user := &auth.User{Name: "alice"}
+	flags := MetaFlagReplayGuard | MetaFlagBindFrames
+
+	// serverReader 为 meta 创建服务端的上行读取器，读取 wire 中的内容
+	serverReader := func(meta *Metadata, wire []byte) *frameReader {
+		fr, _, err := newFrameCodec(meta, user, c, bytes.NewReader(wire), io.Discard)
+		if err != nil {
+			t.Fatalf("newFrameCodec: %v", err)
+		}
+		return fr
+	}
+	clientFrames := func(meta *Metadata, payloads ...string) [][]byte {
+		var frames [][]byte
+		for _, p := range payloads {
+			var buf bytes.Buffer
+			cw := clientFrameWriter(t, meta, c, &buf)
+			cw.bind.seq = uint64(len(frames))
+			if err := cw.WriteFrame([]byte(p)); err != nil {
+				t.Fatalf("client WriteFrame: %v", err)
+			}
+			frames = append(frames, buf.Bytes())
+		}
+		return frames
+	}
+
+	meta := testFrameMeta(flags)
+	frames := clientFrames(meta, "one", "two")
+	fr := serverReader(meta, bytes.Join(frames, nil))
+	for _, want := range []string{"one", "two"} {
+		if got, err := fr.ReadFrame(); err != nil || string(got) != want {
+			t.Fatalf("ReadFrame = %q, %v; want %q", got, err, want)
+		}
+	}
+
+	// 重排
+	if _, err := serverReader(meta, append(frames[1], frames[0]...)).ReadFrame(); err == nil {
+		t.Fatal("a reordered frame was accepted")
+	}
+
+	// 反射: 服务端自己写出的下行帧被送回上行
+	var downlink bytes.Buffer
+	_, fw, _ := newFrameCodec(meta, user, c, nil, &downlink)
+	fw.WriteFrame([]byte("one"))
+	if _, err := serverReader(meta, downlink.Bytes()).ReadFrame(); err == nil {
+		t.Fatal("a reflected downlink frame was accepted as uplink")
+	}
+
+	// 拼接: 同一密钥下另一个流的帧
+	other := testFrameMeta(flags)
+	if _, err := serverReader(meta, clientFrames(other, "one")[0]).ReadFrame(); err == nil {
+		t.Fatal("a frame from another stream was accepted")
+	}
+}
+
+func TestFrameCodec_SealedLength(t *testing.T) {
+	c := testFrameCipher(t)
+	user := &auth.User{Name: "alice"}
+	meta := testFrameMeta(MetaFlagStreamKeys | MetaFlagSealedLength)
+
+	var uplink, downlink bytes.Buffer
+	fr, fw, err := newFrameCodec(meta, user, c, &uplink, &downlink)
+	if err != nil {
+		t.Fatalf("newFrameCodec: %v", err)
+	}
+	overhead := fr.stream.Overhead()
+
+	// 线路上是 Seal(len) | Seal(payload)，不出现明文长度
+	payload := bytes.Repeat([]byte("x"), 300)
+	cw := clientFrameWriter(t, meta, c, &uplink)
+	if err := cw.WriteFrame(payload); err != nil {
+		t.Fatalf("client WriteFrame: %v", err)
+	}
+	wire := append([]byte(nil), uplink.Bytes()...)
+	if len(wire) != 2+overhead+len(payload)+overhead {
+		t.Fatalf("uplink frame is %d bytes, want %d", len(wire), 2+overhead+len(payload)+overhead)
+	}
+	if plainLen := []byte{byte((len(payload) + overhead) >> 8), byte(len(payload) + overhead)}; bytes.Equal(wire[:2], plainLen) {
+		t.Fatal("the length header is sent in the clear")
+	}
+	if got, err := fr.ReadFrame(); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("server ReadFrame = %d bytes, %v", len(got), err)
+	}
+
+	fw.WriteFrame([]byte("reply"))
+	cr := clientFrameReader(t, meta, c, &downlink)
+	if got, err := cr.ReadFrame(); err != nil || string(got) != "reply" {
+		t.Fatalf("client ReadFrame = %q, %v", got, err)
+	}
+
+	// 篡改长度块会在读取数据块之前失败
+	tampered := clientFrameWriter(t, meta, c, &uplink)
+	uplink.Reset()
+	tampered.WriteFrame(payload)
+	uplink.Bytes()[0] ^= 0x01
+	fr2, _, _ := newFrameCodec(meta, user, c, &uplink, io.Discard)
+	if _, err := fr2.ReadFrame(); err == nil {
+		t.Fatal("a tampered length header was accepted")
+	}
+
+	// 加密长度头为 0 的帧不能用作保活
+	zero, _ := c.NewStream(meta.UplinkSalt)
+	sealedZero, _ := zero.Seal(nil, []byte{0, 0}, nil)
+	fr3, _, _ := newFrameCodec(meta, user, c, bytes.NewReader(sealedZero), io.Discard)
+	if _, err := fr3.ReadFrame(); err == nil {
+		t.Fatal("a zero sealed length was accepted")
+	}
+}
+
+func TestFrameCodec_ShapingOnlyWhenRequested(t *testing.T) {
+	c := testFrameCipher(t)
+	user := &auth.User{Name: "alice", Padding: auth.PaddingPolicy{Frame: auth.Range{Min: 100, Max: 100}, Jitter: auth.Range{Min: 200, Max: 200}}}
+
+	for _, shaped := range []bool{false, true} {
+		var flags byte
+		if shaped {
+			flags = MetaFlagPadding
+		}
+		meta := testFrameMeta(flags)
+		var downlink bytes.Buffer
+		_, fw, err := newFrameCodec(meta, user, c, nil, &downlink)
+		if err != nil {
+			t.Fatalf("newFrameCodec: %v", err)
+		}
+		start := time.Now()
+		fw.WriteFrame([]byte("hello"))
+		elapsed := time.Since(start)
+
+		if delayed := elapsed >= 200*time.Millisecond; delayed != shaped {
+			t.Errorf("shaped=%v: WriteFrame took %s", shaped, elapsed)
+		}
+		if padded := downlink.Len() > 100; padded != shaped {
+			t.Errorf("shaped=%v: downlink frame is %d bytes", shaped, downlink.Len())
+		}
+		if got, err := clientFrameReader(t, meta, c, &downlink).ReadFrame(); err != nil || string(got) != "hello" {
+			t.Errorf("shaped=%v: client ReadFrame = %q, %v", shaped, got, err)
+		}
+	}
+}
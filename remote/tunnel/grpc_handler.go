@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"liuproxy_remote/remote/shared"
+)
+
+// gRPC 传输与常见的 "gun" 隧道服务兼容: 客户端调用 /<服务名>/Tun (或 /<服务名>/TunMulti) 双向流方法，
+// 两个方向的消息都是 Hunk (bytes data = 1)，数据拼接起来就是一条 Mux 会话的字节流。
+// 它运行在 HTTP/2 上，既可以是 TLS 终结代理 (如 nginx grpc_pass、CDN) 转发来的明文 h2c，
+// 也可以是内置 TLS 上通过 ALPN 协商的 h2。
+
+// gRPC 状态码，见 https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcStatusOK                = "0"
+	grpcStatusResourceExhausted = "8"
+	grpcStatusUnimplemented     = "12"
+	grpcStatusInternal          = "13"
+	grpcStatusUnauthenticated   = "16"
+)
+
+// peerAddrKey 是请求上下文中保存底层连接 RemoteAddr (可能附带证书身份) 的键
+type peerAddrKey struct{}
+
+// withPeerAddr 供 http.Server.ConnContext 使用，把连接的 RemoteAddr 存入上下文
+func withPeerAddr(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, peerAddrKey{}, conn.RemoteAddr())
+}
+
+// requestRemoteAddr 返回请求的客户端地址: 优先使用转发头给出的真实地址，并保留底层连接的证书身份
+func requestRemoteAddr(r *http.Request) net.Addr {
+	peer, _ := r.Context().Value(peerAddrKey{}).(net.Addr)
+	if addr := clientAddr(r); addr != nil {
+		return &PeerAddr{Addr: addr, Identity: peerIdentity(peer)}
+	}
+	return peer
+}
+
+// grpcMethods 返回 grpc_service 对应的方法路径集合，未配置时返回 nil
+func grpcMethods(service string) map[string]bool {
+	service = strings.Trim(strings.TrimSpace(service), "/")
+	if service == "" {
+		return nil
+	}
+	return map[string]bool{"/" + service + "/Tun": true, "/" + service + "/TunMulti": true}
+}
+
+// isGRPCRequest 报告 r 是否是 gRPC 调用
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodPost &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// serveGRPC 在一个 gRPC 双向流上运行 Mux 会话。
+// 认证方式与 WebSocket 相同: Authorization: Bearer <令牌> (gRPC 元数据 authorization)。
+func serveGRPC(w http.ResponseWriter, r *http.Request, in *Inbound) {
+	w.Header().Set("Content-Type", "application/grpc")
+	owner, _, err := in.authenticateUpgrade(r)
+	if err != nil {
+		log.Printf("[REMOTE-GRPC] Rejected call from %s: %v", r.RemoteAddr, err)
+		// 只有头部的响应，状态放在头部中
+		w.Header().Set("Grpc-Status", grpcStatusUnauthenticated)
+		w.Header().Set("Grpc-Message", encodeGRPCMessage(err.Error()))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		log.Printf("[REMOTE-GRPC] Failed to send response headers to %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	conn := shared.NewGRPCConnAdapter(w, r, local, requestRemoteAddr(r))
+	if owner != nil {
+		log.Printf("[REMOTE-GRPC] [%s] gRPC stream established from %s", owner, conn.RemoteAddr())
+	} else {
+		log.Printf("[REMOTE-GRPC] gRPC stream established from %s", conn.RemoteAddr())
+	}
+	transportErr := serveMuxTransport(conn, in, owner, "[REMOTE-GRPC]")
+	conn.Close()
+
+	status, err := grpcStatus(conn.Err(), transportErr)
+	w.Header().Set("Grpc-Status", status)
+	if err != nil {
+		w.Header().Set("Grpc-Message", encodeGRPCMessage(err.Error()))
+	}
+}
+
+// grpcStatus 根据会话结束的原因确定 trailer 中的状态码。
+// readErr 是请求流中的协议错误，transportErr 是握手等认证错误，两者都为 nil 时会话正常结束。
+func grpcStatus(readErr, transportErr error) (string, error) {
+	switch {
+	case errors.Is(readErr, shared.ErrGRPCCompressed):
+		return grpcStatusUnimplemented, readErr
+	case errors.Is(readErr, shared.ErrGRPCTooLarge):
+		return grpcStatusResourceExhausted, readErr
+	case readErr != nil:
+		return grpcStatusInternal, readErr
+	case transportErr != nil:
+		return grpcStatusUnauthenticated, transportErr
+	}
+	return grpcStatusOK, nil
+}
+
+// encodeGRPCMessage 按 gRPC 规范对 grpc-message 做百分号编码:
+// 0x20-0x7E 之间除 '%' 以外的字节原样保留，其余字节 (包括 UTF-8 多字节字符) 编码为 %XX
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= 0x20 && c <= 0x7E && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
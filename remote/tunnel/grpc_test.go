@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	cases := map[string]string{
+		"invalid token":       "invalid token",
+		"100% done":           "100%25 done",
+		"user 'ä'":            "user '%C3%A4'",
+		"line\nbreak":         "line%0Abreak",
+		"tilde ~ stays as-is": "tilde ~ stays as-is",
+	}
+	for in, want := range cases {
+		if got := encodeGRPCMessage(in); got != want {
+			t.Errorf("encodeGRPCMessage(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// serveTestGRPC 用 body 作为请求流调用 serveGRPC，返回响应
+func serveTestGRPC(t *testing.T, body []byte, header http.Header) *http.Response {
+	t.Helper()
+	in, _ := testInbound(t)
+	r := httptest.NewRequest(http.MethodPost, "/svc/Tun", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/grpc")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	serveGRPC(w, r, in)
+	return w.Result()
+}
+
+func TestServeGRPC_Status(t *testing.T) {
+	// 会话以协议错误结束时 trailer 中不是 OK
+	compressed := []byte{1, 0, 0, 0, 3, 0x0A, 1, 'x'}
+	resp := serveTestGRPC(t, compressed, nil)
+	if got := resp.Trailer.Get("Grpc-Status"); got != grpcStatusUnimplemented {
+		t.Errorf("compressed message: trailer grpc-status = %q, want %q", got, grpcStatusUnimplemented)
+	}
+
+	// 握手失败
+	hello := []byte{handshakeMagic[0], handshakeMagic[1], handshakeModeMux, kexX25519, 0, 32}
+	hello = append(hello, make([]byte, 32)...)
+	msg := binary.AppendUvarint([]byte{0x0A}, uint64(len(hello)))
+	msg = append(msg, hello...)
+	resp = serveTestGRPC(t, append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...), nil)
+	if got := resp.Trailer.Get("Grpc-Status"); got != grpcStatusUnauthenticated {
+		t.Errorf("failed handshake: trailer grpc-status = %q, want %q", got, grpcStatusUnauthenticated)
+	}
+	if resp.Trailer.Get("Grpc-Message") == "" {
+		t.Error("failed handshake: no grpc-message in the trailer")
+	}
+
+	// 请求流正常结束
+	resp = serveTestGRPC(t, nil, nil)
+	if got := resp.Trailer.Get("Grpc-Status"); got != grpcStatusOK {
+		t.Errorf("empty stream: trailer grpc-status = %q, want %q", got, grpcStatusOK)
+	}
+
+	// 令牌无效时只有头部
+	resp = serveTestGRPC(t, nil, http.Header{"Authorization": {"Bearer nope"}})
+	if got := resp.Header.Get("Grpc-Status"); got != grpcStatusUnauthenticated {
+		t.Errorf("invalid token: grpc-status = %q, want %q", got, grpcStatusUnauthenticated)
+	}
+}
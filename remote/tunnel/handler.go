@@ -2,15 +2,90 @@ package tunnel
 
 import (
 	"bufio"
+	"fmt"
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/clientip"
+	"liuproxy_remote/remote/core/securecrypt"
 	"liuproxy_remote/remote/types"
 	"net"
+	"net/http"
 )
 
+// Inbound 汇总了所有入站处理器共享的配置和运行时状态。
+// 它由 server 在启动时创建一次，之后被所有连接共享。
+type Inbound struct {
+	Cfg   *types.Config
+	Users *auth.Registry
+	// Replay 记录流元数据和握手的防重放 ID，DatagramReplay 记录 UDP 数据报的防重放 ID (为 nil 时与 Replay 共用)
+	Replay         *auth.ReplayCache
+	DatagramReplay *auth.ReplayCache
+	// HTTP 处理以 HTTP 请求开头的连接 (WebSocket 隧道和伪装站点)，见 NewHTTPHandler
+	HTTP http.Handler
+	// ClientIP 是真实客户端地址 (转发头) 和 IP 访问控制策略，为 nil 时不做这些处理
+	ClientIP *clientip.Policy
+	// Modes 是所属监听器允许的入站模式，0 表示全部
+	Modes Modes
+}
+
+// Allows 报告所属监听器是否允许 mode
+func (in *Inbound) Allows(mode Modes) bool {
+	return in.Modes == 0 || in.Modes.Has(mode)
+}
+
+// checkClientIP 按 allow_ips/deny_ips 检查客户端地址
+func (in *Inbound) checkClientIP(addr net.Addr) error {
+	if in.ClientIP == nil {
+		return nil
+	}
+	return in.ClientIP.Check(addr)
+}
+
 // HandleTCPConnection 是 remote 端处理新连接的唯一入口。
-func HandleTCPConnection(inboundConn net.Conn, reader *bufio.Reader, cfg *types.Config) {
+func HandleTCPConnection(inboundConn net.Conn, reader *bufio.Reader, in *Inbound) {
 	defer inboundConn.Close()
 	//log.Printf("[REMOTE-TCP-DIAG] Accepted new connection from %s", inboundConn.RemoteAddr())
 
 	// 将连接和 reader 传递给 tcp_handler.go 中的处理器
-	handleTCPStream(inboundConn, reader, cfg)
+	handleTCPStream(inboundConn, reader, in, nil)
+}
+
+// openMetadata 解密一个流的元数据包，并确定流所属的用户和后续帧使用的加密器。
+// 经过握手的会话 (sess 不为 nil) 直接使用会话密钥；
+// 否则依次尝试各用户的长期密钥，hint 是同一会话中上一次识别出的用户。
+func (in *Inbound) openMetadata(encrypted []byte, sess *sessionAuth, hint *auth.User, peer net.Addr) (*auth.User, securecrypt.Cipher, []byte, error) {
+	if sess != nil {
+		plaintext, err := sess.cipher.Decrypt(encrypted)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return sess.user, sess.cipher, plaintext, nil
+	}
+
+	if in.Cfg.RemoteConf.RequireHandshake {
+		return nil, nil, nil, errHandshakeRequired
+	}
+	user, key, plaintext, err := in.Users.Identify(encrypted, hint, peer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkSecurityLevel(user, nil); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkPeerAccess(user, peer); err != nil {
+		return nil, nil, nil, err
+	}
+	return user, key.Cipher, plaintext, nil
+}
+
+// checkPeerAccess 确认连接的客户端证书身份满足用户的 certs 限制。
+// 没有客户端证书的连接 (包括 UDP) 只能使用未设置 certs 的用户。
+func checkPeerAccess(user *auth.User, peer net.Addr) error {
+	identity := peerIdentity(peer)
+	if user.AllowsIdentity(identity) {
+		return nil
+	}
+	if identity == "" {
+		return fmt.Errorf("user '%s' requires a client certificate", user)
+	}
+	return fmt.Errorf("client certificate '%s' is not allowed for user '%s'", identity, user)
 }
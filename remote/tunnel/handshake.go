@@ -0,0 +1,286 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/stats"
+)
+
+// 可选的会话握手 (v3)。
+//
+// 客户端在 Multi-Conn 连接、原始 Mux 会话或 WebSocket 会话的最开始发送 ClientHello:
+//
+//	magic(2) | mode(1) | kex(1) | len(2) | Seal_长期密钥( magic|mode|kex | ReplayGuard | 客户端临时公钥 )
+//
+// 服务端用各用户的长期密钥试解密来认证客户端并确定用户，然后回复 ServerHello:
+//
+//	len(2) | Seal_长期密钥( 服务端临时公钥 | SHA-256(ClientHello 密文) )
+//
+// 双方用临时密钥协商出的共享秘密派生会话密钥，之后的元数据和数据帧都改用会话密钥加密，
+// 长期密钥泄露也无法解密已录制的流量 (前向安全)。
+// 旧客户端不会发送魔数，因此不受影响；服务端可用 require_handshake 拒绝它们。
+//
+// 密钥交换 (kex) 决定临时公钥部分的内容:
+//   - kexX25519: 客户端 X25519 公钥(32) / 服务端 X25519 公钥(32)
+//   - kexHybridMLKEM768: 客户端 X25519 公钥(32) + ML-KEM-768 封装公钥(1184) /
+//     服务端 X25519 公钥(32) + ML-KEM-768 密文(1088)，两个共享秘密一起输入 HKDF，
+//     只要其中任意一个未被攻破，会话密钥就是安全的。
+var handshakeMagic = [2]byte{0xFF, 0x48}
+
+// 握手之后连接上承载的内容
+const (
+	handshakeModeStream byte = 0x01 // 一个 Multi-Conn 流
+	handshakeModeMux    byte = 0x02 // 一个 smux 会话
+)
+
+// 密钥交换算法
+const (
+	kexX25519         byte = 0x01
+	kexHybridMLKEM768 byte = 0x02
+)
+
+// kexNames 用于日志和统计
+var kexNames = map[byte]string{
+	kexX25519:         "x25519",
+	kexHybridMLKEM768: "x25519_mlkem768",
+}
+
+// kexLevels 是每种密钥交换提供的安全级别
+var kexLevels = map[byte]auth.SecurityLevel{
+	kexX25519:         auth.SecurityPFS,
+	kexHybridMLKEM768: auth.SecurityPQ,
+}
+
+// handshakeTimeout 限制握手阶段的总时长
+const handshakeTimeout = 10 * time.Second
+
+var (
+	errHandshakeRequired = errors.New("session handshake required but client sent a legacy request")
+	errHandshakeHeader   = errors.New("sealed handshake header does not match")
+
+	handshakeFailed = stats.Get("handshake_failed")
+)
+
+// sessionAuth 是握手完成后确定下来的用户和会话加密器。
+// 它在整个连接 (或整个 mux 会话) 内有效，流不再需要逐个试解密。
+type sessionAuth struct {
+	user   *auth.User
+	key    *securecrypt.Key // 认证握手的长期密钥
+	cipher securecrypt.Cipher
+	level  auth.SecurityLevel
+}
+
+// checkSecurityLevel 确认一个流达到了其用户要求的最低安全级别。
+// sess 为 nil 表示未经握手的流，其安全级别为 standard。
+func checkSecurityLevel(user *auth.User, sess *sessionAuth) error {
+	level := auth.SecurityStandard
+	if sess != nil {
+		level = sess.level
+	}
+	if level < user.Security {
+		return fmt.Errorf("user '%s' requires security level '%s', got '%s'", user, user.Security, level)
+	}
+	return nil
+}
+
+// kexResult 是服务端一次密钥交换的结果
+type kexResult struct {
+	reply      []byte   // 写入 ServerHello 的公开参数
+	secrets    [][]byte // 按顺序输入 HKDF 的共享秘密
+	transcript []byte   // 双方的公开参数，用作 HKDF 盐
+}
+
+// serverKeyExchange 从 ClientHello 的剩余部分读取客户端的公开参数，完成服务端一侧的密钥交换。
+func serverKeyExchange(kex byte, r io.Reader) (*kexResult, error) {
+	clientPub := make([]byte, securecrypt.X25519PublicKeySize)
+	if _, err := io.ReadFull(r, clientPub); err != nil {
+		return nil, fmt.Errorf("failed to read client X25519 public key: %w", err)
+	}
+	priv, err := securecrypt.GenerateX25519()
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := securecrypt.X25519SharedSecret(priv, clientPub)
+	if err != nil {
+		return nil, err
+	}
+	serverPub := priv.PublicKey().Bytes()
+
+	switch kex {
+	case kexX25519:
+		return &kexResult{
+			reply:      serverPub,
+			secrets:    [][]byte{ecdhSecret},
+			transcript: concatBytes(clientPub, serverPub),
+		}, nil
+
+	case kexHybridMLKEM768:
+		encapKey := make([]byte, securecrypt.MLKEM768EncapsulationKeySize)
+		if _, err := io.ReadFull(r, encapKey); err != nil {
+			return nil, fmt.Errorf("failed to read client ML-KEM-768 encapsulation key: %w", err)
+		}
+		kemSecret, kemCiphertext, err := securecrypt.MLKEM768Encapsulate(encapKey)
+		if err != nil {
+			return nil, err
+		}
+		return &kexResult{
+			reply:      concatBytes(serverPub, kemCiphertext),
+			secrets:    [][]byte{ecdhSecret, kemSecret},
+			transcript: concatBytes(clientPub, encapKey, serverPub, kemCiphertext),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key exchange 0x%02x", kex)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// IsHandshake 报告连接开头的 2 个字节是否为握手魔数
+func IsHandshake(header []byte) bool {
+	return len(header) >= 2 && header[0] == handshakeMagic[0] && header[1] == handshakeMagic[1]
+}
+
+// HandleHandshakeConnection 处理以握手魔数开头的原始 TCP 连接，
+// 握手完成后按 ClientHello 中的 mode 交给 Multi-Conn 或 Mux 处理器。
+// 在回复 ServerHello 之前失败的握手 (例如只是以魔数开头的探测) 会连同已读出的字节一起转交给回落地址。
+func HandleHandshakeConnection(conn net.Conn, reader *bufio.Reader, in *Inbound) {
+	defer conn.Close()
+
+	rec := &recordingReader{r: reader}
+	replied := &writeTracker{Conn: conn}
+	sess, mode, err := serverHandshake(replied, rec, in)
+	if err != nil {
+		log.Printf("[REMOTE-HANDSHAKE] Handshake with %s failed: %v", conn.RemoteAddr(), err)
+		if !replied.wrote {
+			in.fallback(conn, reader, rec.data, err)
+		}
+		return
+	}
+
+	// 握手之后才知道连接承载的是 Multi-Conn 流还是 Mux 会话，监听器的模式限制在这里检查
+	switch {
+	case mode == handshakeModeStream && in.Allows(ModeMultiConn):
+		handleTCPStream(conn, reader, in, sess)
+	case mode == handshakeModeMux && in.Allows(ModeMux):
+		serveMuxSession(conn, reader, in, sess, nil)
+	default:
+		log.Printf("[REMOTE-HANDSHAKE] [%s] Mode 0x%02x requested by %s is not enabled on this listener.", sess.user, mode, conn.RemoteAddr())
+	}
+}
+
+// serverHandshake 在 rw 上完成一次服务端握手，返回会话认证信息和客户端请求的模式。
+// 每种密钥交换的成功次数、握手字节数和服务端处理耗时都会计入统计，
+// 便于评估后量子握手带来的额外开销。
+func serverHandshake(rw net.Conn, reader io.Reader, in *Inbound) (*sessionAuth, byte, error) {
+	rw.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer rw.SetDeadline(time.Time{})
+
+	start := time.Now()
+	sess, kex, mode, wireBytes, err := doServerHandshake(rw, reader, in)
+	if err != nil {
+		handshakeFailed.Add(1)
+		return nil, 0, err
+	}
+	name := kexNames[kex]
+	stats.Get("handshake_" + name + "_ok").Add(1)
+	stats.Get("handshake_" + name + "_bytes").Add(int64(wireBytes))
+	stats.Get("handshake_" + name + "_server_us").Add(time.Since(start).Microseconds())
+	return sess, mode, nil
+}
+
+// doServerHandshake 返回会话认证信息、密钥交换类型、模式，以及握手在线路上的总字节数。
+func doServerHandshake(rw net.Conn, reader io.Reader, in *Inbound) (*sessionAuth, byte, byte, int, error) {
+	fail := func(err error) (*sessionAuth, byte, byte, int, error) { return nil, 0, 0, 0, err }
+
+	// 1. 读取 ClientHello
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fail(fmt.Errorf("failed to read client hello header: %w", err))
+	}
+	if !IsHandshake(header) {
+		return fail(errors.New("bad handshake magic"))
+	}
+	mode, kex := header[2], header[3]
+	if mode != handshakeModeStream && mode != handshakeModeMux {
+		return fail(fmt.Errorf("unsupported handshake mode 0x%02x", mode))
+	}
+	if _, ok := kexNames[kex]; !ok {
+		return fail(fmt.Errorf("unsupported key exchange 0x%02x", kex))
+	}
+	sealedHello := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if _, err := io.ReadFull(reader, sealedHello); err != nil {
+		return fail(fmt.Errorf("failed to read client hello: %w", err))
+	}
+
+	// 2. 试解密以认证客户端，并校验被密封的头部、防重放字段和用户要求的安全级别
+	user, key, hello, err := in.Users.Identify(sealedHello, nil, rw.RemoteAddr())
+	if err != nil {
+		return fail(err)
+	}
+	helloReader := bytes.NewReader(hello)
+	sealedHeader := make([]byte, 4)
+	if _, err := io.ReadFull(helloReader, sealedHeader); err != nil || !bytes.Equal(sealedHeader, header[:4]) {
+		return fail(errHandshakeHeader)
+	}
+	guard, err := readReplayGuard(helloReader)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read replay guard: %w", err))
+	}
+	if err := in.checkReplay(user, true, guard); err != nil {
+		return fail(fmt.Errorf("user '%s': %w", user, err))
+	}
+	sess := &sessionAuth{user: user, key: key, level: kexLevels[kex]}
+	if err := checkSecurityLevel(user, sess); err != nil {
+		return fail(err)
+	}
+	if err := checkPeerAccess(user, rw.RemoteAddr()); err != nil {
+		return fail(err)
+	}
+
+	// 3. 完成密钥交换
+	result, err := serverKeyExchange(kex, helloReader)
+	if err != nil {
+		return fail(fmt.Errorf("user '%s': %w", user, err))
+	}
+
+	// 4. 回复 ServerHello，其中包含 ClientHello 的哈希，使客户端可以确认回复对应自己的请求
+	helloHash := sha256.Sum256(sealedHello)
+	sealedReply, err := key.Cipher.Encrypt(concatBytes(result.reply, helloHash[:]))
+	if err != nil {
+		return fail(fmt.Errorf("failed to seal server hello: %w", err))
+	}
+	replyBuf := make([]byte, 2, 2+len(sealedReply))
+	binary.BigEndian.PutUint16(replyBuf, uint16(len(sealedReply)))
+	if _, err := rw.Write(append(replyBuf, sealedReply...)); err != nil {
+		return fail(fmt.Errorf("failed to write server hello: %w", err))
+	}
+
+	// 5. 派生会话密钥，沿用长期密钥的加密套件
+	sessionKey, err := securecrypt.DeriveSessionKey(concatBytes(header[:4], result.transcript), result.secrets...)
+	if err != nil {
+		return fail(err)
+	}
+	sess.cipher, err = securecrypt.NewCipherWithKey(key.Cipher.Suite(), sessionKey)
+	if err != nil {
+		return fail(err)
+	}
+
+	wireBytes := len(header) + len(sealedHello) + len(replyBuf) + len(sealedReply)
+	return sess, kex, mode, wireBytes, nil
+}
@@ -0,0 +1,292 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/stats"
+	"liuproxy_remote/remote/types"
+)
+
+// handshakeInbound 返回有三个用户的入站配置: alice (standard)、carol (pfs) 和 dave (pq)，
+// 以及用户名到长期密钥加密器的映射
+func handshakeInbound(t *testing.T) (*Inbound, map[string]securecrypt.Cipher) {
+	t.Helper()
+	cfg := &types.Config{}
+	cfg.BufferSize = 4096
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}},
+		{Name: "carol", Keys: []types.KeyConf{{Generation: 1, Secret: "pw3"}}, Security: "pfs"},
+		{Name: "dave", Keys: []types.KeyConf{{Generation: 1, Secret: "pw4"}}, Security: "pq"},
+	}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	ciphers := make(map[string]securecrypt.Cipher)
+	for _, u := range cfg.Users {
+		ciphers[u.Name], _ = securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey(u.Name, u.Keys[0].Secret))
+	}
+	return &Inbound{Cfg: cfg, Users: users, Replay: auth.NewReplayCache(time.Minute, 16)}, ciphers
+}
+
+// clientHandshake 是测试用的客户端握手: 发送 ClientHello，校验 ServerHello 确实是对这个 ClientHello 的回复，
+// 然后与服务端一样派生会话密钥。返回会话加密器和握手在线路上的字节数。
+func clientHandshake(conn io.ReadWriter, longTerm securecrypt.Cipher, mode, kex byte) (securecrypt.Cipher, int, error) {
+	priv, err := securecrypt.GenerateX25519()
+	if err != nil {
+		return nil, 0, err
+	}
+	public := priv.PublicKey().Bytes()
+	var dk *mlkem.DecapsulationKey768
+	if kex == kexHybridMLKEM768 {
+		if dk, err = mlkem.GenerateKey768(); err != nil {
+			return nil, 0, err
+		}
+		public = append(public, dk.EncapsulationKey().Bytes()...)
+	}
+
+	header := []byte{handshakeMagic[0], handshakeMagic[1], mode, kex}
+	hello := binary.BigEndian.AppendUint64(append([]byte{}, header...), uint64(time.Now().Unix()))
+	id := make([]byte, auth.ReplayIDSize)
+	rand.Read(id)
+	hello = append(append(hello, id...), public...)
+	sealedHello, err := longTerm.Encrypt(hello)
+	if err != nil {
+		return nil, 0, err
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(sealedHello)))
+	if _, err := conn.Write(append(header, sealedHello...)); err != nil {
+		return nil, 0, err
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, 0, err
+	}
+	sealedReply := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, sealedReply); err != nil {
+		return nil, 0, err
+	}
+	reply, err := longTerm.Decrypt(sealedReply)
+	if err != nil {
+		return nil, 0, err
+	}
+	serverParams, helloHash := reply[:len(reply)-sha256.Size], reply[len(reply)-sha256.Size:]
+	if want := sha256.Sum256(sealedHello); !bytes.Equal(helloHash, want[:]) {
+		return nil, 0, errors.New("server hello does not answer this client hello")
+	}
+
+	ecdhSecret, err := securecrypt.X25519SharedSecret(priv, serverParams[:securecrypt.X25519PublicKeySize])
+	if err != nil {
+		return nil, 0, err
+	}
+	secrets := [][]byte{ecdhSecret}
+	if dk != nil {
+		kemSecret, err := dk.Decapsulate(serverParams[securecrypt.X25519PublicKeySize:])
+		if err != nil {
+			return nil, 0, err
+		}
+		secrets = append(secrets, kemSecret)
+	}
+	sessionKey, err := securecrypt.DeriveSessionKey(concatBytes(header[:4], public, serverParams), secrets...)
+	if err != nil {
+		return nil, 0, err
+	}
+	session, err := securecrypt.NewCipherWithKey(longTerm.Suite(), sessionKey)
+	return session, len(header) + len(sealedHello) + len(lenBuf) + len(sealedReply), err
+}
+
+// tcpEchoTarget 启动一个原样回复的 TCP 目标，返回发往它的元数据
+func tcpEchoTarget(t *testing.T) []byte {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	target := l.Addr().(*net.TCPAddr)
+	meta := append([]byte{StreamTCP, AddrTypeIPv4}, target.IP.To4()...)
+	return binary.BigEndian.AppendUint16(meta, uint16(target.Port))
+}
+
+// expectEcho 通过 c 加密的流发送元数据和一帧数据，确认收到了同样用 c 加密的回显
+func expectEcho(t *testing.T, rw io.ReadWriter, c securecrypt.Cipher, meta []byte, msg string) {
+	t.Helper()
+	writeTestFrame(t, rw, c, meta)
+	writeTestFrame(t, rw, c, []byte(msg))
+	if got := readTestFrame(t, rw, c); string(got) != msg {
+		t.Fatalf("echo = %q, want %q", got, msg)
+	}
+}
+
+// expectClosed 确认服务端没有回复就关闭了连接
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("server replied (%d bytes, %v), want the connection closed", n, err)
+	}
+}
+
+func TestHandshake_StreamMode(t *testing.T) {
+	in, ciphers := handshakeInbound(t)
+	meta := tcpEchoTarget(t)
+
+	for _, kex := range []byte{kexX25519, kexHybridMLKEM768} {
+		name := kexNames[kex]
+		ok, bytesCounter := stats.Get("handshake_"+name+"_ok"), stats.Get("handshake_"+name+"_bytes")
+		okBefore, bytesBefore := ok.Value(), bytesCounter.Value()
+
+		client, server := net.Pipe()
+		go HandleHandshakeConnection(server, bufio.NewReader(server), in)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		session, wireBytes, err := clientHandshake(client, ciphers["alice"], handshakeModeStream, kex)
+		if err != nil {
+			t.Fatalf("%s: handshake: %v", name, err)
+		}
+
+		// 握手之后元数据和数据帧都使用会话密钥，长期密钥不再能解开回复
+		expectEcho(t, client, session, meta, "after "+name)
+		writeTestFrame(t, client, session, []byte("second frame"))
+		lenBuf := make([]byte, 2)
+		io.ReadFull(client, lenBuf)
+		frame := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		io.ReadFull(client, frame)
+		if _, err := ciphers["alice"].Decrypt(frame); err == nil {
+			t.Fatalf("%s: a frame after the handshake opened with the long-term key", name)
+		}
+		client.Close()
+
+		if got := ok.Value() - okBefore; got != 1 {
+			t.Errorf("%s: handshake_%s_ok grew by %d, want 1", name, name, got)
+		}
+		if got := bytesCounter.Value() - bytesBefore; got != int64(wireBytes) {
+			t.Errorf("%s: handshake_%s_bytes grew by %d, want %d", name, name, got, wireBytes)
+		}
+	}
+}
+
+func TestHandshake_MuxMode(t *testing.T) {
+	in, ciphers := handshakeInbound(t)
+	meta := tcpEchoTarget(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleHandshakeConnection(server, bufio.NewReader(server), in)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	session, _, err := clientHandshake(client, ciphers["alice"], handshakeModeMux, kexX25519)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	client.SetDeadline(time.Time{})
+
+	// 握手之后连接承载一个 smux 会话，其中每个流都使用会话密钥
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 2
+	mux, err := smux.Client(client, smuxConfig)
+	if err != nil {
+		t.Fatalf("smux.Client: %v", err)
+	}
+	defer mux.Close()
+	for _, msg := range []string{"first stream", "second stream"} {
+		stream, err := mux.OpenStream()
+		if err != nil {
+			t.Fatalf("OpenStream: %v", err)
+		}
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		expectEcho(t, stream, session, meta, msg)
+		stream.Close()
+	}
+}
+
+func TestHandshake_SecurityLevels(t *testing.T) {
+	in, ciphers := handshakeInbound(t)
+	meta := tcpEchoTarget(t)
+	failedBefore := stats.Get("handshake_failed").Value()
+
+	cases := []struct {
+		user string
+		kex  byte
+		ok   bool
+	}{
+		{"carol", kexX25519, true},
+		{"carol", kexHybridMLKEM768, true},
+		{"dave", kexX25519, false}, // pq 用户不能使用只有 X25519 的握手
+		{"dave", kexHybridMLKEM768, true},
+	}
+	rejected := 0
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go HandleHandshakeConnection(server, bufio.NewReader(server), in)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		session, _, err := clientHandshake(client, ciphers[c.user], handshakeModeStream, c.kex)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s with %s: handshake err = %v, want ok=%v", c.user, kexNames[c.kex], err, c.ok)
+		}
+		if err == nil {
+			expectEcho(t, client, session, meta, c.user)
+		} else {
+			rejected++
+		}
+		client.Close()
+	}
+	if got := stats.Get("handshake_failed").Value() - failedBefore; got != int64(rejected) {
+		t.Errorf("handshake_failed grew by %d, want %d", got, rejected)
+	}
+
+	// 要求 pfs 或 pq 的用户不能使用不握手的旧格式请求
+	for _, user := range []string{"carol", "dave"} {
+		client, server := net.Pipe()
+		go HandleTCPConnection(server, bufio.NewReader(server), in)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		writeTestFrame(t, client, ciphers[user], meta)
+		expectClosed(t, client)
+		client.Close()
+	}
+}
+
+func TestHandshake_RequireHandshake(t *testing.T) {
+	in, ciphers := handshakeInbound(t)
+	in.Cfg.RemoteConf.RequireHandshake = true
+	meta := tcpEchoTarget(t)
+
+	// v2.2 客户端不握手，直接发送用长期密钥加密的元数据
+	client, server := net.Pipe()
+	go HandleTCPConnection(server, bufio.NewReader(server), in)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	writeTestFrame(t, client, ciphers["alice"], meta)
+	expectClosed(t, client)
+	client.Close()
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go HandleHandshakeConnection(server, bufio.NewReader(server), in)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	session, _, err := clientHandshake(client, ciphers["alice"], handshakeModeStream, kexX25519)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	expectEcho(t, client, session, meta, "handshake required")
+}
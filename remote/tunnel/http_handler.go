@@ -0,0 +1,265 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"liuproxy_remote/remote/auth"
+)
+
+// httpMethodPrefixes 是常见 HTTP 方法的前两个字节，用于在分发时识别 HTTP 请求。
+// "PR" 是 HTTP/2 连接前言 ("PRI * HTTP/2.0")，即 h2c 和内置 TLS 上的 h2 (gRPC 传输)。
+// 它们作为大端长度都超过 16 KB，不会与 Multi-Conn 元数据的长度头冲突。
+var httpMethodPrefixes = []string{"GE", "HE", "PO", "PU", "DE", "OP", "PA", "TR", "CO", "PR"}
+
+// IsHTTPRequest 报告连接开头的 2 个字节是否像一个 HTTP 请求
+func IsHTTPRequest(header []byte) bool {
+	if len(header) < 2 {
+		return false
+	}
+	for _, p := range httpMethodPrefixes {
+		if header[0] == p[0] && header[1] == p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHTTPHandler 创建 HTTP 入口的路由:
+// 发往 ws_paths 或某个用户秘密路径 (ws_path) 的 WebSocket 升级请求，以及 grpc_service 的 gRPC 调用进入隧道，
+// 其余所有请求交给伪装站点，
+// 伪装站点可以是 decoy_upstream 指向的反向代理，或 decoy_dir 中的静态文件，都未配置时返回 404。
+// ws_paths 为空时任何路径的升级请求都进入隧道，与旧版本行为一致。
+func NewHTTPHandler(in *Inbound) (http.Handler, error) {
+	conf := in.Cfg.RemoteConf
+	paths := make(map[string]bool)
+	for _, p := range strings.Split(conf.WsPaths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths[p] = true
+		}
+	}
+
+	grpc := grpcMethods(conf.GrpcService)
+	checkOrigin := originChecker(conf.WsOrigins)
+	upgrader := newUpgrader(checkOrigin)
+
+	var decoy http.Handler = http.NotFoundHandler()
+	switch {
+	case conf.DecoyUpstream != "":
+		target, err := url.Parse(conf.DecoyUpstream)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid decoy_upstream '%s'", conf.DecoyUpstream)
+		}
+		decoy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) { pr.SetURL(target) },
+		}
+	case conf.DecoyDir != "":
+		decoy = http.FileServer(noListingFS{http.Dir(conf.DecoyDir)})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = in.resolveClientAddr(r)
+		if err := in.checkClientIP(clientAddr(r)); err != nil {
+			log.Printf("[REMOTE-HTTP] Rejected request from %s: %v", r.RemoteAddr, err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if grpc[r.URL.Path] && isGRPCRequest(r) {
+			serveGRPC(w, r, in)
+			return
+		}
+		// 未通过认证 (或来源不被允许) 的升级请求与普通请求一样交给伪装站点，
+		// 探测者无法从响应区分隧道路径和其他路径
+		if websocket.IsWebSocketUpgrade(r) && checkOrigin(r) {
+			// 用户的秘密路径本身就是凭据
+			if user := in.Users.LookupPath(r.URL.Path); user != nil {
+				serveWebSocket(w, r, in, upgrader, user, "")
+				return
+			}
+			if len(paths) == 0 || paths[r.URL.Path] {
+				user, protocol, err := in.authenticateUpgrade(r)
+				if err == nil {
+					serveWebSocket(w, r, in, upgrader, user, protocol)
+					return
+				}
+				log.Printf("[REMOTE-WS] Rejected upgrade from %s: %v", r.RemoteAddr, err)
+			}
+		}
+		decoy.ServeHTTP(w, r)
+	}), nil
+}
+
+// noListingFS 包装伪装站点的静态文件目录: 没有 index.html 的目录当作不存在 (404)，
+// 避免 http.FileServer 列出目录内容，让伪装站点看起来像一个普通网站。
+type noListingFS struct {
+	fs http.FileSystem
+}
+
+func (n noListingFS) Open(name string) (http.File, error) {
+	f, err := n.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		return f, err
+	}
+	index, err := n.fs.Open(path.Join(name, "index.html"))
+	if err != nil {
+		f.Close()
+		return nil, fs.ErrNotExist
+	}
+	index.Close()
+	return f, nil
+}
+
+// clientAddrKey 是请求上下文中保存转发头给出的真实客户端地址的键
+type clientAddrKey struct{}
+
+// resolveClientAddr 在请求来自受信任的代理 (或 Unix 套接字) 时，用 real_ip_headers 中的地址替换 r.RemoteAddr，
+// 并把该地址存入请求上下文，供 WebSocket 隧道用作连接的 RemoteAddr
+func (in *Inbound) resolveClientAddr(r *http.Request) *http.Request {
+	if in.ClientIP == nil {
+		return r
+	}
+	peer, _ := r.Context().Value(peerAddrKey{}).(net.Addr)
+	if peer == nil || peerIdentity(peer) != "" {
+		return r // 附带了证书身份的连接不经过 CDN
+	}
+	ip, ok := in.ClientIP.RealIP(peer, r.Header)
+	if !ok {
+		return r
+	}
+	addr := net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))
+	r = r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, net.Addr(addr)))
+	r.RemoteAddr = addr.String()
+	return r
+}
+
+// clientAddr 返回 resolveClientAddr 得到的真实客户端地址，没有时返回 nil
+func clientAddr(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(clientAddrKey{}).(net.Addr)
+	return addr
+}
+
+// bearerProtocolPrefix 是在 Sec-WebSocket-Protocol 中携带令牌时使用的前缀，例如 "bearer.<令牌>"
+const bearerProtocolPrefix = "bearer."
+
+var (
+	errUpgradeTokenMissing = errors.New("token required")
+	errUpgradeTokenInvalid = errors.New("invalid token")
+)
+
+// authenticateUpgrade 从 WebSocket 升级请求中取出令牌并确定用户。令牌可以放在:
+//   - Authorization: Bearer <令牌>
+//   - 查询参数 ?token=<令牌>
+//   - Sec-WebSocket-Protocol 中的 "bearer.<令牌>" 一项 (浏览器等无法设置请求头的客户端)
+//
+// 没有令牌时返回 nil 用户，除非设置了 require_ws_token。
+// 返回的 protocol 是应回复给客户端的子协议: 客户端同时提供的第一个非令牌子协议，没有时为令牌那一项。
+func (in *Inbound) authenticateUpgrade(r *http.Request) (*auth.User, string, error) {
+	var token, protocol, tokenProtocol string
+	if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(v)
+	}
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if v, ok := strings.CutPrefix(p, bearerProtocolPrefix); ok {
+			if token == "" {
+				token, tokenProtocol = v, p
+			}
+		} else if protocol == "" {
+			protocol = p
+		}
+	}
+
+	if token == "" {
+		if in.Cfg.RemoteConf.RequireWsToken {
+			return nil, "", errUpgradeTokenMissing
+		}
+		return nil, protocol, nil
+	}
+	user := in.Users.LookupToken(token)
+	if user == nil {
+		return nil, "", errUpgradeTokenInvalid
+	}
+	if protocol == "" {
+		// 浏览器要求服务端选中一个客户端提供的子协议
+		protocol = tokenProtocol
+	}
+	return user, protocol, nil
+}
+
+// HandleHTTPConnection 用 in.HTTP 处理一个以 HTTP 请求开头的连接 (支持 keep-alive)。
+// WebSocket 升级后连接被劫持，隧道会话在处理函数内一直运行到结束。
+// 配置了 grpc_service 时还接受以 HTTP/2 前言开头的连接 (h2c，或内置 TLS 解密后的 h2)。
+func HandleHTTPConnection(conn net.Conn, reader *bufio.Reader, in *Inbound) {
+	server := &http.Server{
+		Handler:           in.HTTP,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ConnContext:       withPeerAddr,
+	}
+	if in.Cfg.RemoteConf.GrpcService != "" {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	server.Serve(newSingleConnListener(&bufferedConn{Conn: conn, reader: reader}))
+}
+
+// singleConnListener 是只返回一个连接的 net.Listener，使 http.Server 可以处理已经接受的连接。
+// 第二次 Accept 会阻塞到该连接关闭，然后返回错误使 Serve 退出。
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{done: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: conn, done: l.done}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *singleConnListener) Close() error   { return nil }
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// notifyCloseConn 在连接关闭时关闭 done
+type notifyCloseConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
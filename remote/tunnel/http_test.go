@@ -0,0 +1,215 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/types"
+)
+
+func TestIsHTTPRequest(t *testing.T) {
+	for _, prefix := range []string{"GET /", "HEAD /", "POST /", "PUT /", "DELETE /", "OPTIONS /", "PATCH /", "TRACE /", "CONNECT x", "PRI * HTTP/2.0"} {
+		if !IsHTTPRequest([]byte(prefix)) {
+			t.Errorf("IsHTTPRequest(%q) = false", prefix)
+		}
+	}
+	for _, header := range [][]byte{{0x00, 0x40}, {0xFF, 0x48}, {0x02, 0x00}, {0x05, 0x01}, []byte("G")} {
+		if IsHTTPRequest(header) {
+			t.Errorf("IsHTTPRequest(%x) = true", header)
+		}
+	}
+}
+
+// testHTTPServer 启动一个使用 NewHTTPHandler 的测试服务器，伪装站点是一个临时目录
+func testHTTPServer(t *testing.T, conf types.RemoteConf) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("home"), 0644)
+	os.MkdirAll(filepath.Join(dir, "assets"), 0755)
+	os.WriteFile(filepath.Join(dir, "assets", "app.js"), []byte("js"), 0644)
+	os.MkdirAll(filepath.Join(dir, "blog"), 0755)
+	os.WriteFile(filepath.Join(dir, "blog", "index.html"), []byte("blog"), 0644)
+
+	cfg := &types.Config{RemoteConf: conf}
+	cfg.BufferSize = 4096
+	cfg.RemoteConf.DecoyDir = dir
+	cfg.Users = []types.UserConf{{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}, WsPath: "/alice-secret"}}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	handler, err := NewHTTPHandler(&Inbound{Cfg: cfg, Users: users})
+	if err != nil {
+		t.Fatalf("NewHTTPHandler: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPHandler_DecoySite(t *testing.T) {
+	server := testHTTPServer(t, types.RemoteConf{WsPaths: "/tunnel"})
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "home"},
+		{"/assets/app.js", http.StatusOK, "js"},
+		{"/blog/", http.StatusOK, "blog"},
+		// 没有 index.html 的目录不列出内容
+		{"/assets/", http.StatusNotFound, ""},
+		{"/assets", http.StatusNotFound, ""},
+		{"/missing", http.StatusNotFound, ""},
+		// 普通 GET 请求即使发往隧道路径也由伪装站点处理
+		{"/tunnel", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		resp, err := http.Get(server.URL + c.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", c.path, err)
+		}
+		body := make([]byte, 64)
+		n, _ := resp.Body.Read(body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("GET %s = %d, want %d", c.path, resp.StatusCode, c.status)
+		}
+		if c.body != "" && string(body[:n]) != c.body {
+			t.Errorf("GET %s body = %q, want %q", c.path, body[:n], c.body)
+		}
+		if strings.Contains(string(body[:n]), "app.js") {
+			t.Errorf("GET %s listed the directory", c.path)
+		}
+	}
+}
+
+func TestHTTPHandler_WebSocketRouting(t *testing.T) {
+	server := testHTTPServer(t, types.RemoteConf{WsPaths: "/tunnel"})
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	cases := []struct {
+		path     string
+		upgraded bool
+	}{
+		{"/tunnel", true},
+		{"/alice-secret", true},
+		{"/other", false},
+		{"/", false},
+	}
+	for _, c := range cases {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL+c.path, nil)
+		if conn != nil {
+			conn.Close()
+		}
+		if upgraded := err == nil; upgraded != c.upgraded {
+			t.Errorf("upgrade to %s: err = %v, want upgraded=%v", c.path, err, c.upgraded)
+		}
+		if !c.upgraded && resp != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+			t.Errorf("upgrade to %s was switched to WebSocket", c.path)
+		}
+	}
+}
+
+func TestAuthenticateUpgrade(t *testing.T) {
+	cfg := &types.Config{}
+	cfg.Users = []types.UserConf{{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}, Token: "t0ken"}}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	in := &Inbound{Cfg: cfg, Users: users}
+
+	upgrade := func(target string, header http.Header) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		return r
+	}
+	cases := []struct {
+		name     string
+		req      *http.Request
+		user     string
+		protocol string
+		err      error
+	}{
+		{"bearer header", upgrade("/tunnel", http.Header{"Authorization": {"Bearer t0ken"}}), "alice", "", nil},
+		{"query", upgrade("/tunnel?token=t0ken", nil), "alice", "", nil},
+		{"subprotocol only", upgrade("/tunnel", http.Header{"Sec-Websocket-Protocol": {"bearer.t0ken"}}), "alice", "bearer.t0ken", nil},
+		{"subprotocol with another", upgrade("/tunnel", http.Header{"Sec-Websocket-Protocol": {"bearer.t0ken, mux"}}), "alice", "mux", nil},
+		{"invalid token", upgrade("/tunnel?token=nope", nil), "", "", errUpgradeTokenInvalid},
+		{"no token", upgrade("/tunnel", nil), "", "", nil},
+	}
+	for _, c := range cases {
+		user, protocol, err := in.authenticateUpgrade(c.req)
+		if err != c.err || protocol != c.protocol || (user == nil) != (c.user == "") || (user != nil && user.Name != c.user) {
+			t.Errorf("%s: got %v, %q, %v; want %q, %q, %v", c.name, user, protocol, err, c.user, c.protocol, c.err)
+		}
+	}
+
+	cfg.RemoteConf.RequireWsToken = true
+	if _, _, err := in.authenticateUpgrade(upgrade("/tunnel", nil)); err != errUpgradeTokenMissing {
+		t.Errorf("require_ws_token without a token: err = %v, want %v", err, errUpgradeTokenMissing)
+	}
+}
+
+// upgradeStatus 向 path 发送升级请求，返回状态码
+func upgradeStatus(t *testing.T, server *httptest.Server, path string, header http.Header) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, header)
+	if conn != nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("upgrade to %s: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestHTTPHandler_UnauthenticatedUpgradeGetsDecoy(t *testing.T) {
+	server := testHTTPServer(t, types.RemoteConf{WsPaths: "/tunnel", RequireWsToken: true})
+
+	// 隧道路径上未认证的请求与不存在的路径得到相同的响应
+	decoy := upgradeStatus(t, server, "/no-such-path", nil)
+	if decoy != http.StatusNotFound {
+		t.Fatalf("decoy status = %d, want 404", decoy)
+	}
+	for _, header := range []http.Header{nil, {"Authorization": {"Bearer nope"}}} {
+		if got := upgradeStatus(t, server, "/tunnel", header); got != decoy {
+			t.Errorf("unauthenticated upgrade with %v = %d, want the decoy's %d", header, got, decoy)
+		}
+	}
+	// 秘密路径本身就是凭据，不受 require_ws_token 影响
+	if got := upgradeStatus(t, server, "/alice-secret", nil); got != http.StatusSwitchingProtocols {
+		t.Errorf("secret path upgrade = %d, want 101", got)
+	}
+}
+
+func TestHTTPHandler_CheckOrigin(t *testing.T) {
+	server := testHTTPServer(t, types.RemoteConf{WsPaths: "/tunnel", WsOrigins: "https://app.example"})
+	host := strings.TrimPrefix(server.URL, "http://")
+	cases := []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"http://" + host, http.StatusSwitchingProtocols},
+		{"https://app.example", http.StatusSwitchingProtocols},
+		{"https://evil.example", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		var header http.Header
+		if c.origin != "" {
+			header = http.Header{"Origin": {c.origin}}
+		}
+		if got := upgradeStatus(t, server, "/tunnel", header); got != c.status {
+			t.Errorf("upgrade from origin %q = %d, want %d", c.origin, got, c.status)
+		}
+	}
+}
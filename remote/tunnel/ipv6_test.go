@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/types"
+)
+
+// testInbound 返回只有一个用户的入站配置，以及该用户的加密器
+func testInbound(t *testing.T) (*Inbound, securecrypt.Cipher) {
+	t.Helper()
+	cfg := &types.Config{}
+	cfg.BufferSize = 4096
+	cfg.Users = []types.UserConf{{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}}}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	cipher, err := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	if err != nil {
+		t.Fatalf("NewCipherWithKey: %v", err)
+	}
+	return &Inbound{Cfg: cfg, Users: users, Replay: auth.NewReplayCache(time.Minute, 16)}, cipher
+}
+
+// listenLoopback6 在 [::1] 上监听，系统不支持 IPv6 时跳过测试
+func listenLoopback6(t *testing.T, network string) string {
+	t.Helper()
+	var addr string
+	switch network {
+	case "tcp6":
+		l, err := net.Listen(network, "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 loopback unavailable: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() { io.Copy(c, c); c.Close() }()
+			}
+		}()
+		addr = l.Addr().String()
+	case "udp6":
+		pc, err := net.ListenPacket(network, "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 loopback unavailable: %v", err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, from, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				pc.WriteTo(buf[:n], from)
+			}
+		}()
+		addr = pc.LocalAddr().String()
+	}
+	return addr
+}
+
+func writeTestFrame(t *testing.T, w io.Writer, c securecrypt.Cipher, payload []byte) {
+	t.Helper()
+	sealed, err := c.Encrypt(payload)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if _, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(sealed))), sealed...)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+func readTestFrame(t *testing.T, r io.Reader, c securecrypt.Cipher) []byte {
+	t.Helper()
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		t.Fatalf("read frame length: %v", err)
+	}
+	sealed := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	plain, err := c.Decrypt(sealed)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	return plain
+}
+
+// ipv6Metadata 构造一个不带扩展字段的元数据，目标为 addr
+func ipv6Metadata(streamType byte, addr *net.UDPAddr) []byte {
+	meta := []byte{streamType, AddrTypeIPv6}
+	meta = append(meta, addr.IP.To16()...)
+	return binary.BigEndian.AppendUint16(meta, uint16(addr.Port))
+}
+
+func TestSocks5UDPHeader_IPv6RoundTrip(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}
+	header, ok := appendSocks5UDPHeader(nil, addr)
+	if !ok {
+		t.Fatalf("appendSocks5UDPHeader(%s) not supported", addr)
+	}
+	if header[3] != AddrTypeIPv6 || len(header) != 4+16+2 {
+		t.Fatalf("header = %x, want ATYP 0x04 and 22 bytes", header)
+	}
+	got, data, err := parseSocks5UDPHeader(append(header, "payload"...))
+	if err != nil {
+		t.Fatalf("parseSocks5UDPHeader: %v", err)
+	}
+	if !got.IP.Equal(addr.IP) || got.Port != addr.Port || string(data) != "payload" {
+		t.Fatalf("parsed %s %q, want %s \"payload\"", got, data, addr)
+	}
+
+	// 双栈套接字上的 IPv4 映射地址仍按 IPv4 回复
+	mapped, _ := appendSocks5UDPHeader(nil, &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 53})
+	if mapped[3] != AddrTypeIPv4 {
+		t.Fatalf("IPv4-mapped reply ATYP = %d, want %d", mapped[3], AddrTypeIPv4)
+	}
+}
+
+func TestTCPStream_IPv6Target(t *testing.T) {
+	in, cipher := testInbound(t)
+	target, _ := net.ResolveUDPAddr("udp6", listenLoopback6(t, "tcp6"))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleTCPConnection(server, bufio.NewReader(server), in)
+
+	writeTestFrame(t, client, cipher, ipv6Metadata(StreamTCP, target))
+	writeTestFrame(t, client, cipher, []byte("hello over ipv6"))
+	if got := readTestFrame(t, client, cipher); string(got) != "hello over ipv6" {
+		t.Fatalf("echo = %q", got)
+	}
+}
+
+func TestUDPStream_IPv6Target(t *testing.T) {
+	in, cipher := testInbound(t)
+	target, _ := net.ResolveUDPAddr("udp6", listenLoopback6(t, "udp6"))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleTCPConnection(server, bufio.NewReader(server), in)
+
+	writeTestFrame(t, client, cipher, ipv6Metadata(StreamUDP, target))
+	record, _ := appendSocks5UDPHeader([]byte{0, 0}, target)
+	record = append(record, "ping"...)
+	binary.BigEndian.PutUint16(record, uint16(len(record)-2))
+	writeTestFrame(t, client, cipher, record)
+
+	reply := readTestFrame(t, client, cipher)
+	if int(binary.BigEndian.Uint16(reply)) != len(reply)-2 {
+		t.Fatalf("reply record length mismatch: %x", reply)
+	}
+	from, data, err := parseSocks5UDPHeader(reply[2:])
+	if err != nil {
+		t.Fatalf("parseSocks5UDPHeader: %v", err)
+	}
+	if reply[5] != AddrTypeIPv6 || !from.IP.Equal(target.IP) || from.Port != target.Port || string(data) != "ping" {
+		t.Fatalf("reply from %s = %q, want %s \"ping\"", from, data, target)
+	}
+}
@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Modes 是一个监听器允许的入站模式集合
+type Modes uint8
+
+const (
+	// ModeWS 是 HTTP 入口: WebSocket 隧道、gRPC 传输和伪装站点
+	ModeWS Modes = 1 << iota
+	// ModeMux 是直接运行在 TCP 连接上的 Mux 会话
+	ModeMux
+	// ModeMultiConn 是每个 TCP 连接承载一个流的 Multi-Conn 模式
+	ModeMultiConn
+	// ModeUDP 是 UDP 端口 (开启 quic 时为 QUIC)
+	ModeUDP
+	// ModeSOCKS5 是不加密的 SOCKS5 代理 (用户名/密码认证)，只用于可信网络，必须显式开启
+	ModeSOCKS5
+
+	// AllModes 包含所有隧道入站模式，不包括 ModeSOCKS5
+	AllModes = ModeWS | ModeMux | ModeMultiConn | ModeUDP
+)
+
+var modeNames = []struct {
+	mode Modes
+	name string
+}{
+	{ModeWS, "ws"},
+	{ModeMux, "mux"},
+	{ModeMultiConn, "multi-conn"},
+	{ModeUDP, "udp"},
+	{ModeSOCKS5, "socks5"},
+}
+
+// errUDPNotAllowed 表示监听器没有开启 udp 模式，却收到了 UDP over stream 的流
+var errUDPNotAllowed = errors.New("UDP over stream requires the udp mode on this listener")
+
+// ParseModes 解析逗号分隔的模式列表 (ws、mux、multi-conn、udp、socks5)，空字符串表示全部隧道模式
+func ParseModes(value string) (Modes, error) {
+	var modes Modes
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		found := false
+		for _, m := range modeNames {
+			if m.name == item {
+				modes |= m.mode
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown mode '%s' (want ws, mux, multi-conn, udp or socks5)", item)
+		}
+	}
+	if modes == 0 {
+		modes = AllModes
+	}
+	return modes, nil
+}
+
+// Has 报告集合是否包含 mode
+func (m Modes) Has(mode Modes) bool {
+	return m&mode != 0
+}
+
+func (m Modes) String() string {
+	var names []string
+	for _, n := range modeNames {
+		if m.Has(n.mode) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
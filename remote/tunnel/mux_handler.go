@@ -4,20 +4,74 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xtaci/smux"
-	"liuproxy_remote/remote/core/securecrypt"
-	"liuproxy_remote/remote/types"
+	"liuproxy_remote/remote/auth"
 )
 
-// HandleMuxSession 负责处理一个基于 smux 的多路复用会话
-func HandleMuxSession(conn net.Conn, reader *bufio.Reader, cfg *types.Config) {
+// HandleMuxSession 负责处理原始 TCP 连接上一个基于 smux 的多路复用会话。
+// 配置了回落地址时，先读出第一个流的元数据并试解密 (见 checkMuxProbe)，
+// 失败的连接 (例如只是看起来像 smux 帧头的探测) 连同已读出的字节一起转交给回落地址。
+func HandleMuxSession(conn net.Conn, reader *bufio.Reader, in *Inbound) {
+	if in.fallbackEnabled() {
+		rec := &recordingReader{r: reader}
+		conn.SetReadDeadline(time.Now().Add(metadataReadTimeout))
+		if err := in.checkMuxProbe(rec, conn.RemoteAddr()); err != nil {
+			defer conn.Close()
+			log.Printf("[REMOTE-MUX] Session from %s failed authentication: %v", conn.RemoteAddr(), err)
+			in.fallback(conn, reader, rec.data, err)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		// 已读出的字节重新交给 smux
+		reader = bufio.NewReader(io.MultiReader(bytes.NewReader(rec.data), reader))
+	}
+	serveMuxSession(conn, reader, in, nil, nil)
+}
+
+// serveMuxTransport 在 WebSocket、gRPC 等只承载 Mux 会话的传输上运行隧道。
+// 会话开头可能是一个可选的握手 (见 handshake.go)，预读 2 字节判断。
+// owner 是传输层认证出的用户 (可以为 nil)，tag 是日志前缀。
+// 握手失败或与传输层认证的用户不一致时返回错误，会话正常运行并结束时返回 nil。
+func serveMuxTransport(conn net.Conn, in *Inbound, owner *auth.User, tag string) error {
+	reader := bufio.NewReader(conn)
+	header, err := reader.Peek(2)
+	if err != nil {
+		log.Printf("%s Failed to read first message from %s: %v", tag, conn.RemoteAddr(), err)
+		return nil
+	}
+	if !IsHandshake(header) {
+		serveMuxSession(conn, reader, in, nil, owner)
+		return nil
+	}
+
+	sess, mode, err := serverHandshake(conn, reader, in)
+	if err != nil {
+		log.Printf("%s Handshake with %s failed: %v", tag, conn.RemoteAddr(), err)
+		return err
+	}
+	if mode != handshakeModeMux {
+		log.Printf("%s [%s] Handshake requested mode 0x%02x, but this transport only carries mux sessions.", tag, sess.user, mode)
+		return fmt.Errorf("handshake mode 0x%02x is not supported on this transport", mode)
+	}
+	if owner != nil && sess.user != owner {
+		log.Printf("%s Handshake key belongs to user '%s' but the transport was authenticated as '%s'. Closing.", tag, sess.user, owner)
+		return fmt.Errorf("handshake user '%s' does not match the authenticated user '%s'", sess.user, owner)
+	}
+	serveMuxSession(conn, reader, in, sess, owner)
+	return nil
+}
+
+// serveMuxSession 是 HandleMuxSession 的实现。
+// sess 不为 nil 时，会话已完成握手，所有流都使用会话密钥。
+func serveMuxSession(conn net.Conn, reader *bufio.Reader, in *Inbound, sess *sessionAuth, owner *auth.User) {
 	// 1. 根据 reader 是否为 nil，决定传给 smux.Server 的 io.ReadWriteCloser
 	var smuxInput io.ReadWriteCloser = conn // 默认直接使用 conn
 	if reader != nil {
@@ -42,6 +96,9 @@ func HandleMuxSession(conn net.Conn, reader *bufio.Reader, cfg *types.Config) {
 	//log.Printf("[REMOTE-MUX] New smux session established from %s", conn.RemoteAddr())
 
 	// 2. 在循环中接受逻辑流
+	// 同一会话中的流通常属于同一个用户，记住上一次识别结果以减少试解密次数
+	var lastUser atomic.Pointer[auth.User]
+	lastUser.Store(owner)
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
@@ -54,117 +111,116 @@ func HandleMuxSession(conn net.Conn, reader *bufio.Reader, cfg *types.Config) {
 		// 为每个流启动一个 goroutine 进行处理
 		go func(s *smux.Stream) {
 			defer s.Close()
-			handleMuxStream(s, cfg)
+			if user := handleMuxStream(s, conn.RemoteAddr(), in, sess, owner, lastUser.Load()); user != nil {
+				lastUser.Store(user)
+			}
 		}(stream)
 	}
 }
 
-// handleMuxStream 处理单个 smux 逻辑流，其逻辑与 handleTCPStream 非常相似
-func handleMuxStream(stream *smux.Stream, cfg *types.Config) {
-	// 1. 创建加密器
-	cipher, err := securecrypt.NewCipher(cfg.CommonConf.Crypt)
-	if err != nil {
-		log.Printf("[REMOTE-MUX-STREAM %d] Failed to create cipher: %v", stream.ID(), err)
-		return
-	}
+// muxStream 是 smux 流和 QUIC 流共同的部分。
+// Close 只需关闭写方向 (半关闭)，调用方负责在流结束后释放读方向。
+type muxStream interface {
+	io.ReadWriteCloser
+	readDeadliner
+	ID() uint32
+}
 
-	// 2. 读取并解密元数据包
+// handleMuxStream 处理单个 smux 逻辑流 (或 QUIC 流)，其逻辑与 handleTCPStream 非常相似。
+// peer 是会话的远端地址；sess 是会话握手的结果 (可以为 nil)；owner 是会话在传输层认证的用户 (可以为 nil)；
+// hint 是同一会话中上一次识别出的用户；返回值是本流识别出的用户，失败时为 nil。
+func handleMuxStream(stream muxStream, peer net.Addr, in *Inbound, sess *sessionAuth, owner, hint *auth.User) *auth.User {
+	// 1. 读取并解密元数据包，同时确定流所属的用户
 	lenBuf := make([]byte, 2)
 	if _, err := io.ReadFull(stream, lenBuf); err != nil {
 		log.Printf("[REMOTE-MUX-STREAM %d] Failed to read metadata length: %v", stream.ID(), err)
-		return
+		return nil
 	}
 	metaLen := binary.BigEndian.Uint16(lenBuf)
 	encryptedMeta := make([]byte, metaLen)
 	if _, err := io.ReadFull(stream, encryptedMeta); err != nil {
 		log.Printf("[REMOTE-MUX-STREAM %d] Failed to read metadata payload: %v", stream.ID(), err)
-		return
+		return nil
 	}
 
-	decryptedMetaBytes, err := cipher.Decrypt(encryptedMeta)
+	user, cipher, decryptedMetaBytes, err := in.openMetadata(encryptedMeta, sess, hint, peer)
 	if err != nil {
 		log.Printf("[REMOTE-MUX-STREAM %d] Failed to decrypt metadata: %v", stream.ID(), err)
-		return
+		return nil
+	}
+	if owner != nil && user != owner {
+		log.Printf("[REMOTE-MUX-STREAM %d] Stream key belongs to user '%s' but the session was authenticated as '%s'. Rejecting.", stream.ID(), user, owner)
+		return nil
 	}
 
 	meta, err := ReadMetadata(bytes.NewReader(decryptedMetaBytes))
 	if err != nil {
-		log.Printf("[REMOTE-MUX-STREAM %d] Failed to parse metadata: %v", stream.ID(), err)
-		return
+		log.Printf("[REMOTE-MUX-STREAM %d] [%s] Failed to parse metadata: %v", stream.ID(), user, err)
+		return user
+	}
+	if err := checkFirstPacket(user, meta); err != nil {
+		log.Printf("[REMOTE-MUX-STREAM %d] [%s] Rejected metadata from %s: %v", stream.ID(), user, peer, err)
+		return user
+	}
+	if meta.Type == StreamUDP && !in.Allows(ModeUDP) {
+		log.Printf("[REMOTE-MUX-STREAM %d] [%s] Rejected metadata from %s: %v", stream.ID(), user, peer, errUDPNotAllowed)
+		return user
 	}
 
 	//log.Printf("[REMOTE-MUX-STREAM %d] Metadata parsed. Target: %s:%d", stream.ID(), meta.Addr, meta.Port)
 
-	// 3. 连接最终目标
+	if err := in.checkReplay(user, meta.Flags&MetaFlagReplayGuard != 0, meta.Guard); err != nil {
+		log.Printf("[REMOTE-MUX-STREAM %d] [%s] Rejected metadata from %s: %v", stream.ID(), user, peer, err)
+		return user
+	}
+
+	// UDP over stream: 流承载数据报而不是 TCP 连接 (见 udp_stream.go)
+	switch meta.Type {
+	case StreamTCP:
+	case StreamUDP:
+		fr, fw, err := newFrameCodec(meta, user, cipher, stream, stream)
+		if err != nil {
+			log.Printf("[REMOTE-MUX-STREAM %d] [%s] Failed to set up frame codec: %v", stream.ID(), user, err)
+			return user
+		}
+		relayUDPStream("REMOTE-MUX", user, fr, fw, stream)
+		return user
+	default:
+		log.Printf("[REMOTE-MUX-STREAM %d] [%s] Unsupported stream type 0x%02x. Rejecting.", stream.ID(), user, meta.Type)
+		return user
+	}
+
+	// 2. 连接最终目标
 	targetAddr := net.JoinHostPort(meta.Addr, strconv.Itoa(meta.Port))
-	targetConn, err := net.Dial("tcp", targetAddr)
+	targetConn, err := dialTarget(targetAddr)
 	if err != nil {
-		log.Printf("[REMOTE-MUX-STREAM %d] Failed to dial target %s: %v", stream.ID(), targetAddr, err)
-		return
+		log.Printf("[REMOTE-MUX-STREAM %d] [%s] Failed to dial target %s: %v", stream.ID(), user, targetAddr, err)
+		return user
 	}
 	defer targetConn.Close()
 
-	// 4. 启动双向转发 (逻辑与 tcp_handler.go 完全相同)
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Uplink (stream -> target)
-	go func() {
-		defer wg.Done()
-		for {
-			lenBuf := make([]byte, 2)
-			_, err := io.ReadFull(stream, lenBuf)
-			if err != nil {
-				break
-			}
-			payloadLen := binary.BigEndian.Uint16(lenBuf)
-			buf := make([]byte, payloadLen)
-			_, err = io.ReadFull(stream, buf)
-			if err != nil {
-				break
-			}
-			decrypted, dErr := cipher.Decrypt(buf)
-			if dErr != nil {
-				break
-			}
-			if _, wErr := targetConn.Write(decrypted); wErr != nil {
-				break
-			}
-		}
-		if tcpConn, ok := targetConn.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
-	}()
-
-	// Downlink (target -> stream)
-	go func() {
-		defer wg.Done()
-		buf := make([]byte, 4096)
-		lenBuf := make([]byte, 2)
-		for {
-			n, err := targetConn.Read(buf)
-			if n > 0 {
-				encrypted, eErr := cipher.Encrypt(buf[:n])
-				if eErr != nil {
-					break
-				}
-				binary.BigEndian.PutUint16(lenBuf, uint16(len(encrypted)))
-				if _, wErr := stream.Write(lenBuf); wErr != nil {
-					break
-				}
-				if _, wErr := stream.Write(encrypted); wErr != nil {
-					break
-				}
-			}
-			if err != nil {
-				break
-			}
-		}
-		stream.Close() // CloseWrite() is not available on smux.Stream
-	}()
-
-	wg.Wait()
+	// 3. 启动双向转发 (与 tcp_handler.go 共用 relay)
+	fr, fw, err := newFrameCodec(meta, user, cipher, stream, stream)
+	if err != nil {
+		log.Printf("[REMOTE-MUX-STREAM %d] [%s] Failed to set up frame codec: %v", stream.ID(), user, err)
+		return user
+	}
+	relay("REMOTE-MUX", fr, fw, targetConn, func() {
+		stream.Close() // smux.Stream 没有 CloseWrite()，QUIC 流的 Close 本身就是半关闭
+	})
 	//log.Printf("[REMOTE-MUX-STREAM %d] Relay finished for target %s.", stream.ID(), targetAddr)
+	return user
+}
+
+// HandleKCPConnection 处理一个 KCP 连接。KCP 只是 Mux 会话的另一种底层传输，
+// 因此与 WebSocket 一样，会话开头可以有一个可选的握手。
+func HandleKCPConnection(conn net.Conn, in *Inbound) {
+	defer conn.Close()
+	if err := in.checkClientIP(conn.RemoteAddr()); err != nil {
+		log.Printf("[REMOTE-KCP] Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	serveMuxTransport(conn, in, nil, "[REMOTE-KCP]")
 }
 
 type bufferedConn struct {
@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"net"
+
+	"liuproxy_remote/remote/stats"
+)
+
+// 所有入站 (Multi-Conn、Mux、QUIC、SOCKS5) 访问目标时共用的计数器
+var (
+	outboundTCPDials    = stats.Get("outbound_tcp_dials")
+	outboundTCPFailures = stats.Get("outbound_tcp_dial_failures")
+	outboundUDPSockets  = stats.Get("outbound_udp_sockets")
+)
+
+// dialTarget 连接 TCP 目标 (host:port)
+func dialTarget(targetAddr string) (net.Conn, error) {
+	outboundTCPDials.Add(1)
+	conn, err := net.Dial("tcp", targetAddr)
+	if err != nil {
+		outboundTCPFailures.Add(1)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenOutboundUDP 为一个 UDP 会话创建出站套接字。
+// 未指定地址时系统创建双栈套接字 (不支持 IPv6 时退回 IPv4)，同一会话可以发往 IPv4 和 IPv6 目标
+func listenOutboundUDP() (net.PacketConn, error) {
+	outboundUDPSockets.Add(1)
+	return net.ListenPacket("udp", ":0")
+}
@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"bufio"
+	"log"
+	"net"
+)
+
+// PeerAddr 是附带了客户端身份的远端地址。
+// 经过验证的 TLS 客户端证书身份通过它随 RemoteAddr 传递给所有处理器，
+// 并直接出现在日志中。
+type PeerAddr struct {
+	net.Addr
+	// Identity 是客户端证书的身份 (SAN 或 Subject CN)，为空表示没有经过验证的证书
+	Identity string
+}
+
+func (a *PeerAddr) String() string {
+	if a.Identity == "" {
+		return a.Addr.String()
+	}
+	return a.Addr.String() + " (cert " + a.Identity + ")"
+}
+
+// Unwrap 返回不带身份信息的原始地址
+func (a *PeerAddr) Unwrap() net.Addr { return a.Addr }
+
+// peerIdentity 返回 addr 中附带的客户端证书身份，没有时返回空字符串
+func peerIdentity(addr net.Addr) string {
+	if pa, ok := addr.(*PeerAddr); ok {
+		return pa.Identity
+	}
+	return ""
+}
+
+// peerConn 用 PeerAddr 覆盖连接的 RemoteAddr
+type peerConn struct {
+	net.Conn
+	addr *PeerAddr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr { return c.addr }
+
+// CloseWrite 转发给底层连接，使 *tls.Conn 等连接的半关闭仍然有效
+func (c *peerConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// WithIdentity 返回一个 RemoteAddr 附带客户端证书身份的连接
+func WithIdentity(conn net.Conn, identity string) net.Conn {
+	return &peerConn{Conn: conn, addr: &PeerAddr{Addr: conn.RemoteAddr(), Identity: identity}}
+}
+
+// WithRemoteAddr 返回一个 RemoteAddr 为 addr 的连接 (例如从转发头得到的真实客户端地址)，
+// 保留原连接附带的客户端证书身份
+func WithRemoteAddr(conn net.Conn, addr net.Addr) net.Conn {
+	return &peerConn{Conn: conn, addr: &PeerAddr{Addr: addr, Identity: peerIdentity(conn.RemoteAddr())}}
+}
+
+// HandleRejectedConnection 处理没有通过连接级认证 (例如缺少有效的客户端证书) 的连接:
+// 配置了回落地址时把连接转交过去，否则直接关闭。
+func HandleRejectedConnection(conn net.Conn, reader *bufio.Reader, in *Inbound, reason error) {
+	defer conn.Close()
+	log.Printf("[REMOTE-DISPATCH] Rejected connection from %s: %v", conn.RemoteAddr(), reason)
+	in.fallback(conn, reader, nil, reason)
+}
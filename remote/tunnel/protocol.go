@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
 )
 
 // StreamType 定义了 goremote v3 协议中的流类型
@@ -15,6 +19,51 @@ const (
 	StreamUDP StreamType = 0x02
 )
 
+// 元数据第一个字节的低 4 位是流类型，高 4 位是元数据版本:
+//
+//   - 版本 0 (v2.2 旧客户端): 第一个字节之后直接是 ATYP，没有任何选项。
+//   - 版本 1: 第一个字节之后是一个选项标志字节，然后才是 ATYP。
+//
+// 标志与流类型不再共用一个字节，新增选项时不会挤占流类型的取值空间。
+const (
+	streamTypeMask   byte = 0x0f
+	metaVersionShift      = 4
+
+	metaVersionLegacy byte = 0
+	metaVersionFlags  byte = 1
+)
+
+// 版本 1 元数据中选项标志字节的各个位
+const (
+	// MetaFlagReplayGuard 表示元数据末尾附带时间戳和唯一 ID (见 ReplayGuard)
+	MetaFlagReplayGuard byte = 0x01
+	// MetaFlagStreamKeys 表示数据帧使用流式模式 (见 frame.go)，元数据末尾附带上行盐
+	MetaFlagStreamKeys byte = 0x02
+	// MetaFlagBindFrames 表示每个数据帧都把方向、流标识和帧序号作为 AEAD 附加数据认证，
+	// 被重排、反射或拼接到其他流的帧会解密失败。必须与 MetaFlagReplayGuard 同时使用，
+	// 因为流标识就是 ReplayGuard 中的唯一 ID。
+	MetaFlagBindFrames byte = 0x04
+	// MetaFlagSealedLength 表示数据帧的长度头也经 AEAD 加密 (见 frame.go)，
+	// 线路上不再出现明文长度。必须与 MetaFlagStreamKeys 同时使用。
+	MetaFlagSealedLength byte = 0x08
+	// MetaFlagPadding 表示客户端请求流量整形: 两个方向的数据帧明文都带有填充，
+	// 下行帧按用户策略延迟抖动 (见 frame.go)。元数据中所有可选字段之后的字节是第一个包的填充。
+	MetaFlagPadding byte = 0x10
+
+	// metaFlagsKnown 是本版本认识的所有标志，其他位被置位时拒绝元数据
+	metaFlagsKnown = MetaFlagReplayGuard | MetaFlagStreamKeys | MetaFlagBindFrames | MetaFlagSealedLength | MetaFlagPadding
+)
+
+// ReplayGuard 是附加在元数据或 UDP 数据报中的防重放字段，位于加密内容内部:
+// 8 字节大端 Unix 时间戳 (秒) + 16 字节随机 ID。
+type ReplayGuard struct {
+	Timestamp time.Time
+	ID        [auth.ReplayIDSize]byte
+}
+
+// replayGuardSize 是 ReplayGuard 编码后的长度
+const replayGuardSize = 8 + auth.ReplayIDSize
+
 // AddressType 定义了地址类型
 type AddressType = byte
 
@@ -26,21 +75,42 @@ const (
 
 // Metadata 是每个 goremote v3 短连接的第一个明文包
 type Metadata struct {
-	Type StreamType
-	Addr string
-	Port int
+	Type  StreamType
+	Flags byte
+	Addr  string
+	Port  int
+	// Guard 仅在 Flags 包含 MetaFlagReplayGuard 时有效
+	Guard ReplayGuard
+	// UplinkSalt 仅在 Flags 包含 MetaFlagStreamKeys 时有效
+	UplinkSalt []byte
+	// Padding 是元数据末尾的填充字节数，仅在 Flags 包含 MetaFlagPadding 时统计
+	Padding int
 }
 
-// ReadMetadata 从 reader 读取并解码元数据
+// ReadMetadata 从 reader 读取并解码元数据。
+// 端口之后的可选字段依次为 ReplayGuard、上行盐 (按标志存在与否)；其后的字节是填充，被忽略。
 func ReadMetadata(reader io.Reader) (*Metadata, error) {
 	meta := &Metadata{}
 
-	// Read StreamType and AddrType
+	// Read StreamType/version, the flags byte (version 1) and AddrType
 	typeBuf := make([]byte, 2)
 	if _, err := io.ReadFull(reader, typeBuf); err != nil {
 		return nil, fmt.Errorf("failed to read metadata type bytes: %w", err)
 	}
-	meta.Type = typeBuf[0]
+	meta.Type = typeBuf[0] & streamTypeMask
+	switch version := typeBuf[0] >> metaVersionShift; version {
+	case metaVersionLegacy:
+	case metaVersionFlags:
+		meta.Flags = typeBuf[1]
+		if unknown := meta.Flags &^ metaFlagsKnown; unknown != 0 {
+			return nil, fmt.Errorf("unsupported metadata flags 0x%02x", unknown)
+		}
+		if _, err := io.ReadFull(reader, typeBuf[1:]); err != nil {
+			return nil, fmt.Errorf("failed to read metadata address type: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported metadata version %d", version)
+	}
 	addrType := typeBuf[1]
 
 	var addrBytes []byte
@@ -78,5 +148,46 @@ func ReadMetadata(reader io.Reader) (*Metadata, error) {
 	}
 	meta.Port = int(binary.BigEndian.Uint16(portBuf))
 
+	if meta.Flags&MetaFlagBindFrames != 0 && meta.Flags&MetaFlagReplayGuard == 0 {
+		return nil, fmt.Errorf("frame binding requires a replay guard")
+	}
+	if meta.Flags&MetaFlagSealedLength != 0 && meta.Flags&MetaFlagStreamKeys == 0 {
+		return nil, fmt.Errorf("sealed length headers require stream keys")
+	}
+	if meta.Flags&MetaFlagReplayGuard != 0 {
+		guard, err := readReplayGuard(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read replay guard: %w", err)
+		}
+		meta.Guard = guard
+	}
+
+	if meta.Flags&MetaFlagStreamKeys != 0 {
+		meta.UplinkSalt = make([]byte, securecrypt.StreamSaltSize)
+		if _, err := io.ReadFull(reader, meta.UplinkSalt); err != nil {
+			return nil, fmt.Errorf("failed to read uplink salt: %w", err)
+		}
+	}
+
+	if meta.Flags&MetaFlagPadding != 0 {
+		n, err := io.Copy(io.Discard, reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata padding: %w", err)
+		}
+		meta.Padding = int(n)
+	}
+
 	return meta, nil
 }
+
+// readReplayGuard 读取并解码 ReplayGuard
+func readReplayGuard(reader io.Reader) (ReplayGuard, error) {
+	var guard ReplayGuard
+	buf := make([]byte, replayGuardSize)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return guard, err
+	}
+	guard.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(buf[:8])), 0)
+	copy(guard.ID[:], buf[8:])
+	return guard, nil
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+)
+
+// testMetadataV1 构造一个版本 1 的元数据，目标为 127.0.0.1:80，tail 追加在端口之后
+func testMetadataV1(streamType, flags byte, tail ...byte) []byte {
+	meta := []byte{metaVersionFlags<<metaVersionShift | streamType, flags, AddrTypeIPv4, 127, 0, 0, 1, 0, 80}
+	return append(meta, tail...)
+}
+
+func TestReadMetadata_Versions(t *testing.T) {
+	legacy, err := ReadMetadata(bytes.NewReader([]byte{StreamUDP, AddrTypeIPv4, 127, 0, 0, 1, 0, 53}))
+	if err != nil || legacy.Type != StreamUDP || legacy.Flags != 0 || legacy.Port != 53 {
+		t.Fatalf("legacy metadata = %+v, %v", legacy, err)
+	}
+
+	salt := bytes.Repeat([]byte{0x42}, securecrypt.StreamSaltSize)
+	meta, err := ReadMetadata(bytes.NewReader(testMetadataV1(StreamTCP, MetaFlagStreamKeys|MetaFlagPadding, append(salt, make([]byte, 300)...)...)))
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if meta.Type != StreamTCP || meta.Flags != MetaFlagStreamKeys|MetaFlagPadding || meta.Addr != "127.0.0.1" || meta.Port != 80 {
+		t.Fatalf("metadata = %+v", meta)
+	}
+	if !bytes.Equal(meta.UplinkSalt, salt) || meta.Padding != 300 {
+		t.Fatalf("salt = %x, padding = %d; want the salt and 300 padding bytes", meta.UplinkSalt, meta.Padding)
+	}
+
+	for name, data := range map[string][]byte{
+		"unknown flag":          testMetadataV1(StreamTCP, 0x80),
+		"unknown version":       {0x20 | StreamTCP, AddrTypeIPv4, 127, 0, 0, 1, 0, 80},
+		"bind without guard":    testMetadataV1(StreamTCP, MetaFlagBindFrames),
+		"sealed without stream": testMetadataV1(StreamTCP, MetaFlagSealedLength),
+	} {
+		if _, err := ReadMetadata(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: metadata was accepted", name)
+		}
+	}
+}
+
+func TestCheckFirstPacket(t *testing.T) {
+	user := &auth.User{Name: "alice", Padding: auth.PaddingPolicy{First: auth.Range{Min: 200, Max: 800}}}
+	cases := []struct {
+		flags   byte
+		padding int
+		ok      bool
+	}{
+		{MetaFlagPadding, 500, true},
+		{MetaFlagPadding, 10, false},
+		{MetaFlagPadding, 0, false},
+		// 没有请求流量整形的客户端不受 padding_first 限制
+		{0, 0, true},
+	}
+	for _, c := range cases {
+		err := checkFirstPacket(user, &Metadata{Flags: c.flags, Padding: c.padding})
+		if (err == nil) != c.ok {
+			t.Errorf("flags 0x%02x with %d padding bytes: err = %v, want ok=%v", c.flags, c.padding, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"liuproxy_remote/remote/auth"
+)
+
+// QUICALPN 是 QUIC 传输使用的 ALPN 协议名
+const QUICALPN = "liuproxy"
+
+// QUIC 连接关闭时使用的应用错误码 (QUICCodeRefused 表示连接被访问控制拒绝)，
+// 以及流处理结束后取消读取时使用的错误码
+const (
+	quicCodeNoError    quic.ApplicationErrorCode = 0
+	QUICCodeRefused    quic.ApplicationErrorCode = 1
+	quicCodeStreamDone quic.StreamErrorCode      = 0
+)
+
+// quicConnSeq 为每个 QUIC 连接编号，用于区分同一地址上不同连接的 UDP 会话
+var quicConnSeq atomic.Uint64
+
+// quicStream 让 QUIC 流满足 muxStream
+type quicStream struct {
+	*quic.Stream
+}
+
+func (s quicStream) ID() uint32 { return uint32(s.StreamID()) }
+
+// HandleQUICConnection 处理一个已完成 TLS 握手的 QUIC 连接。
+// 每个双向流相当于 Mux 会话中的一个流 (元数据和帧格式与 handleMuxStream 相同)，
+// 每个 QUIC 数据报相当于一个发往 UDP 端口的加密 UDP 请求，回复同样以数据报发回。
+// peer 是连接的远端地址 (可能附带客户端证书身份)，udp 处理数据报中的 UDP 请求。
+func HandleQUICConnection(conn *quic.Conn, peer net.Addr, in *Inbound, udp *UDPHandler) {
+	if err := in.checkClientIP(peer); err != nil {
+		log.Printf("[REMOTE-QUIC] Rejected connection from %s: %v", peer, err)
+		conn.CloseWithError(QUICCodeRefused, "refused")
+		return
+	}
+	//log.Printf("[REMOTE-QUIC] New QUIC connection from %s", peer)
+
+	ctx := conn.Context()
+	if conn.ConnectionState().SupportsDatagrams.Remote {
+		go serveQUICDatagrams(ctx, conn, peer, udp)
+	}
+
+	// 同一连接中的流通常属于同一个用户，记住上一次识别结果以减少试解密次数
+	var lastUser atomic.Pointer[auth.User]
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			//log.Printf("[REMOTE-QUIC] Connection from %s closed: %v", peer, err)
+			conn.CloseWithError(quicCodeNoError, "")
+			return
+		}
+		go func(s *quic.Stream) {
+			defer func() {
+				s.CancelRead(quicCodeStreamDone)
+				s.Close()
+			}()
+			if user := handleMuxStream(quicStream{s}, peer, in, nil, nil, lastUser.Load()); user != nil {
+				lastUser.Store(user)
+			}
+		}(stream)
+	}
+}
+
+// serveQUICDatagrams 把连接上的数据报交给 UDP 处理器，直到连接关闭。
+// 连接关闭时它的 UDP 会话随之关闭，而不是等到会话超时。
+func serveQUICDatagrams(ctx context.Context, conn *quic.Conn, peer net.Addr, udp *UDPHandler) {
+	sessionKey := fmt.Sprintf("%s (quic #%d)", peer, quicConnSeq.Add(1))
+	defer udp.closeSession(sessionKey)
+	for {
+		payload, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		go udp.handleDatagram(payload, peer, sessionKey, conn.SendDatagram)
+	}
+}
@@ -0,0 +1,208 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"liuproxy_remote/remote/certs"
+	"liuproxy_remote/remote/core/securecrypt"
+)
+
+// testQUICServer 在 127.0.0.1 上运行 QUIC 监听器，数据报交给 udp 处理
+func testQUICServer(t *testing.T, in *Inbound, udp *UDPHandler) *net.UDPAddr {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := certs.GenerateSelfSigned([]string{"localhost"}, time.Hour, certFile, keyFile); err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %v", err)
+	}
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	transport := &quic.Transport{Conn: udpConn}
+	t.Cleanup(func() { transport.Close(); udpConn.Close() })
+	listener, err := transport.Listen(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{QUICALPN},
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go HandleQUICConnection(conn, conn.RemoteAddr(), in, udp)
+		}
+	}()
+	return udpConn.LocalAddr().(*net.UDPAddr)
+}
+
+// udpEchoTarget 启动一个原样回复的 UDP 目标
+func udpEchoTarget(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// expectUDPReply 解密一个 UDP 回复，确认它来自 target 并且内容是 "ping"
+func expectUDPReply(t *testing.T, c securecrypt.Cipher, sealed []byte, target *net.UDPAddr) {
+	t.Helper()
+	plain, err := c.Decrypt(sealed)
+	if err != nil {
+		t.Fatalf("Decrypt reply: %v", err)
+	}
+	from, data, err := parseSocks5UDPHeader(plain)
+	if err != nil || from.Port != target.Port || string(data) != "ping" {
+		t.Fatalf("reply from %v with %q, %v; want \"ping\" from %s", from, data, err, target)
+	}
+}
+
+func sessionCount(h *UDPHandler) int {
+	n := 0
+	h.sessions.Range(func(any, any) bool { n++; return true })
+	return n
+}
+
+func TestQUIC_StreamsAndDatagrams(t *testing.T) {
+	in, cipher := testInbound(t)
+	udp := NewUDPHandler(in, nil)
+	defer udp.sessionCleanup.Stop()
+	addr := testQUICServer(t, in, udp)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr.String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUICALPN}}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("DialAddr: %v", err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	// 每个流都是独立的隧道流
+	target := echo.Addr().(*net.TCPAddr)
+	meta := append([]byte{StreamTCP, AddrTypeIPv4}, target.IP.To4()...)
+	meta = binary.BigEndian.AppendUint16(meta, uint16(target.Port))
+	for _, msg := range []string{"first stream", "second stream"} {
+		stream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatalf("OpenStreamSync: %v", err)
+		}
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		writeTestFrame(t, stream, cipher, meta)
+		writeTestFrame(t, stream, cipher, []byte(msg))
+		if got := readTestFrame(t, stream, cipher); string(got) != msg {
+			t.Fatalf("echo = %q, want %q", got, msg)
+		}
+		stream.Close()
+	}
+
+	// 数据报中的 UDP 请求，回复同样以数据报返回
+	udpTarget := udpEchoTarget(t)
+	if err := conn.SendDatagram(udpRequest(t, cipher, udpTarget)); err != nil {
+		t.Fatalf("SendDatagram: %v", err)
+	}
+	reply, err := conn.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveDatagram: %v", err)
+	}
+	expectUDPReply(t, cipher, reply, udpTarget)
+	if n := sessionCount(udp); n != 1 {
+		t.Fatalf("%d UDP sessions, want 1", n)
+	}
+
+	// 连接关闭后它的 UDP 会话随之关闭
+	conn.CloseWithError(0, "")
+	for deadline := time.Now().Add(5 * time.Second); sessionCount(udp) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("UDP session outlived the QUIC connection")
+		}
+	}
+}
+
+func TestQUIC_LegacyUDPOnSeparatePort(t *testing.T) {
+	in, cipher := testInbound(t)
+	legacy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer legacy.Close()
+	udp := NewUDPHandler(in, legacy)
+	defer udp.sessionCleanup.Stop()
+	go udp.Listen()
+	quicAddr := testQUICServer(t, in, udp)
+	udpTarget := udpEchoTarget(t)
+
+	// 第一个字节最高两位不为 0 的包在 QUIC 端口上会被当作 QUIC 包丢弃，旧格式端口则不受影响
+	buf := make([]byte, 2048)
+	for _, c := range []struct {
+		addr  *net.UDPAddr
+		reply bool
+	}{
+		{legacy.LocalAddr().(*net.UDPAddr), true},
+		{quicAddr, false},
+	} {
+		request := udpRequest(t, cipher, udpTarget)
+		for request[0]&0xC0 == 0 {
+			request = udpRequest(t, cipher, udpTarget)
+		}
+		client, err := net.DialUDP("udp4", nil, c.addr)
+		if err != nil {
+			t.Fatalf("DialUDP: %v", err)
+		}
+		client.Write(request)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		client.Close()
+		if (err == nil) != c.reply {
+			t.Fatalf("request to %s: reply err = %v, want reply=%v", c.addr, err, c.reply)
+		}
+		if c.reply {
+			expectUDPReply(t, cipher, buf[:n], udpTarget)
+		}
+	}
+}
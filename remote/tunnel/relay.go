@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// frameSource 和 frameSink 是 relay 的入站一侧: 加密帧 (frameReader/frameWriter) 或未加密的连接 (plainFrames)
+type frameSource interface {
+	ReadFrame() ([]byte, error)
+}
+
+type frameSink interface {
+	WriteFrame(payload []byte) error
+}
+
+// plainFrames 把未加密的入站连接当作帧的来源和去处，每次 Read 的结果是一个帧 (内置 SOCKS5 使用)
+type plainFrames struct {
+	r   io.Reader
+	w   io.Writer
+	buf []byte
+}
+
+func newPlainFrames(r io.Reader, w io.Writer) *plainFrames {
+	return &plainFrames{r: r, w: w, buf: make([]byte, 32<<10)}
+}
+
+// ReadFrame 返回的切片在下一次调用前有效
+func (p *plainFrames) ReadFrame() ([]byte, error) {
+	for {
+		n, err := p.r.Read(p.buf)
+		if n > 0 {
+			return p.buf[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *plainFrames) WriteFrame(payload []byte) error {
+	_, err := p.w.Write(payload)
+	return err
+}
+
+// relay 在入站一侧的帧与目标连接之间双向转发，直到两个方向都结束。
+// tag 是日志前缀 (例如 "REMOTE-TCP")；closeInbound 在下行结束后调用，用于 (半) 关闭入站一侧。
+// Multi-Conn、Mux 和内置 SOCKS5 的 CONNECT 共用这一实现。
+func relay(tag string, fr frameSource, fw frameSink, targetConn net.Conn, closeInbound func()) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Uplink (inbound -> target)
+	go func() {
+		defer wg.Done()
+		for {
+			decrypted, err := fr.ReadFrame()
+			if err != nil {
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					log.Printf("[%s-UPLINK] Read frame failed: %v", tag, err)
+				}
+				break
+			}
+			if _, wErr := targetConn.Write(decrypted); wErr != nil {
+				log.Printf("[%s-UPLINK] Write to target failed: %v", tag, wErr)
+				break
+			}
+		}
+		closeWrite(targetConn)
+	}()
+
+	// Downlink (target -> inbound)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 4096)
+		for {
+			n, err := targetConn.Read(buf)
+			if n > 0 {
+				if wErr := fw.WriteFrame(buf[:n]); wErr != nil {
+					log.Printf("[%s-DOWNLINK] Write frame failed: %v", tag, wErr)
+					break
+				}
+			}
+			if err != nil {
+				//log.Printf("[%s-DOWNLINK] Read from target finished: %v", tag, err)
+				break
+			}
+		}
+		closeInbound()
+	}()
+
+	wg.Wait()
+}
+
+// closeWrite 半关闭连接的写方向。*net.TCPConn、*tls.Conn 等支持 CloseWrite 的连接都适用，
+// 其他连接 (例如 smux 流) 不做任何事。
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"errors"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/stats"
+)
+
+// errReplayGuardMissing 表示开启 require_replay_guard 后收到了不带防重放字段的旧格式请求
+var errReplayGuardMissing = errors.New("replay guard required but missing")
+
+var (
+	replayRejected  = stats.Get("replay_rejected")
+	replayUnguarded = stats.Get("replay_unguarded_accepted")
+)
+
+// checkReplay 校验一个已解密的连接级请求 (流元数据、握手) 的防重放字段。
+// 与解密失败不同，这里失败说明请求来自持有正确密钥的一方 (或其录制的流量)，
+// 因此单独计数，便于区分探测/错误配置与重放攻击。
+func (in *Inbound) checkReplay(user *auth.User, guarded bool, guard ReplayGuard) error {
+	return in.checkReplayIn(in.Replay, user, guarded, guard)
+}
+
+// checkDatagramReplay 与 checkReplay 相同，用于单个 UDP 数据报。
+// 数据报使用独立的 DatagramReplay 配额，UDP 流量再大也不会占用新连接所需的配额。
+func (in *Inbound) checkDatagramReplay(user *auth.User, guarded bool, guard ReplayGuard) error {
+	cache := in.DatagramReplay
+	if cache == nil {
+		cache = in.Replay
+	}
+	return in.checkReplayIn(cache, user, guarded, guard)
+}
+
+func (in *Inbound) checkReplayIn(cache *auth.ReplayCache, user *auth.User, guarded bool, guard ReplayGuard) error {
+	if !guarded {
+		if in.Cfg.RemoteConf.RequireReplayGuard {
+			replayRejected.Add(1)
+			return errReplayGuardMissing
+		}
+		replayUnguarded.Add(1)
+		return nil
+	}
+	if err := cache.Check(user.Name, guard.Timestamp, guard.ID); err != nil {
+		replayRejected.Add(1)
+		return err
+	}
+	return nil
+}
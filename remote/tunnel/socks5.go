@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 (RFC 1928) 的地址编码在 UDP 端口、UDP over stream 记录和 SOCKS5 入站中共用:
+//
+//	ATYP(1) | DST.ADDR | DST.PORT(2, 大端)
+//
+// ATYP 为 0x01 (IPv4, 4 字节)、0x03 (域名, 1 字节长度 + 域名) 或 0x04 (IPv6, 16 字节)。
+// UDP 请求和回复在地址前还有 RSV(2) 和 FRAG(1)。
+
+const socks5Version = 0x05
+
+// appendSocks5Addr 把 ip:port 编码为 ATYP | ADDR | PORT 追加到 buf。
+// 双栈套接字上的 IPv4 映射地址按 IPv4 编码；无效的 IP 返回 false。
+func appendSocks5Addr(buf []byte, ip net.IP, port int) ([]byte, bool) {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		buf = append(buf, AddrTypeIPv4)
+		buf = append(buf, ipv4...)
+	} else if ipv6 := ip.To16(); ipv6 != nil {
+		buf = append(buf, AddrTypeIPv6)
+		buf = append(buf, ipv6...)
+	} else {
+		return buf, false
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), true
+}
+
+// parseSocks5Addr 解析 data 开头的 ATYP | ADDR | PORT，返回主机、端口和占用的字节数
+func parseSocks5Addr(data []byte) (string, int, int, error) {
+	if len(data) < 1 {
+		return "", 0, 0, io.ErrShortBuffer
+	}
+	addrType := data[0]
+	offset := 1
+
+	var host string
+	switch addrType {
+	case AddrTypeIPv4:
+		if len(data) < offset+4+2 {
+			return "", 0, 0, io.ErrShortBuffer
+		}
+		host = net.IP(data[offset : offset+4]).String()
+		offset += 4
+	case AddrTypeIPv6:
+		if len(data) < offset+16+2 {
+			return "", 0, 0, io.ErrShortBuffer
+		}
+		host = net.IP(data[offset : offset+16]).String()
+		offset += 16
+	case AddrTypeDomain:
+		if len(data) < offset+1 {
+			return "", 0, 0, io.ErrShortBuffer
+		}
+		domainLen := int(data[offset])
+		offset++
+		if len(data) < offset+domainLen+2 {
+			return "", 0, 0, io.ErrShortBuffer
+		}
+		host = string(data[offset : offset+domainLen])
+		offset += domainLen
+	default:
+		return "", 0, 0, fmt.Errorf("unsupported address type: %d", addrType)
+	}
+
+	port := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	return host, port, offset + 2, nil
+}
+
+// readSocks5Addr 从 r 中读取一个 ATYP | ADDR | PORT (SOCKS5 请求中的目标地址)
+func readSocks5Addr(r io.Reader) (string, int, error) {
+	buf := make([]byte, 2, 1+1+255+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, err
+	}
+	// 已读出 ATYP 和地址的第一个字节，据此确定剩余长度
+	var rest int
+	switch buf[0] {
+	case AddrTypeIPv4:
+		rest = 4 - 1 + 2
+	case AddrTypeIPv6:
+		rest = 16 - 1 + 2
+	case AddrTypeDomain:
+		rest = int(buf[1]) + 2
+	default:
+		return "", 0, fmt.Errorf("unsupported address type: %d", buf[0])
+	}
+	buf = buf[:2+rest]
+	if _, err := io.ReadFull(r, buf[2:]); err != nil {
+		return "", 0, err
+	}
+	host, port, _, err := parseSocks5Addr(buf)
+	return host, port, err
+}
+
+// appendSocks5UDPHeader 把 addr 编码为 SOCKS5 UDP 回复头 (RSV, FRAG, ATYP, 地址, 端口) 追加到 buf。
+// 不支持的地址返回 false。
+func appendSocks5UDPHeader(buf []byte, addr net.Addr) ([]byte, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return buf, false // 不支持非UDP地址
+	}
+	return appendSocks5Addr(append(buf, 0x00, 0x00, 0x00), udpAddr.IP, udpAddr.Port)
+}
+
+// parseSocks5UDPHeader 解析 SOCKS5 UDP 请求的头部
+func parseSocks5UDPHeader(data []byte) (*net.UDPAddr, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, io.ErrShortBuffer
+	}
+	// RSV(2), FRAG(1)
+	host, port, n, err := parseSocks5Addr(data[3:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return addr, data[3+n:], nil
+}
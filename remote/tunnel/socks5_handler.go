@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/clientip"
+	"liuproxy_remote/remote/stats"
+)
+
+// 内置 SOCKS5 入站 (RFC 1928)，供可信网络中的程序不经 liuproxy-local 直接使用服务端。
+// 只接受用户名/密码认证 (RFC 1929)，密码是用户的 socks5_password；支持 CONNECT 和 UDP ASSOCIATE。
+// 访问目标使用与隧道相同的出站连接 (见 outbound.go)，用户同样受监听器用户表、安全级别和客户端证书的限制。
+
+const (
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xFF
+	// socks5UserPassVersion 是 RFC 1929 子协商的版本号
+	socks5UserPassVersion = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5ReplySucceeded        = 0x00
+	socks5ReplyGeneralFailure   = 0x01
+	socks5ReplyHostUnreachable  = 0x04
+	socks5ReplyConnRefused      = 0x05
+	socks5ReplyCmdNotSupported  = 0x07
+	socks5ReplyAddrNotSupported = 0x08
+)
+
+var (
+	socks5Connects      = stats.Get("socks5_connect")
+	socks5UDPAssociates = stats.Get("socks5_udp_associate")
+	socks5AuthFailures  = stats.Get("socks5_auth_failed")
+)
+
+// HandleSOCKS5Connection 处理以 SOCKS5 问候 (0x05) 开头的连接
+func HandleSOCKS5Connection(conn net.Conn, reader *bufio.Reader, in *Inbound) {
+	defer conn.Close()
+	peer := conn.RemoteAddr()
+
+	// 认证和请求必须在限定时间内完成
+	conn.SetReadDeadline(time.Now().Add(metadataReadTimeout))
+	user, err := socks5Authenticate(conn, reader, in)
+	if err != nil {
+		log.Printf("[REMOTE-SOCKS5] Authentication from %s failed: %v", peer, err)
+		return
+	}
+
+	// 请求: VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		log.Printf("[REMOTE-SOCKS5] [%s] Failed to read request from %s: %v", user, peer, err)
+		return
+	}
+	if head[0] != socks5Version {
+		log.Printf("[REMOTE-SOCKS5] [%s] Invalid request version %d from %s", user, head[0], peer)
+		return
+	}
+	host, port, err := readSocks5Addr(reader)
+	if err != nil {
+		log.Printf("[REMOTE-SOCKS5] [%s] Invalid request address from %s: %v", user, peer, err)
+		writeSocks5Reply(conn, socks5ReplyAddrNotSupported, nil)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch head[1] {
+	case socks5CmdConnect:
+		socks5Connect(conn, reader, user, net.JoinHostPort(host, strconv.Itoa(port)))
+	case socks5CmdUDPAssociate:
+		socks5UDPAssociate(conn, reader, user)
+	default:
+		log.Printf("[REMOTE-SOCKS5] [%s] Unsupported command 0x%02x from %s", user, head[1], peer)
+		writeSocks5Reply(conn, socks5ReplyCmdNotSupported, nil)
+	}
+}
+
+// socks5Authenticate 完成方法协商和用户名/密码认证，返回登录的用户
+func socks5Authenticate(conn net.Conn, reader *bufio.Reader, in *Inbound) (*auth.User, error) {
+	// 问候: VER | NMETHODS | METHODS
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		return nil, err
+	}
+	if greeting[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(methods, socks5AuthUserPass) {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return nil, errors.New("client does not offer username/password authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthUserPass}); err != nil {
+		return nil, err
+	}
+
+	// RFC 1929: VER | ULEN | UNAME | PLEN | PASSWD
+	name, err := readSocks5AuthField(reader, true)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readSocks5AuthField(reader, false)
+	if err != nil {
+		return nil, err
+	}
+	user := in.Users.LookupSOCKS5(name, password)
+	if user == nil {
+		err = fmt.Errorf("invalid credentials for user '%s'", name)
+	} else if err = checkSecurityLevel(user, nil); err == nil {
+		err = checkPeerAccess(user, conn.RemoteAddr())
+	}
+	if err != nil {
+		socks5AuthFailures.Add(1)
+		conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{socks5UserPassVersion, 0x00}); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// readSocks5AuthField 读取 RFC 1929 中的一个长度前缀字段，withVersion 为 true 时先读取并检查版本号
+func readSocks5AuthField(reader *bufio.Reader, withVersion bool) (string, error) {
+	if withVersion {
+		version, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if version != socks5UserPassVersion {
+			return "", fmt.Errorf("unsupported username/password version %d", version)
+		}
+	}
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(reader, field); err != nil {
+		return "", err
+	}
+	return string(field), nil
+}
+
+// writeSocks5Reply 写出 VER | REP | RSV | ATYP | BND.ADDR | BND.PORT。
+// addr 为 nil 或不是 IP 地址时回复 0.0.0.0:0
+func writeSocks5Reply(conn net.Conn, rep byte, addr net.Addr) error {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	reply, ok := appendSocks5Addr([]byte{socks5Version, rep, 0x00}, ip, port)
+	if !ok {
+		reply, _ = appendSocks5Addr(reply[:3], net.IPv4zero, 0)
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socks5Connect 连接目标并在客户端与目标之间转发数据
+func socks5Connect(conn net.Conn, reader *bufio.Reader, user *auth.User, targetAddr string) {
+	targetConn, err := dialTarget(targetAddr)
+	if err != nil {
+		log.Printf("[REMOTE-SOCKS5] [%s] Failed to dial target %s: %v", user, targetAddr, err)
+		rep := byte(socks5ReplyHostUnreachable)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			rep = socks5ReplyConnRefused
+		}
+		writeSocks5Reply(conn, rep, nil)
+		return
+	}
+	defer targetConn.Close()
+	socks5Connects.Add(1)
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, targetConn.LocalAddr()); err != nil {
+		return
+	}
+
+	// 与隧道共用 relay，上行从 reader 读取以免丢失预读的数据
+	frames := newPlainFrames(reader, conn)
+	relay("REMOTE-SOCKS5", frames, frames, targetConn, func() { closeWrite(conn) })
+}
+
+// socks5UDPAssociate 在控制连接到达的本地地址上打开一个 UDP 中继端口，
+// 只接受来自客户端 IP 的数据报，直到控制连接关闭或关联空闲超过 udpSessionTimeout。
+func socks5UDPAssociate(conn net.Conn, reader *bufio.Reader, user *auth.User) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	clientIP, ok2 := clientip.AddrIP(conn.RemoteAddr())
+	if !ok || !ok2 {
+		// Unix 套接字上没有可以对应的 UDP 地址
+		log.Printf("[REMOTE-SOCKS5] [%s] UDP ASSOCIATE is not available on %s", user, conn.LocalAddr())
+		writeSocks5Reply(conn, socks5ReplyCmdNotSupported, nil)
+		return
+	}
+
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		log.Printf("[REMOTE-SOCKS5] [%s] Failed to open UDP relay on %s: %v", user, local.IP, err)
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	defer relayConn.Close()
+	targetConn, err := listenOutboundUDP()
+	if err != nil {
+		log.Printf("[REMOTE-SOCKS5] [%s] Failed to create outbound UDP socket: %v", user, err)
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	defer targetConn.Close()
+	socks5UDPAssociates.Add(1)
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, relayConn.LocalAddr()); err != nil {
+		return
+	}
+
+	// 控制连接关闭时结束关联
+	go func() {
+		io.Copy(io.Discard, reader)
+		relayConn.Close()
+	}()
+
+	// 只接受来自客户端 IP、不分片 (FRAG 为 0) 的数据报，回复发往客户端最近一次发送数据报的地址
+	var clientAddr atomic.Pointer[net.UDPAddr]
+	buf := make([]byte, 64<<10)
+	recv := func() ([]byte, error) {
+		for {
+			n, from, err := relayConn.ReadFromUDP(buf)
+			if err != nil {
+				return nil, err
+			}
+			if fromIP, _ := clientip.AddrIP(from); fromIP != clientIP || n < 4 || buf[2] != 0 {
+				continue
+			}
+			clientAddr.Store(from)
+			return buf[:n], nil
+		}
+	}
+	send := func(packet []byte) error {
+		to := clientAddr.Load()
+		if to == nil {
+			return nil
+		}
+		_, err := relayConn.WriteToUDP(packet, to)
+		return err
+	}
+	relayDatagrams("REMOTE-SOCKS5", user, targetConn, recv, send, func() {
+		relayConn.Close()
+		conn.Close()
+	})
+}
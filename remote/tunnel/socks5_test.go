@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/types"
+)
+
+// socks5Login 通过 conn 完成方法协商和用户名/密码认证，返回认证结果的状态字节
+func socks5Login(t *testing.T, conn net.Conn, name, password string) byte {
+	t.Helper()
+	conn.Write([]byte{socks5Version, 1, socks5AuthUserPass})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socks5AuthUserPass {
+		t.Fatalf("method selection = %x, %v", method, err)
+	}
+	req := append([]byte{socks5UserPassVersion, byte(len(name))}, name...)
+	conn.Write(append(append(req, byte(len(password))), password...))
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		t.Fatalf("read auth status: %v", err)
+	}
+	return status[1]
+}
+
+func TestSOCKS5_ConnectWithPassword(t *testing.T) {
+	cfg := &types.Config{}
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}, Socks5Password: "s3cret"},
+		{Name: "bob", Keys: []types.KeyConf{{Generation: 1, Secret: "pw2"}}},
+	}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	in := &Inbound{Cfg: cfg, Users: users, Modes: ModeSOCKS5}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	// 错误的密码和未设置 socks5_password 的用户都被拒绝
+	for _, cred := range [][2]string{{"alice", "wrong"}, {"bob", ""}} {
+		client, server := net.Pipe()
+		go HandleSOCKS5Connection(server, bufio.NewReader(server), in)
+		if status := socks5Login(t, client, cred[0], cred[1]); status == 0 {
+			t.Fatalf("login as %q with %q succeeded", cred[0], cred[1])
+		}
+		client.Close()
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleSOCKS5Connection(server, bufio.NewReader(server), in)
+	if status := socks5Login(t, client, "alice", "s3cret"); status != 0 {
+		t.Fatalf("login status = %d, want 0", status)
+	}
+
+	addr := target.Addr().(*net.TCPAddr)
+	req, _ := appendSocks5Addr([]byte{socks5Version, socks5CmdConnect, 0x00}, addr.IP, addr.Port)
+	client.Write(req)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != socks5ReplySucceeded || reply[3] != AddrTypeIPv4 || binary.BigEndian.Uint16(reply[8:]) == 0 {
+		t.Fatalf("reply = %x, want success with a bound address", reply)
+	}
+
+	client.Write([]byte("hello over socks5"))
+	echo := make([]byte, len("hello over socks5"))
+	if _, err := io.ReadFull(client, echo); err != nil || !bytes.Equal(echo, []byte("hello over socks5")) {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+}
+
+func TestSOCKS5_UDPAssociate(t *testing.T) {
+	cfg := &types.Config{}
+	cfg.Users = []types.UserConf{{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}, Socks5Password: "s3cret"}}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	in := &Inbound{Cfg: cfg, Users: users, Modes: ModeSOCKS5}
+
+	// UDP ASSOCIATE 需要真实的 TCP 连接，中继端口开在控制连接到达的地址上
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			HandleSOCKS5Connection(c, bufio.NewReader(c), in)
+		}
+	}()
+	control, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	if status := socks5Login(t, control, "alice", "s3cret"); status != 0 {
+		t.Fatalf("login status = %d, want 0", status)
+	}
+	req, _ := appendSocks5Addr([]byte{socks5Version, socks5CmdUDPAssociate, 0x00}, net.IPv4zero, 0)
+	control.Write(req)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != socks5ReplySucceeded || reply[3] != AddrTypeIPv4 {
+		t.Fatalf("reply = %x, want success with an IPv4 relay address", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	client, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer client.Close()
+	target := udpEchoTarget(t)
+	request, _ := appendSocks5UDPHeader(nil, target)
+
+	// 分片的数据报被丢弃，普通数据报得到带有目标地址的回复
+	fragmented := append([]byte{}, request...)
+	fragmented[2] = 1
+	client.Write(append(fragmented, "fragment"...))
+	client.Write(append(request, "ping"...))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("read relayed reply: %v", err)
+	}
+	from, data, err := parseSocks5UDPHeader(buf[:n])
+	if err != nil || from.Port != target.Port || string(data) != "ping" {
+		t.Fatalf("relayed reply from %v with %q, %v; want \"ping\" from %s", from, data, err, target)
+	}
+
+	// 控制连接关闭后关联结束，中继端口不再转发
+	control.Close()
+	time.Sleep(100 * time.Millisecond)
+	client.Write(append(request, "late"...))
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err := client.Read(buf); err == nil {
+		t.Fatalf("relay answered %x after the control connection closed", buf[:n])
+	}
+}
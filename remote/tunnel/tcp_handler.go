@@ -4,56 +4,105 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
-	"sync"
-
-	"liuproxy_remote/remote/core/securecrypt"
-	"liuproxy_remote/remote/types"
+	"time"
 )
 
-// handleTCPStream 修改签名以接收 bufio.Reader
-func handleTCPStream(inboundConn net.Conn, reader *bufio.Reader, cfg *types.Config) {
-	// 1. 创建加密器
-	cipher, err := securecrypt.NewCipher(cfg.CommonConf.Crypt)
-	if err != nil {
-		log.Printf("[REMOTE-TCP-DIAG] Failed to create cipher: %v", err)
-		return
+// handleTCPStream 修改签名以接收 bufio.Reader。
+// sess 不为 nil 时，连接已完成握手，所有帧使用会话密钥。
+func handleTCPStream(inboundConn net.Conn, reader *bufio.Reader, in *Inbound, sess *sessionAuth) {
+	// 1. 读取第一个元数据包
+	// 未经握手的连接在认证失败时可以转交给回落地址，此时需要限制读取时间，
+	// 并保留已读出的字节以便原样转发
+	canFallback := sess == nil && in.fallbackEnabled()
+	if canFallback {
+		inboundConn.SetReadDeadline(time.Now().Add(metadataReadTimeout))
+	}
+	rejectProbe := func(consumed []byte, reason error) {
+		if canFallback {
+			in.fallback(inboundConn, reader, consumed, reason)
+		}
 	}
 
-	// 2. 读取并解密第一个元数据包
 	//log.Printf("[REMOTE-TCP-DIAG] Reading encrypted metadata from inbound connection...")
 	lenBuf := make([]byte, 2)
-	if _, err := io.ReadFull(reader, lenBuf); err != nil {
+	if n, err := io.ReadFull(reader, lenBuf); err != nil {
 		log.Printf("[REMOTE-TCP-DIAG] Failed to read metadata length header: %v", err)
+		if n > 0 && isTimeout(err) {
+			rejectProbe(lenBuf[:n], err)
+		}
 		return
 	}
 	metaLen := binary.BigEndian.Uint16(lenBuf)
+	if canFallback && metaLen < minMetadataLen {
+		rejectProbe(lenBuf, fmt.Errorf("metadata length %d is too short", metaLen))
+		return
+	}
 
 	encryptedMeta := make([]byte, metaLen)
-	if _, err := io.ReadFull(reader, encryptedMeta); err != nil {
+	if n, err := io.ReadFull(reader, encryptedMeta); err != nil {
 		log.Printf("[REMOTE-TCP-DIAG] Failed to read encrypted metadata payload: %v", err)
+		if isTimeout(err) {
+			rejectProbe(concatBytes(lenBuf, encryptedMeta[:n]), err)
+		}
 		return
 	}
+	consumed := concatBytes(lenBuf, encryptedMeta)
 
-	decryptedMetaBytes, err := cipher.Decrypt(encryptedMeta)
+	// 2. 解密元数据并确定连接所属用户，后续帧都使用同一个加密器
+	user, cipher, decryptedMetaBytes, err := in.openMetadata(encryptedMeta, sess, nil, inboundConn.RemoteAddr())
 	if err != nil {
-		log.Printf("[REMOTE-TCP-DIAG] Failed to decrypt metadata: %v", err)
+		log.Printf("[REMOTE-TCP-DIAG] Failed to decrypt metadata from %s: %v", inboundConn.RemoteAddr(), err)
+		rejectProbe(consumed, err)
 		return
 	}
 
 	meta, err := ReadMetadata(bytes.NewReader(decryptedMetaBytes))
 	if err != nil {
-		log.Printf("[REMOTE-TCP-DIAG] Failed to parse decrypted metadata: %v", err)
+		log.Printf("[REMOTE-TCP-DIAG] [%s] Failed to parse decrypted metadata: %v", user, err)
+		rejectProbe(consumed, err)
+		return
+	}
+	if err := checkFirstPacket(user, meta); err != nil {
+		log.Printf("[REMOTE-TCP-DIAG] [%s] Rejected metadata from %s: %v", user, inboundConn.RemoteAddr(), err)
+		rejectProbe(consumed, err)
+		return
+	}
+	if meta.Type == StreamUDP && !in.Allows(ModeUDP) {
+		log.Printf("[REMOTE-TCP-DIAG] [%s] Rejected metadata from %s: %v", user, inboundConn.RemoteAddr(), errUDPNotAllowed)
+		rejectProbe(consumed, errUDPNotAllowed)
 		return
 	}
 	//log.Printf("[REMOTE-TCP-DIAG] Metadata decrypted successfully. StreamType: 0x%02x, Target: %s:%d", meta.Type, meta.Addr, meta.Port)
 
-	// 根据元数据中的流类型，理论上可以处理TCP或UDP，但此函数只处理TCP
-	if meta.Type != StreamTCP {
-		log.Printf("[REMOTE-TCP-DIAG] Received non-TCP stream type 0x%02x in a TCP connection. Closing.", meta.Type)
+	// 重放录制的请求是常见的主动探测手段，同样转交给回落地址
+	if err := in.checkReplay(user, meta.Flags&MetaFlagReplayGuard != 0, meta.Guard); err != nil {
+		log.Printf("[REMOTE-TCP-DIAG] [%s] Rejected metadata from %s: %v", user, inboundConn.RemoteAddr(), err)
+		rejectProbe(consumed, err)
+		return
+	}
+	if canFallback {
+		inboundConn.SetReadDeadline(time.Time{})
+	}
+
+	// 根据元数据中的流类型处理 TCP 或 UDP (UDP over stream，见 udp_stream.go)
+	switch meta.Type {
+	case StreamTCP:
+	case StreamUDP:
+		fr, fw, err := newFrameCodec(meta, user, cipher, reader, inboundConn)
+		if err != nil {
+			log.Printf("[REMOTE-TCP-DIAG] [%s] Failed to set up frame codec: %v", user, err)
+			return
+		}
+		relayUDPStream("REMOTE-TCP", user, fr, fw, inboundConn)
+		return
+	default:
+		log.Printf("[REMOTE-TCP-DIAG] [%s] Received unsupported stream type 0x%02x. Closing.", user, meta.Type)
 		return
 	}
 
@@ -61,9 +110,9 @@ func handleTCPStream(inboundConn net.Conn, reader *bufio.Reader, cfg *types.Conf
 
 	// 3. 连接最终目标
 	//log.Printf("[REMOTE-TCP-DIAG] Dialing target: %s", targetAddr)
-	targetConn, err := net.Dial("tcp", targetAddr)
+	targetConn, err := dialTarget(targetAddr)
 	if err != nil {
-		log.Printf("[REMOTE-TCP-DIAG] Failed to dial target %s: %v", targetAddr, err)
+		log.Printf("[REMOTE-TCP-DIAG] [%s] Failed to dial target %s: %v", user, targetAddr, err)
 		return
 	}
 	defer targetConn.Close()
@@ -71,84 +120,20 @@ func handleTCPStream(inboundConn net.Conn, reader *bufio.Reader, cfg *types.Conf
 
 	// 4. 启动双向加密转发
 	//log.Printf("[REMOTE-TCP-DIAG] Starting bidirectional relay for TCP stream.")
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Uplink (inbound -> target)
-	go func() {
-		defer wg.Done()
-		// Uplink 的 reader 现在是 MultiReader，它会先读取 bufio.Reader 中剩余的数据，然后再读取原始的 conn
-		combinedReader := io.MultiReader(reader, inboundConn)
-		lenBuf := make([]byte, 2)
-		for {
-			_, err := io.ReadFull(combinedReader, lenBuf) // 从组合 reader 读取
-			if err != nil {
-				if err != io.EOF && err != io.ErrUnexpectedEOF {
-					//log.Printf("[REMOTE-TCP-UPLINK] Read length header failed: %v", err)
-				}
-				break
-			}
-			payloadLen := binary.BigEndian.Uint16(lenBuf)
-			if payloadLen == 0 {
-				continue
-			}
-
-			buf := make([]byte, payloadLen)
-			_, err = io.ReadFull(combinedReader, buf) // 从组合 reader 读取
-			if err != nil {
-				log.Printf("[REMOTE-TCP-UPLINK] Read payload failed: %v", err)
-				break
-			}
-			decrypted, dErr := cipher.Decrypt(buf)
-			if dErr != nil {
-				log.Printf("[REMOTE-TCP-UPLINK] Decryption failed: %v", dErr)
-				break
-			}
-			if _, wErr := targetConn.Write(decrypted); wErr != nil {
-				log.Printf("[REMOTE-TCP-UPLINK] Write to target failed: %v", wErr)
-				break
-			}
-		}
-		if tcpConn, ok := targetConn.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
-	}()
-
-	// Downlink (target -> inbound)
-	go func() {
-		defer wg.Done()
-		buf := make([]byte, 4096)
-		lenBuf := make([]byte, 2)
-		for {
-			n, err := targetConn.Read(buf)
-			if n > 0 {
-				encrypted, eErr := cipher.Encrypt(buf[:n])
-				if eErr != nil {
-					log.Printf("[REMOTE-TCP-DOWNLINK] Encryption failed: %v", eErr)
-					break
-				}
-
-				binary.BigEndian.PutUint16(lenBuf, uint16(len(encrypted)))
-				if _, wErr := inboundConn.Write(lenBuf); wErr != nil {
-					log.Printf("[REMOTE-TCP-DOWNLINK] Write length header failed: %v", wErr)
-					break
-				}
-
-				if _, wErr := inboundConn.Write(encrypted); wErr != nil {
-					log.Printf("[REMOTE-TCP-DOWNLINK] Write payload failed: %v", wErr)
-					break
-				}
-			}
-			if err != nil {
-				//log.Printf("[REMOTE-TCP-DOWNLINK] Read from target finished: %v", err)
-				break
-			}
-		}
-		if tcpConn, ok := inboundConn.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
-	}()
-
-	wg.Wait()
+	// 上行直接从 bufio.Reader 读取，它会先消费预读的数据，再继续读取原始的 conn
+	fr, fw, err := newFrameCodec(meta, user, cipher, reader, inboundConn)
+	if err != nil {
+		log.Printf("[REMOTE-TCP-DIAG] [%s] Failed to set up frame codec: %v", user, err)
+		return
+	}
+	relay("REMOTE-TCP", fr, fw, targetConn, func() {
+		closeWrite(inboundConn)
+	})
 	//log.Printf("[REMOTE-TCP-DIAG] Relay finished for target %s.", targetAddr)
 }
+
+// isTimeout 报告 err 是否为读取超时
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
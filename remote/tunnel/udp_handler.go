@@ -3,50 +3,57 @@ package tunnel
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"liuproxy_remote/remote/auth"
 	"liuproxy_remote/remote/core/securecrypt"
 	"liuproxy_remote/remote/types"
 )
 
 const udpSessionTimeout = 60 * time.Second
 
+// udpFlagReplayGuard 置于 SOCKS5 UDP 头部 RSV 的第一个字节，
+// 表示 RSV/FRAG 之后紧跟一个 ReplayGuard，然后才是 ATYP。
+const udpFlagReplayGuard byte = 0x80
+
 // udpSession 存储了一个UDP会话所需的信息
 type udpSession struct {
 	// 连接到最终目标的UDP "连接"
 	targetConn net.PacketConn
 	// 会话的过期时间
 	expiry time.Time
+	// 会话所属的用户，以及该用户最近一次使用的那一代密钥，回复包使用这把密钥加密
+	user *auth.User
+	key  atomic.Pointer[securecrypt.Key]
+	// reply 把加密后的回复包发回客户端 (UDP 监听端口或 QUIC 数据报)
+	reply func([]byte) error
 }
 
 // UDPHandler 负责管理所有的UDP会话
 type UDPHandler struct {
+	in             *Inbound
 	cfg            *types.Config
+	users          *auth.Registry
 	listener       *net.UDPConn
-	sessions       sync.Map // map[string]*udpSession, key是 gateway_addr:port
+	sessions       sync.Map // map[string]*udpSession, key是 gateway_addr:port (QUIC 数据报见 quic_handler.go)
 	sessionCleanup *time.Ticker
-	cipher         *securecrypt.Cipher
 }
 
-// NewUDPHandler 创建并初始化一个新的UDPHandler
-func NewUDPHandler(cfg *types.Config, listener *net.UDPConn) *UDPHandler {
-	cipher, err := securecrypt.NewCipher(cfg.Crypt)
-	if err != nil {
-		log.Fatalf("[REMOTE-UDP] Failed to create cipher for UDP handler: %v", err)
-	}
-
+// NewUDPHandler 创建并初始化一个新的UDPHandler。
+// 开启 QUIC 时处理器同时处理 QUIC 数据报；listener 为 nil 表示没有接收旧格式 UDP 包的端口，不要调用 Listen。
+func NewUDPHandler(in *Inbound, listener *net.UDPConn) *UDPHandler {
 	handler := &UDPHandler{
-		cfg:            cfg,
+		in:             in,
+		cfg:            in.Cfg,
+		users:          in.Users,
 		listener:       listener,
 		sessionCleanup: time.NewTicker(30 * time.Second),
-		cipher:         cipher,
 	}
 
 	go handler.cleanupLoop()
@@ -55,9 +62,14 @@ func NewUDPHandler(cfg *types.Config, listener *net.UDPConn) *UDPHandler {
 
 // Listen 开始监听并处理传入的UDP包
 func (h *UDPHandler) Listen() {
+	h.serve(h.listener.ReadFrom, h.listener.WriteTo)
+}
+
+// serve 用 read 逐个读取加密的 UDP 请求，回复用 write 发回请求的来源地址，直到 read 出错
+func (h *UDPHandler) serve(read func([]byte) (int, net.Addr, error), write func([]byte, net.Addr) (int, error)) {
 	buf := make([]byte, h.cfg.BufferSize)
 	for {
-		n, gatewayAddr, err := h.listener.ReadFromUDP(buf)
+		n, gatewayAddr, err := read(buf)
 		if err != nil {
 			log.Printf("[REMOTE-UDP] Error reading from UDP listener: %v", err)
 			return // 监听器关闭时会出错，循环自然结束
@@ -67,33 +79,76 @@ func (h *UDPHandler) Listen() {
 		copy(encryptedPayload, buf[:n])
 
 		// 每个包都在独立的goroutine中处理，以实现高并发
-		go h.handlePacket(encryptedPayload, gatewayAddr)
+		go h.handleDatagram(encryptedPayload, gatewayAddr, gatewayAddr.String(), func(b []byte) error {
+			_, err := write(b, gatewayAddr)
+			return err
+		})
 	}
 }
 
-func (h *UDPHandler) handlePacket(encryptedPayload []byte, gatewayAddr *net.UDPAddr) {
-	// 1. 解密
-	payload, err := h.cipher.Decrypt(encryptedPayload)
+// handleDatagram 处理一个加密的 UDP 请求。gatewayAddr 是客户端地址，
+// sessionKey 区分不同客户端的会话，reply 用于发送该会话的回复包。
+func (h *UDPHandler) handleDatagram(encryptedPayload []byte, gatewayAddr net.Addr, sessionKey string, reply func([]byte) error) {
+	if err := h.in.checkClientIP(gatewayAddr); err != nil {
+		log.Printf("[REMOTE-UDP] Dropping packet from %s: %v", gatewayAddr, err)
+		return
+	}
+
+	// UDP 数据报无法握手，要求握手时全部丢弃
+	if h.in.Cfg.RemoteConf.RequireHandshake {
+		log.Printf("[REMOTE-UDP] Dropping packet from %s: %v", gatewayAddr, errHandshakeRequired)
+		return
+	}
+
+	// 1. 解密并识别用户，已有会话的用户会被优先尝试
+	var hint *auth.User
+	if s, ok := h.sessions.Load(sessionKey); ok {
+		hint = s.(*udpSession).user
+	}
+	user, key, payload, err := h.users.Identify(encryptedPayload, hint, gatewayAddr)
 	if err != nil {
 		log.Printf("[REMOTE-UDP] Failed to decrypt UDP packet from %s: %v", gatewayAddr, err)
 		return
 	}
+	if hint != nil && user != hint {
+		// 一个网关地址在会话有效期内只能属于一个用户，否则回复会用错密钥
+		log.Printf("[REMOTE-UDP] Packet from %s belongs to user '%s' but the session belongs to '%s'. Dropping.", gatewayAddr, user, hint)
+		return
+	}
+	// 与 openMetadata 相同，未经握手的数据报只能使用 standard 级别的用户
+	if err := checkSecurityLevel(user, nil); err != nil {
+		log.Printf("[REMOTE-UDP] Dropping packet from %s: %v", gatewayAddr, err)
+		return
+	}
+	if err := checkPeerAccess(user, gatewayAddr); err != nil {
+		log.Printf("[REMOTE-UDP] Dropping packet from %s: %v", gatewayAddr, err)
+		return
+	}
 
-	// 2. 解析SOCKS5 UDP头部
+	// 2. 防重放校验，然后解析SOCKS5 UDP头部
+	guard, guarded, payload, err := stripUDPReplayGuard(payload)
+	if err != nil {
+		log.Printf("[REMOTE-UDP] [%s] Malformed replay guard from %s: %v", user, gatewayAddr, err)
+		return
+	}
+	if err := h.in.checkDatagramReplay(user, guarded, guard); err != nil {
+		log.Printf("[REMOTE-UDP] [%s] Rejected packet from %s: %v", user, gatewayAddr, err)
+		return
+	}
 	targetAddr, data, err := parseSocks5UDPHeader(payload)
 	if err != nil {
-		log.Printf("[REMOTE-UDP] Failed to parse SOCKS5 UDP header from %s: %v", gatewayAddr, err)
+		log.Printf("[REMOTE-UDP] [%s] Failed to parse SOCKS5 UDP header from %s: %v", user, gatewayAddr, err)
 		return
 	}
-	log.Printf("[REMOTE-UDP-DIAG] Received packet from %s, forwarding to %s", gatewayAddr, targetAddr)
+	log.Printf("[REMOTE-UDP-DIAG] [%s] Received packet from %s, forwarding to %s", user, gatewayAddr, targetAddr)
 
 	// 3. 获取或创建会话
-	sessionKey := gatewayAddr.String()
-	session, err := h.getOrCreateSession(sessionKey, gatewayAddr)
+	session, err := h.getOrCreateSession(sessionKey, user, reply)
 	if err != nil {
 		log.Printf("[REMOTE-UDP] Failed to get or create session for %s: %v", gatewayAddr, err)
 		return
 	}
+	session.key.Store(key)
 
 	// 4. 发送数据到最终目标
 	_, err = session.targetConn.WriteTo(data, targetAddr)
@@ -102,7 +157,7 @@ func (h *UDPHandler) handlePacket(encryptedPayload []byte, gatewayAddr *net.UDPA
 	}
 }
 
-func (h *UDPHandler) getOrCreateSession(sessionKey string, gatewayAddr *net.UDPAddr) (*udpSession, error) {
+func (h *UDPHandler) getOrCreateSession(sessionKey string, user *auth.User, reply func([]byte) error) (*udpSession, error) {
 	// 尝试加载现有会话
 	if s, ok := h.sessions.Load(sessionKey); ok {
 		session := s.(*udpSession)
@@ -111,8 +166,8 @@ func (h *UDPHandler) getOrCreateSession(sessionKey string, gatewayAddr *net.UDPA
 	}
 
 	// 创建新会话
-	log.Printf("[REMOTE-UDP-DIAG] Creating new UDP session for %s", sessionKey)
-	targetConn, err := net.ListenPacket("udp", "0.0.0.0:0")
+	log.Printf("[REMOTE-UDP-DIAG] [%s] Creating new UDP session for %s", user, sessionKey)
+	targetConn, err := listenOutboundUDP()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create outbound UDP socket: %w", err)
 	}
@@ -120,65 +175,63 @@ func (h *UDPHandler) getOrCreateSession(sessionKey string, gatewayAddr *net.UDPA
 	newSession := &udpSession{
 		targetConn: targetConn,
 		expiry:     time.Now().Add(udpSessionTimeout),
+		user:       user,
+		reply:      reply,
 	}
 
 	h.sessions.Store(sessionKey, newSession)
 
 	// 为这个新会话启动一个专门的“回复”goroutine
-	go h.replyLoop(newSession, gatewayAddr)
+	go h.replyLoop(newSession, sessionKey)
 
 	return newSession, nil
 }
 
 // replyLoop 持续从目标UDP连接读取数据，并将其转发回对应的gateway
-func (h *UDPHandler) replyLoop(session *udpSession, gatewayAddr *net.UDPAddr) {
+func (h *UDPHandler) replyLoop(session *udpSession, sessionKey string) {
 	buf := make([]byte, h.cfg.BufferSize)
 	for {
 		session.targetConn.SetReadDeadline(time.Now().Add(udpSessionTimeout + 5*time.Second))
 		n, remoteAddr, err := session.targetConn.ReadFrom(buf)
 		if err != nil {
 			// 超时或其他错误，意味着此会话可以关闭了
-			log.Printf("[REMOTE-UDP-DIAG] Reply loop for %s terminating: %v", gatewayAddr, err)
+			log.Printf("[REMOTE-UDP-DIAG] Reply loop for %s terminating: %v", sessionKey, err)
 			session.targetConn.Close()
-			h.sessions.Delete(gatewayAddr.String())
+			h.sessions.CompareAndDelete(sessionKey, session)
 			return
 		}
 
-		log.Printf("[REMOTE-UDP-DIAG] Received reply from %s for %s", remoteAddr, gatewayAddr)
+		log.Printf("[REMOTE-UDP-DIAG] Received reply from %s for %s", remoteAddr, sessionKey)
 
 		// 封装成SOCKS5 UDP包
-		var replyBuf bytes.Buffer
-		// RSV, FRAG, ATYP
-		replyBuf.Write([]byte{0x00, 0x00, 0x00})
-		if udpRemoteAddr, ok := remoteAddr.(*net.UDPAddr); ok {
-			if ipv4 := udpRemoteAddr.IP.To4(); ipv4 != nil {
-				replyBuf.WriteByte(0x01) // IPv4
-				replyBuf.Write(ipv4)
-			} else {
-				// 暂不支持IPv6回复
-				continue
-			}
-			binary.Write(&replyBuf, binary.BigEndian, uint16(udpRemoteAddr.Port))
-		} else {
-			continue // 不支持非UDP地址
+		reply, ok := appendSocks5UDPHeader(nil, remoteAddr)
+		if !ok {
+			continue
 		}
-		replyBuf.Write(buf[:n])
+		reply = append(reply, buf[:n]...)
 
 		// 加密
-		encryptedReply, err := h.cipher.Encrypt(replyBuf.Bytes())
+		encryptedReply, err := session.key.Load().Cipher.Encrypt(reply)
 		if err != nil {
-			log.Printf("[REMOTE-UDP] Failed to encrypt reply for %s: %v", gatewayAddr, err)
+			log.Printf("[REMOTE-UDP] Failed to encrypt reply for %s: %v", sessionKey, err)
 			continue
 		}
 
 		// 发送回gateway
-		_, err = h.listener.WriteTo(encryptedReply, gatewayAddr)
-		if err != nil {
-			log.Printf("[REMOTE-UDP] Failed to send reply to gateway %s: %v", gatewayAddr, err)
+		if err := session.reply(encryptedReply); err != nil {
+			log.Printf("[REMOTE-UDP] Failed to send reply to gateway %s: %v", sessionKey, err)
 		}
 	}
 }
 
+// closeSession 立即关闭并删除一个会话 (例如承载它的 QUIC 连接已经关闭)
+func (h *UDPHandler) closeSession(sessionKey string) {
+	if s, ok := h.sessions.LoadAndDelete(sessionKey); ok {
+		log.Printf("[REMOTE-UDP-DIAG] Closing UDP session for %s", sessionKey)
+		s.(*udpSession).targetConn.Close()
+	}
+}
+
 // cleanupLoop 定期清理过期的UDP会话
 func (h *UDPHandler) cleanupLoop() {
 	for range h.sessionCleanup.C {
@@ -195,46 +248,21 @@ func (h *UDPHandler) cleanupLoop() {
 	}
 }
 
-// parseSocks5UDPHeader 解析 SOCKS5 UDP 请求的头部
-func parseSocks5UDPHeader(data []byte) (*net.UDPAddr, []byte, error) {
-	if len(data) < 4 {
-		return nil, nil, io.ErrShortBuffer
-	}
-	// RSV(2), FRAG(1)
-	offset := 3
-	addrType := data[offset]
-	offset++
-
-	var host string
-	switch addrType {
-	case 0x01: // IPv4
-		if len(data) < offset+4+2 {
-			return nil, nil, io.ErrShortBuffer
-		}
-		host = net.IP(data[offset : offset+4]).String()
-		offset += 4
-	case 0x03: // Domain
-		if len(data) < offset+1 {
-			return nil, nil, io.ErrShortBuffer
-		}
-		domainLen := int(data[offset])
-		offset++
-		if len(data) < offset+domainLen+2 {
-			return nil, nil, io.ErrShortBuffer
-		}
-		host = string(data[offset : offset+domainLen])
-		offset += domainLen
-	default:
-		return nil, nil, fmt.Errorf("unsupported address type: %d", addrType)
+// stripUDPReplayGuard 取出 UDP 请求中的 ReplayGuard (如果有)，
+// 返回去掉该字段、并清除 RSV 标志后的标准 SOCKS5 UDP 数据。
+func stripUDPReplayGuard(data []byte) (ReplayGuard, bool, []byte, error) {
+	if len(data) < 3 || data[0]&udpFlagReplayGuard == 0 {
+		return ReplayGuard{}, false, data, nil
 	}
-
-	port := binary.BigEndian.Uint16(data[offset : offset+2])
-	offset += 2
-
-	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if len(data) < 3+replayGuardSize {
+		return ReplayGuard{}, false, nil, io.ErrShortBuffer
+	}
+	guard, err := readReplayGuard(bytes.NewReader(data[3 : 3+replayGuardSize]))
 	if err != nil {
-		return nil, nil, err
+		return ReplayGuard{}, false, nil, err
 	}
-
-	return addr, data[offset:], nil
+	stripped := make([]byte, 0, len(data)-replayGuardSize)
+	stripped = append(stripped, data[0]&^udpFlagReplayGuard, data[1], data[2])
+	stripped = append(stripped, data[3+replayGuardSize:]...)
+	return guard, true, stripped, nil
 }
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+)
+
+// UDP over stream: 元数据的流类型为 StreamUDP 时，流不再连接一个 TCP 目标，
+// 而是承载一串 UDP 数据报 (用于只开放 TCP/WebSocket 端口的平台)。
+// 数据帧解密后的内容是连续的记录，每条记录为:
+//
+//	len(2, 大端) | RSV(2) | FRAG(1) | ATYP | DST.ADDR | DST.PORT | DATA
+//
+// 即一个长度前缀加上与 UDP 端口相同的 SOCKS5 UDP 请求 (不含防重放字段，流的元数据已经带有)。
+// 下行记录格式相同，地址为回复的来源。一条记录可以跨越多个帧，一个帧也可以包含多条记录。
+// 每个流有独立的出站 UDP 套接字，两个方向都空闲超过 udpSessionTimeout 后流被关闭。
+
+// udpRecordChunk 是写出下行记录时单帧的最大明文长度
+const udpRecordChunk = 16 << 10
+
+// frameStream 把 frameReader 解密出的帧内容还原为字节流
+type frameStream struct {
+	fr  *frameReader
+	buf []byte
+}
+
+func (s *frameStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		frame, err := s.fr.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		s.buf = frame
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// readDeadliner 是可以设置读取期限的入站一侧 (net.Conn、smux 流、QUIC 流)
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// relayUDPStream 在一个 StreamUDP 流与新建的出站 UDP 套接字之间转发数据报，直到任一方向结束或空闲超时。
+// inbound 用于在空闲超时时中断上行读取；tag 是日志前缀。
+func relayUDPStream(tag string, user *auth.User, fr *frameReader, fw *frameWriter, inbound readDeadliner) {
+	targetConn, err := listenOutboundUDP()
+	if err != nil {
+		log.Printf("[%s-UDP] [%s] Failed to create outbound UDP socket: %v", tag, user, err)
+		return
+	}
+	defer targetConn.Close()
+
+	records := &frameStream{fr: fr}
+	lenBuf := make([]byte, 2)
+	recv := func() ([]byte, error) {
+		if _, err := io.ReadFull(records, lenBuf); err != nil {
+			return nil, err
+		}
+		record := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(records, record); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+	var record []byte
+	send := func(packet []byte) error {
+		if len(packet) > 0xffff {
+			return nil
+		}
+		record = binary.BigEndian.AppendUint16(record[:0], uint16(len(packet)))
+		record = append(record, packet...)
+		return writeChunked(fw, record)
+	}
+	relayDatagrams(tag, user, targetConn, recv, send, func() { inbound.SetReadDeadline(time.Now()) })
+}
+
+// relayDatagrams 在入站一侧与出站 UDP 套接字 targetConn 之间转发 SOCKS5 UDP 格式的数据报，
+// 直到任一方向结束或两个方向都空闲超过 udpSessionTimeout。
+// recv 返回下一个请求 (RSV | FRAG | ATYP | DST.ADDR | DST.PORT | DATA)，send 发出一个同样格式的回复，
+// stopInbound 在结束时调用，用于中断阻塞在 recv 中的读取。UDP over stream 和 SOCKS5 UDP ASSOCIATE 共用这一实现。
+func relayDatagrams(tag string, user *auth.User, targetConn net.PacketConn, recv func() ([]byte, error), send func([]byte) error, stopInbound func()) {
+	var lastActive atomic.Int64
+	touch := func() { lastActive.Store(time.Now().UnixNano()) }
+	touch()
+
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			close(done)
+			targetConn.Close()
+			stopInbound()
+		})
+	}
+
+	// 空闲检测
+	go func() {
+		ticker := time.NewTicker(udpSessionTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, lastActive.Load())) > udpSessionTimeout {
+					stop()
+					return
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Uplink (入站 -> 目标)
+	go func() {
+		defer wg.Done()
+		defer stop()
+		for {
+			request, err := recv()
+			if err != nil {
+				return
+			}
+			touch()
+			targetAddr, data, err := parseSocks5UDPHeader(request)
+			if err != nil {
+				log.Printf("[%s-UDP] [%s] Dropping malformed datagram: %v", tag, user, err)
+				continue
+			}
+			if _, err := targetConn.WriteTo(data, targetAddr); err != nil {
+				log.Printf("[%s-UDP] [%s] Failed to write to target %s: %v", tag, user, targetAddr, err)
+			}
+		}
+	}()
+
+	// Downlink (目标 -> 入站)
+	go func() {
+		defer wg.Done()
+		defer stop()
+		buf := make([]byte, 64<<10)
+		var packet []byte
+		for {
+			n, from, err := targetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			touch()
+			var ok bool
+			packet, ok = appendSocks5UDPHeader(packet[:0], from)
+			if !ok {
+				continue
+			}
+			packet = append(packet, buf[:n]...)
+			if err := send(packet); err != nil {
+				log.Printf("[%s-UDP] [%s] Failed to send reply: %v", tag, user, err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+// writeChunked 把 data 分成不超过 udpRecordChunk 的帧写出
+func writeChunked(fw *frameWriter, data []byte) error {
+	for len(data) > 0 {
+		chunk := data[:min(len(data), udpRecordChunk)]
+		if err := fw.WriteFrame(chunk); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
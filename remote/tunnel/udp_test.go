@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"liuproxy_remote/remote/auth"
+	"liuproxy_remote/remote/core/securecrypt"
+	"liuproxy_remote/remote/types"
+)
+
+// udpRequest 构造一个发往 target 的加密 UDP 请求
+func udpRequest(t *testing.T, c securecrypt.Cipher, target *net.UDPAddr) []byte {
+	t.Helper()
+	packet, _ := appendSocks5UDPHeader(nil, target)
+	sealed, err := c.Encrypt(append(packet, "ping"...))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return sealed
+}
+
+func TestUDPDatagram_SecurityChecks(t *testing.T) {
+	cfg := &types.Config{}
+	cfg.BufferSize = 4096
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}},
+		{Name: "carol", Keys: []types.KeyConf{{Generation: 1, Secret: "pw3"}}, Security: "pfs"},
+	}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	in := &Inbound{Cfg: cfg, Users: users, Replay: auth.NewReplayCache(time.Minute, 16)}
+	h := NewUDPHandler(in, nil)
+	defer h.sessionCleanup.Stop()
+
+	alice, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	carol, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("carol", "pw3"))
+	target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	noReply := func([]byte) error { return nil }
+
+	hasSession := func(key string) bool {
+		s, ok := h.sessions.Load(key)
+		if ok {
+			s.(*udpSession).targetConn.Close()
+		}
+		return ok
+	}
+
+	// 要求 pfs 的用户不能使用未经握手的 UDP 数据报
+	h.handleDatagram(udpRequest(t, carol, target), peer, "carol", noReply)
+	if hasSession("carol") {
+		t.Fatal("a pfs user opened a UDP session without a handshake")
+	}
+
+	h.handleDatagram(udpRequest(t, alice, target), peer, "alice", noReply)
+	if !hasSession("alice") {
+		t.Fatal("a standard user could not open a UDP session")
+	}
+
+	// require_handshake 时所有数据报都被丢弃
+	cfg.RemoteConf.RequireHandshake = true
+	h.handleDatagram(udpRequest(t, alice, target), peer, "alice-2", noReply)
+	if hasSession("alice-2") {
+		t.Fatal("require_handshake accepted a UDP datagram")
+	}
+}
+
+// guardedUDPRequest 构造一个带防重放字段、ID 为 id 的加密 UDP 请求
+func guardedUDPRequest(t *testing.T, c securecrypt.Cipher, target *net.UDPAddr, id byte) []byte {
+	t.Helper()
+	header, _ := appendSocks5UDPHeader(nil, target)
+	packet := []byte{header[0] | udpFlagReplayGuard, header[1], header[2]}
+	packet = binary.BigEndian.AppendUint64(packet, uint64(time.Now().Unix()))
+	packet = append(packet, id)
+	packet = append(packet, make([]byte, auth.ReplayIDSize-1)...)
+	packet = append(packet, header[3:]...)
+	sealed, err := c.Encrypt(append(packet, "ping"...))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return sealed
+}
+
+func TestUDPDatagram_ReplayBudget(t *testing.T) {
+	cfg := &types.Config{}
+	cfg.BufferSize = 4096
+	cfg.Users = []types.UserConf{
+		{Name: "alice", Keys: []types.KeyConf{{Generation: 1, Secret: "pw"}}},
+		{Name: "mallory", Keys: []types.KeyConf{{Generation: 1, Secret: "pw4"}}},
+	}
+	users, err := auth.NewRegistry(cfg)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	in := &Inbound{Cfg: cfg, Users: users, Replay: auth.NewReplayCache(time.Minute, 1), DatagramReplay: auth.NewReplayCache(time.Minute, 2)}
+	h := NewUDPHandler(in, nil)
+	defer h.sessionCleanup.Stop()
+	defer h.sessions.Range(func(_, s any) bool { s.(*udpSession).targetConn.Close(); return true })
+
+	alice, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("alice", "pw"))
+	mallory, _ := securecrypt.NewCipherWithKey(securecrypt.DefaultSuite, securecrypt.DeriveKey("mallory", "pw4"))
+	target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	noReply := func([]byte) error { return nil }
+
+	// mallory 的 UDP 数据报用完了自己的数据报配额
+	for id := byte(1); id <= 3; id++ {
+		h.handleDatagram(guardedUDPRequest(t, mallory, target, id), peer, "mallory", noReply)
+	}
+	if err := in.checkDatagramReplay(users.Lookup("mallory"), true, ReplayGuard{Timestamp: time.Now(), ID: [auth.ReplayIDSize]byte{4}}); err != auth.ErrReplayCacheFull {
+		t.Fatalf("mallory's datagram budget: err = %v, want ErrReplayCacheFull", err)
+	}
+
+	// 其他用户的数据报不受影响，数据报也没有占用任何人新建连接的配额
+	h.handleDatagram(guardedUDPRequest(t, alice, target, 1), peer, "alice", noReply)
+	if _, ok := h.sessions.Load("alice"); !ok {
+		t.Fatal("alice's datagram was rejected after mallory filled their budget")
+	}
+	for _, name := range []string{"alice", "mallory"} {
+		if err := in.checkReplay(users.Lookup(name), true, ReplayGuard{Timestamp: time.Now(), ID: [auth.ReplayIDSize]byte{9}}); err != nil {
+			t.Fatalf("new connection for %s after the UDP burst: %v", name, err)
+		}
+	}
+}
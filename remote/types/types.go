@@ -4,6 +4,7 @@ package types
 import (
 	"bufio"
 	"net"
+	"time"
 )
 
 // Agent 接口定义了所有代理处理器的通用行为。
@@ -22,15 +23,183 @@ type CommonConf struct {
 	MaxConnections int    `ini:"maxConnections"`
 	BufferSize     int    `ini:"bufferSize"`
 	Crypt          int    `ini:"crypt"`
+	// LegacyCrypt 为 true 时，继续接受用 crypt 整数密钥加密的旧客户端。
+	// 该模式的密钥空间很小，只应在迁移期间开启。
+	LegacyCrypt bool `ini:"legacy_crypt"`
 }
 
 // RemoteConf 包含 remote 模式特有的配置
 type RemoteConf struct {
 	PortWsSvr int `ini:"port_ws_svr"`
+	// Bind 是逗号分隔的监听 IP 地址 (如 "0.0.0.0, ::")，TCP、UDP 和 KCP 端口在每个地址上分别监听。
+	// 空字符串表示在所有地址上以 IPv4/IPv6 双栈监听。
+	// "unix:/路径" 和 "unix:@名字" (Linux 抽象命名空间) 表示 Unix 套接字，只接受 TCP 上的入站模式
+	Bind string `ini:"bind"`
+	// SocketMode 和 SocketOwner 是 Unix 套接字文件的权限 (八进制，如 "0660") 和属主 ("用户:组"，可以是名字或数字)，
+	// 空字符串表示保持默认
+	SocketMode  string `ini:"socket_mode"`
+	SocketOwner string `ini:"socket_owner"`
+	UsersFile   string `ini:"users_file"`
+	// ReplayWindow 是防重放时间窗口 (秒)，时间戳偏差超过它的请求被拒绝
+	ReplayWindow int `ini:"replay_window"`
+	// RequireReplayGuard 为 true 时拒绝不带时间戳和唯一 ID 的旧格式请求
+	RequireReplayGuard bool `ini:"require_replay_guard"`
+	// StatsInterval 是统计日志的输出间隔 (秒)，0 表示不输出
+	StatsInterval int `ini:"stats_interval"`
+	// Suite 是该监听器默认接受的加密套件，"auto" 表示接受所有套件
+	Suite string `ini:"suite"`
+	// RequireHandshake 为 true 时只接受先完成会话握手 (前向安全) 的客户端
+	RequireHandshake bool `ini:"require_handshake"`
+	// Padding、PaddingFirst 和 PaddingJitter 是监听器级的填充和延迟抖动设置，
+	// 格式为 "min-max"，含义见 PaddingConf
+	Padding       string `ini:"padding"`
+	PaddingFirst  string `ini:"padding_first"`
+	PaddingJitter string `ini:"padding_jitter"`
+	// Fallback 是回落地址 (host:port)。未通过认证的 Multi-Conn 连接会被透明地转发到这里，
+	// 空字符串表示直接关闭这类连接
+	Fallback string `ini:"fallback"`
+	// WsPaths 是逗号分隔的 WebSocket 隧道路径，空字符串表示任何路径的升级请求都进入隧道
+	WsPaths string `ini:"ws_paths"`
+	// DecoyDir 和 DecoyUpstream 决定非隧道 HTTP 请求的处理方式:
+	// 提供静态目录中的文件，或反向代理到上游站点 (同时设置时反向代理优先)
+	DecoyDir      string `ini:"decoy_dir"`
+	DecoyUpstream string `ini:"decoy_upstream"`
+	// GrpcService 是 gRPC 传输的服务名，客户端调用 /<GrpcService>/Tun 双向流方法承载 Mux 会话。
+	// 空字符串表示不开启 gRPC 传输
+	GrpcService string `ini:"grpc_service"`
+	// Quic 为 true 时，UDP 端口改为运行 QUIC 监听器 (需要 TLSCert/TLSKey):
+	// 每个 QUIC 流承载一个隧道流，UDP 请求通过 QUIC 数据报传输
+	Quic bool `ini:"quic"`
+	// UdpPort 是开启 QUIC 时旧格式 UDP 请求使用的独立端口，0 表示开启 QUIC 后不再接受旧格式的 UDP 请求。
+	// 只用于默认监听器，配置了 [listener.*] 节时改在监听器节中设置
+	UdpPort int `ini:"udp_port"`
+	// Socks5Port 是内置 SOCKS5 代理的端口 (监听 Socks5Bind)，0 表示不开启。
+	// 配置了 [listener.NAME] 节时不能设置它和 Socks5Bind，改用 modes = socks5 的监听器
+	Socks5Port int `ini:"socks5_port"`
+	// Socks5Bind 是内置 SOCKS5 代理的监听地址，写法与 Bind 相同。SOCKS5 不加密，空字符串表示只监听 127.0.0.1
+	Socks5Bind string `ini:"socks5_bind"`
+	// KcpPort 是 KCP 监听器的 UDP 端口，0 表示不开启。KCP 连接上运行 Mux 会话，适合丢包严重的链路。
+	// 只用于默认监听器，配置了 [listener.*] 节时改在监听器节中设置
+	KcpPort int `ini:"kcp_port"`
+	// KcpProfile 是 KCP 参数的预设: normal、fast (默认)、fast2 或 fast3，越往后越激进
+	KcpProfile string `ini:"kcp_profile"`
+	// KcpNoDelay、KcpInterval、KcpResend 和 KcpNC 覆盖预设中的同名参数，空字符串表示使用预设的值
+	KcpNoDelay  string `ini:"kcp_nodelay"`
+	KcpInterval string `ini:"kcp_interval"`
+	KcpResend   string `ini:"kcp_resend"`
+	KcpNC       string `ini:"kcp_nc"`
+	// KcpSndWnd、KcpRcvWnd 和 KcpMTU 是发送/接收窗口 (包数) 和 MTU，0 表示使用默认值
+	KcpSndWnd int `ini:"kcp_sndwnd"`
+	KcpRcvWnd int `ini:"kcp_rcvwnd"`
+	KcpMTU    int `ini:"kcp_mtu"`
+	// KcpFEC 是前向纠错的 "数据分片,校验分片"，例如 "10,3"；"0,0" 关闭 FEC，空字符串表示 "10,3"
+	KcpFEC string `ini:"kcp_fec"`
+	// RequireWsToken 为 true 时，WebSocket 升级请求必须携带有效令牌或使用用户的秘密路径
+	RequireWsToken bool `ini:"require_ws_token"`
+	// WsOrigins 是逗号分隔的、允许发起 WebSocket 升级的其他来源 (浏览器的 Origin 头)，"*" 表示任意来源。
+	// 不带 Origin 的请求和同源请求总是允许
+	WsOrigins string `ini:"ws_origins"`
+	// TLSCert 和 TLSKey 是逗号分隔的证书和私钥文件 (PEM)，按顺序一一对应。
+	// 设置后监听器自行终结 TLS，按 SNI 选择证书，文件变化时自动重新加载
+	TLSCert string `ini:"tls_cert"`
+	TLSKey  string `ini:"tls_key"`
+	// TLSClientCA 是验证客户端证书 (mTLS) 的 CA 证书包，设置后每个连接都必须出示由它签发的证书，
+	// 证书的 SAN 或 Subject CN 成为连接的身份
+	TLSClientCA string `ini:"tls_client_ca"`
+	// TLSClientAllow 是逗号分隔的证书身份模式，为空表示接受 CA 签发的任何证书
+	TLSClientAllow string `ini:"tls_client_allow"`
+	// TLSClientFallback 为 true 时，没有有效客户端证书的连接被转交给 Fallback 地址而不是直接关闭
+	TLSClientFallback bool `ini:"tls_client_fallback"`
+	// ProxyProtocol 为 true 时识别连接开头的 PROXY 协议 v1/v2 头，用其中的地址作为客户端地址
+	ProxyProtocol bool `ini:"proxy_protocol"`
+	// TrustedProxies 是逗号分隔的受信任代理 (IP 或 CIDR)。设置后只接受来自它们的 PROXY 协议头和转发头
+	TrustedProxies string `ini:"trusted_proxies"`
+	// TrustUnixSocket 为 true 时，Unix 套接字的对端 (本机的 nginx 等) 也被视为受信任的代理
+	TrustUnixSocket bool `ini:"trust_unix_socket"`
+	// RealIPHeaders 是逗号分隔的 HTTP 头名 (如 CF-Connecting-IP、X-Forwarded-For)，
+	// 来自受信任代理 (包括 TrustUnixSocket 时的 Unix 套接字) 的请求按顺序从中取真实客户端地址
+	RealIPHeaders string `ini:"real_ip_headers"`
+	// AllowIPs 和 DenyIPs 是逗号分隔的 IP 或 CIDR，作用于真实客户端地址。
+	// AllowIPs 不为空时只接受其中的地址；DenyIPs 优先于 AllowIPs
+	AllowIPs string `ini:"allow_ips"`
+	DenyIPs  string `ini:"deny_ips"`
+}
+
+// ListenerConf 描述一个由 [listener.NAME] 节定义的监听器。
+// 配置了任何监听器时，它们取代由 port_ws_svr 和 bind 定义的默认监听器
+type ListenerConf struct {
+	Name string
+	// Bind 和 Port 是监听地址和端口，Bind 的写法与 RemoteConf.Bind 相同。只监听 Unix 套接字时不需要 Port
+	Bind string
+	Port int
+	// SocketMode 和 SocketOwner 是 Unix 套接字文件的权限和属主，含义与 RemoteConf 中的同名项相同
+	SocketMode  string
+	SocketOwner string
+	// Modes 是逗号分隔的入站模式: ws (HTTP，包括 WebSocket、gRPC 和伪装站点)、mux、multi-conn、udp 和 socks5。
+	// 空字符串表示除 socks5 以外的全部模式
+	Modes string
+	// TLSCert、TLSKey、TLSClientCA 和 TLSClientAllow 是该监听器的 TLS 设置，含义与 RemoteConf 中的同名项相同。
+	// 未设置证书时该监听器不终结 TLS
+	TLSCert        string
+	TLSKey         string
+	TLSClientCA    string
+	TLSClientAllow string
+	// Users 是逗号分隔的用户名，只有这些用户可以通过该监听器接入；空字符串表示所有用户
+	Users string
+	// Suite 是该监听器接受的加密套件，覆盖 [remote] suite；单独配置了 suite 的用户不受影响
+	Suite string
+	// KcpPort 是该监听器的 KCP 端口 (UDP)，0 表示不开启。KCP 连接与 mux 模式的连接一样受 Users 和 Modes 限制，
+	// 参数沿用 [remote] 中的 kcp_* 设置
+	KcpPort int
+	// UdpPort 是开启 QUIC 时该监听器接受旧格式 UDP 请求的端口，0 表示不接受
+	UdpPort int
+}
+
+// PaddingConf 是一组填充和流量整形设置，每一项都是 "min-max" 形式的区间，空字符串表示沿用上一级设置
+type PaddingConf struct {
+	// Frame 是每个下行帧的随机填充字节数
+	Frame string
+	// First 是客户端第一个包 (元数据) 必须携带的填充字节数
+	First string
+	// Jitter 是每个下行帧发送前的随机延迟 (毫秒)
+	Jitter string
+}
+
+// UserConf 描述一个允许接入隧道的用户。
+// 简单写法来自 [users] 节，每行一个 "名字 = 口令"；
+// 需要轮换密钥时使用 [user.名字] 节，为每一代密钥写一行 key.N。
+// 口令经 Argon2id 派生为密钥，用户名同时作为盐的一部分。
+type UserConf struct {
+	Name string
+	Keys []KeyConf
+	// Suite 覆盖监听器的加密套件设置，空字符串表示沿用监听器设置
+	Suite string
+	// Security 是该用户要求的最低会话安全级别: standard、pfs 或 pq
+	Security string
+	// Padding 覆盖监听器的填充设置
+	Padding PaddingConf
+	// Certs 是逗号分隔的客户端证书身份模式，设置后该用户只能通过匹配的证书接入
+	Certs string
+	// Token 是该用户在 WebSocket 升级请求中出示的令牌
+	Token string
+	// WsPath 是该用户专属的秘密 WebSocket 路径，访问它即认证为该用户
+	WsPath string
+	// Socks5Password 是该用户通过内置 SOCKS5 代理接入时使用的密码，空字符串表示不能使用 SOCKS5
+	Socks5Password string
+}
+
+// KeyConf 是某个用户的一代密钥
+type KeyConf struct {
+	Generation int
+	Secret     string
+	// RetireAfter 之后该密钥不再被接受；零值表示永不退役
+	RetireAfter time.Time
 }
 
 // Config 是整个应用程序的统一配置结构体
 type Config struct {
 	CommonConf `ini:"common"`
 	RemoteConf `ini:"remote"`
+	Users      []UserConf     `ini:"-"`
+	Listeners  []ListenerConf `ini:"-"`
 }